@@ -0,0 +1,134 @@
+package walker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// BlacklistedAddrError is the FetchError of fetches whose connection was
+// refused because the host resolved to a blacklisted IP address (see
+// Config.BlacklistPrivateIPs).
+type BlacklistedAddrError struct {
+	// Addr is the address that was dialed, ex. internal.test.com:80
+	Addr string
+
+	// IP the address resolved to
+	IP net.IP
+}
+
+func (e *BlacklistedAddrError) Error() string {
+	return fmt.Sprintf("%v resolved to blacklisted IP address %v", e.Addr, e.IP)
+}
+
+// blacklistError returns the *BlacklistedAddrError err is or wraps, or nil if
+// it isn't one.
+func blacklistError(err error) *BlacklistedAddrError {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	berr, _ := err.(*BlacklistedAddrError)
+	return berr
+}
+
+// ipBlacklist refuses connections to addresses in its denied networks, unless
+// they are also in its allowed networks.
+type ipBlacklist struct {
+	deny  []*net.IPNet
+	allow []*net.IPNet
+}
+
+// newIPBlacklist creates the blacklist set by Config.DeniedNetworks and
+// Config.AllowedNetworks.
+func newIPBlacklist() (*ipBlacklist, error) {
+	deny, err := parseNetworks(Config.DeniedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parseNetworks(Config.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	return &ipBlacklist{deny: deny, allow: allow}, nil
+}
+
+// parseNetworks parses CIDR ranges, ex. 10.0.0.0/8 or fc00::/7. A single IP
+// address is treated as a range of just that address.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, n := range networks {
+		n = strings.TrimSpace(n)
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR range %q", n)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range %q", n)
+		}
+		parsed = append(parsed, network)
+	}
+	return parsed, nil
+}
+
+// blocked returns true if connections to ip are not allowed. IPv4 addresses
+// written as IPv6 (ex. ::ffff:127.0.0.1) match the IPv4 ranges.
+func (b *ipBlacklist) blocked(ip net.IP) bool {
+	for _, network := range b.allow {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	for _, network := range b.deny {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapDial wraps dial so it refuses to connect to blocked addresses, failing
+// with a *BlacklistedAddrError. Addresses that are already IPs are checked
+// before dialing; for host names, the address dial connected to is checked,
+// and the connection closed before anything is sent if it is blocked.
+func (b *ipBlacklist) wrapDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = net.Dial
+	}
+	return func(network, addr string) (net.Conn, error) {
+		if ip := net.ParseIP(hostOf(addr)); ip != nil && b.blocked(ip) {
+			return nil, &BlacklistedAddrError{Addr: addr, IP: ip}
+		}
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(hostOf(conn.RemoteAddr().String()))
+		if ip != nil && b.blocked(ip) {
+			conn.Close()
+			return nil, &BlacklistedAddrError{Addr: addr, IP: ip}
+		}
+		return conn, nil
+	}
+}
+
+// hostOf returns the host of a host:port address, ex. "::1" for "[::1]:80",
+// or addr itself if it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
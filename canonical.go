@@ -0,0 +1,165 @@
+package walker
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/charset"
+)
+
+// defaultPorts are the ports StripDefaultPorts removes for each scheme
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Canonicalize rewrites u into its canonical form, so equivalent links (ex.
+// http://Example.com:80/a/../b?x=1&utm_source=y#frag and
+// http://example.com/b?x=1) are stored and deduplicated as one link. The
+// rules applied are set in Config.Canonicalization.
+func (u *URL) Canonicalize() {
+	c := &Config.Canonicalization
+
+	if c.LowercaseHost {
+		u.Host = strings.ToLower(u.Host)
+	}
+
+	if c.StripDefaultPorts {
+		host, port, err := net.SplitHostPort(u.Host)
+		if err == nil && port == defaultPorts[u.Scheme] {
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			u.Host = host
+		}
+	}
+
+	if c.ResolveDotSegments {
+		if p := removeDotSegments(u.Path); p != u.Path {
+			u.Path = p
+			u.RawPath = ""
+		}
+	}
+
+	if c.DropFragments {
+		u.Fragment = ""
+	}
+
+	if u.RawQuery != "" && (c.SortQuery || len(c.StripQueryParams) > 0) {
+		var params []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			if param == "" || isStrippedQueryParam(param) {
+				continue
+			}
+			params = append(params, param)
+		}
+		if c.SortQuery {
+			sort.Strings(params)
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+}
+
+// removeDotSegments resolves "." and ".." segments in path, following RFC
+// 3986 section 5.2.4.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	var out []string
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// out[0] is the empty segment before the leading slash, which we
+			// never remove
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// isStrippedQueryParam returns true if the raw query parameter param (ex.
+// "utm_source=feed") is in Config.Canonicalization.StripQueryParams. Entries
+// ending in '*' match any parameter starting with the rest of the entry.
+func isStrippedQueryParam(param string) bool {
+	name := param
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+	name = strings.ToLower(name)
+
+	for _, strip := range Config.Canonicalization.StripQueryParams {
+		strip = strings.ToLower(strip)
+		if strings.HasSuffix(strip, "*") {
+			if strings.HasPrefix(name, strip[:len(strip)-1]) {
+				return true
+			}
+		} else if name == strip {
+			return true
+		}
+	}
+	return false
+}
+
+// getCanonicalLink returns the href of the page's <link rel="canonical">
+// tag, or nil if it doesn't have one.
+func getCanonicalLink(contents []byte) (*URL, error) {
+	utf8Reader, err := charset.NewReader(bytes.NewReader(contents), "text/html")
+	if err != nil {
+		return nil, err
+	}
+	tokenizer := html.NewTokenizer(utf8Reader)
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return nil, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tagName, hasAttrs := tokenizer.TagName()
+			if string(tagName) == "body" {
+				// rel=canonical is only valid in the head
+				return nil, nil
+			}
+			if string(tagName) != "link" || !hasAttrs {
+				continue
+			}
+
+			var rel, href string
+			for {
+				key, val, moreAttr := tokenizer.TagAttr()
+				switch string(key) {
+				case "rel":
+					rel = strings.ToLower(strings.TrimSpace(string(val)))
+				case "href":
+					href = strings.TrimSpace(string(val))
+				}
+				if !moreAttr {
+					break
+				}
+			}
+			if rel == "canonical" && href != "" {
+				return ParseURL(href)
+			}
+		}
+	}
+}
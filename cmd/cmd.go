@@ -55,6 +55,21 @@ func Dispatcher(d walker.Dispatcher) {
 	commander.Dispatcher = d
 }
 
+// RecrawlPolicy sets the policy dispatchers in this process use to choose
+// which links to refresh, overriding the recrawl_policy config setting
+func RecrawlPolicy(p walker.RecrawlPolicy) {
+	walker.SetRecrawlPolicy(p)
+}
+
+// LinkExtractor sets the extractor fetchers in this process use to parse
+// links out of content of the given media types (see
+// walker.RegisterLinkExtractor)
+func LinkExtractor(mediaTypes []string, e walker.LinkExtractor) {
+	if err := walker.RegisterLinkExtractor(mediaTypes, e); err != nil {
+		fatalf("Failed to register link extractor for %v: %v", mediaTypes, err)
+	}
+}
+
 // Execute will run the command specified by the command line
 func Execute() {
 	commander.Execute()
@@ -76,6 +91,70 @@ func fatalf(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// initDatastore sets the datastore (and dispatcher, if the datastore needs
+// one) selected by the `datastore` config value, unless a datastore has
+// already been set.
+func initDatastore() {
+	if commander.Datastore != nil {
+		return
+	}
+
+	switch walker.Config.Datastore {
+	case "memory":
+		commander.Datastore = walker.NewMemoryDatastore()
+	case "sql":
+		ds, err := walker.NewSQLDatastore()
+		if err != nil {
+			fatalf("Failed creating SQL datastore: %v", err)
+		}
+		commander.Datastore = ds
+		commander.Dispatcher = &walker.SQLDispatcher{}
+	default:
+		ds, err := walker.NewCassandraDatastore()
+		if err != nil {
+			fatalf("Failed creating Cassandra datastore: %v", err)
+		}
+		commander.Datastore = ds
+		commander.Dispatcher = &walker.CassandraDispatcher{}
+	}
+}
+
+// storeSeeds adds the links in the seeds config value to the datastore, along
+// with their domains (like the seed command).
+func storeSeeds() {
+	if len(walker.Config.Seeds) == 0 {
+		return
+	}
+	orig := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = orig }()
+	walker.Config.AddNewDomains = true
+
+	for _, seed := range walker.Config.Seeds {
+		u, err := walker.ParseURL(seed)
+		if err != nil {
+			fatalf("Could not parse seed %v as a url: %v", seed, err)
+		}
+		u.Canonicalize()
+		commander.Datastore.StoreParsedURL(u, nil)
+	}
+	fmt.Printf("Seeded %v links\n", len(walker.Config.Seeds))
+}
+
+// domainExcluder initializes the datastore for the exclude and include
+// commands, exiting if it can't exclude domains.
+func domainExcluder() walker.DomainExcluder {
+	if commander.Datastore == nil && walker.Config.Datastore == "memory" {
+		fatalf("The memory datastore cannot be modified from a separate process")
+	}
+	initDatastore()
+
+	excluder, ok := commander.Datastore.(walker.DomainExcluder)
+	if !ok {
+		fatalf("The datastore does not support excluding domains")
+	}
+	return excluder
+}
+
 func init() {
 	walkerCommand := &cobra.Command{
 		Use: "walker",
@@ -99,14 +178,8 @@ func init() {
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig()
 
-			if commander.Datastore == nil {
-				ds, err := walker.NewCassandraDatastore()
-				if err != nil {
-					fatalf("Failed creating Cassandra datastore: %v", err)
-				}
-				commander.Datastore = ds
-				commander.Dispatcher = &walker.CassandraDispatcher{}
-			}
+			initDatastore()
+			storeSeeds()
 
 			if commander.Handler == nil {
 				commander.Handler = &walker.SimpleWriterHandler{}
@@ -128,7 +201,13 @@ func init() {
 			}
 
 			if !noConsole {
-				console.Start()
+				if walker.Config.Datastore != "cassandra" {
+					// The console reads directly from Cassandra
+					fmt.Printf("The console is not available with the %v datastore, not starting it\n",
+						walker.Config.Datastore)
+				} else {
+					console.Start()
+				}
 			}
 
 			sig := make(chan os.Signal)
@@ -150,14 +229,8 @@ func init() {
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig()
 
-			if commander.Datastore == nil {
-				ds, err := walker.NewCassandraDatastore()
-				if err != nil {
-					fatalf("Failed creating Cassandra datastore: %v", err)
-				}
-				commander.Datastore = ds
-				commander.Dispatcher = &walker.CassandraDispatcher{}
-			}
+			initDatastore()
+			storeSeeds()
 
 			if commander.Handler == nil {
 				commander.Handler = &walker.SimpleWriterHandler{}
@@ -185,7 +258,14 @@ func init() {
 			readConfig()
 
 			if commander.Dispatcher == nil {
-				commander.Dispatcher = &walker.CassandraDispatcher{}
+				switch walker.Config.Datastore {
+				case "memory":
+					fatalf("The memory datastore does not use a dispatcher")
+				case "sql":
+					commander.Dispatcher = &walker.SQLDispatcher{}
+				default:
+					commander.Dispatcher = &walker.CassandraDispatcher{}
+				}
 			}
 
 			go func() {
@@ -204,7 +284,8 @@ func init() {
 	}
 	walkerCommand.AddCommand(dispatchCommand)
 
-	var seedURL string
+	var seedURL, seedSitemap string
+	var seedPriority int
 	seedCommand := &cobra.Command{
 		Use:   "seed",
 		Short: "add a seed URL to the datastore",
@@ -214,7 +295,14 @@ func init() {
     - Adding any other link that needs to be crawled soon
 
 This command will insert the provided link and also add its domain to the
-crawl, regardless of the add_new_domains configuration setting.`,
+crawl, regardless of the add_new_domains configuration setting.
+
+With --sitemap, every link listed in the given sitemap (following sitemap
+indexes) is inserted instead, along with its lastmod, changefreq and priority.
+
+If --priority is given the domain's crawl priority is set as well. Domains
+with higher priority have segments generated and are crawled first (the
+default priority is 0).`,
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig()
 
@@ -222,28 +310,107 @@ crawl, regardless of the add_new_domains configuration setting.`,
 			defer func() { walker.Config.AddNewDomains = orig }()
 			walker.Config.AddNewDomains = true
 
-			if seedURL == "" {
-				fatalf("Seed URL needed to execute; add on with --url/-u")
+			if seedURL == "" && seedSitemap == "" {
+				fatalf("Seed URL needed to execute; add on with --url/-u or --sitemap/-s")
+			}
+			if seedURL != "" && seedSitemap != "" {
+				fatalf("Only one of --url and --sitemap can be given")
 			}
-			u, err := walker.ParseURL(seedURL)
+			link := seedURL
+			if seedSitemap != "" {
+				link = seedSitemap
+			}
+			u, err := walker.ParseURL(link)
 			if err != nil {
-				fatalf("Could not parse %v as a url: %v", seedURL, err)
+				fatalf("Could not parse %v as a url: %v", link, err)
 			}
+			u.Canonicalize()
 
-			if commander.Datastore == nil {
-				ds, err := walker.NewCassandraDatastore()
-				if err != nil {
-					fatalf("Failed creating Cassandra datastore: %v", err)
+			if commander.Datastore == nil && walker.Config.Datastore == "memory" {
+				fatalf("The memory datastore cannot be seeded from a separate process; " +
+					"list seeds in the seeds config value instead")
+			}
+			initDatastore()
+
+			if seedSitemap != "" {
+				links := walker.SitemapLinks(u)
+				if len(links) == 0 {
+					fatalf("Found no links in sitemap %v", u)
 				}
-				commander.Datastore = ds
+				for _, l := range links {
+					l.Canonicalize()
+					commander.Datastore.StoreParsedURL(l, nil)
+				}
+				fmt.Printf("Seeded %v links from %v\n", len(links), u)
+			} else {
+				commander.Datastore.StoreParsedURL(u, nil)
 			}
 
-			commander.Datastore.StoreParsedURL(u, nil)
+			if cmd.Flags().Lookup("priority").Changed {
+				prioritizer, ok := commander.Datastore.(walker.DomainPrioritizer)
+				if !ok {
+					fatalf("The datastore does not support domain priorities")
+				}
+				dom, err := u.ToplevelDomainPlusOne()
+				if err != nil {
+					fatalf("Could not get the domain of %v: %v", u, err)
+				}
+				if err := prioritizer.SetDomainPriority(dom, seedPriority); err != nil {
+					fatalf("Failed to set priority: %v", err)
+				}
+			}
 		},
 	}
 	seedCommand.Flags().StringVarP(&seedURL, "url", "u", "", "URL to add as a seed")
+	seedCommand.Flags().StringVarP(&seedSitemap, "sitemap", "s", "", "sitemap whose links to add as seeds")
+	seedCommand.Flags().IntVarP(&seedPriority, "priority", "p", 0, "crawl priority to give the seed's domain")
 	walkerCommand.AddCommand(seedCommand)
 
+	var excludeDomain, excludeReason string
+	excludeCommand := &cobra.Command{
+		Use:   "exclude",
+		Short: "exclude a domain from the crawl",
+		Long: `Exclude marks a domain so that it is never dispatched or crawled, recording
+the reason it was excluded (shown in the console). The domain is added to the
+crawl if it isn't already part of it, so it can be excluded ahead of time.
+
+Use the include command to crawl the domain again.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			readConfig()
+			if excludeDomain == "" {
+				fatalf("Domain needed to execute; add on with --domain/-d")
+			}
+			if excludeReason == "" {
+				fatalf("Reason needed to execute; add on with --reason/-r")
+			}
+
+			if err := domainExcluder().ExcludeDomain(excludeDomain, excludeReason); err != nil {
+				fatalf("Failed to exclude %v: %v", excludeDomain, err)
+			}
+		},
+	}
+	excludeCommand.Flags().StringVarP(&excludeDomain, "domain", "d", "", "domain (TLD+1) to exclude")
+	excludeCommand.Flags().StringVarP(&excludeReason, "reason", "r", "manually excluded", "why the domain is excluded")
+	walkerCommand.AddCommand(excludeCommand)
+
+	var includeDomain string
+	includeCommand := &cobra.Command{
+		Use:   "include",
+		Short: "include a previously excluded domain in the crawl",
+		Run: func(cmd *cobra.Command, args []string) {
+			readConfig()
+			if includeDomain == "" {
+				fatalf("Domain needed to execute; add on with --domain/-d")
+			}
+
+			if err := domainExcluder().IncludeDomain(includeDomain); err != nil {
+				fatalf("Failed to include %v: %v", includeDomain, err)
+			}
+		},
+	}
+	includeCommand.Flags().StringVarP(&includeDomain, "domain", "d", "", "domain (TLD+1) to include")
+	walkerCommand.AddCommand(includeCommand)
+
 	var outfile string
 	schemaCommand := &cobra.Command{
 		Use:   "schema",
@@ -255,6 +422,11 @@ Useful for something like:
     $ walker schema -o schema.cql
     $ <edit schema.cql further as desired>
     $ cqlsh -f schema.cql
+
+With the sql datastore it prints the SQL DDL for the configured driver
+instead:
+    $ walker schema -o schema.sql
+    $ sqlite3 walker.db < schema.sql
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			readConfig()
@@ -268,7 +440,12 @@ Useful for something like:
 			}
 			defer out.Close()
 
-			schema, err := walker.GetCassandraSchema()
+			var schema string
+			if walker.Config.Datastore == "sql" {
+				schema, err = walker.GetSQLSchema()
+			} else {
+				schema, err = walker.GetCassandraSchema()
+			}
 			if err != nil {
 				panic(err.Error())
 			}
@@ -33,32 +33,156 @@ func init() {
 // walker. It reads values straight from the config file (walker.yaml by
 // default). See sample-walker.yaml for explanations and default values.
 type WalkerConfig struct {
-	AddNewDomains           bool     `yaml:"add_new_domains"`
-	AddedDomainsCacheSize   int      `yaml:"added_domains_cache_size"`
-	MaxDNSCacheEntries      int      `yaml:"max_dns_cache_entries"`
-	UserAgent               string   `yaml:"user_agent"`
-	AcceptFormats           []string `yaml:"accept_formats"`
-	AcceptProtocols         []string `yaml:"accept_protocols"`
-	DefaultCrawlDelay       int      `yaml:"default_crawl_delay"`
-	MaxHTTPContentSizeBytes int64    `yaml:"max_http_content_size_bytes"`
-	IgnoreTags              []string `yaml:"ignore_tags"`
-	//TODO: allow -1 as a no max value
-	MaxLinksPerPage         int  `yaml:"max_links_per_page"`
-	NumSimultaneousFetchers int  `yaml:"num_simultaneous_fetchers"`
-	BlacklistPrivateIPs     bool `yaml:"blacklist_private_ips"`
+	Datastore                string   `yaml:"datastore"`
+	Seeds                    []string `yaml:"seeds"`
+	AddNewDomains            bool     `yaml:"add_new_domains"`
+	AddedDomainsCacheSize    int      `yaml:"added_domains_cache_size"`
+	MaxDNSCacheEntries       int      `yaml:"max_dns_cache_entries"`
+	UserAgent                string   `yaml:"user_agent"`
+	AcceptFormats            []string `yaml:"accept_formats"`
+	AcceptProtocols          []string `yaml:"accept_protocols"`
+	DefaultCrawlDelay        int      `yaml:"default_crawl_delay"`
+	MaxHTTPContentSizeBytes  int64    `yaml:"max_http_content_size_bytes"`
+	TruncateOversizedContent bool     `yaml:"truncate_oversized_content"`
+	IgnoreTags               []string `yaml:"ignore_tags"`
+	// MaxLinksPerPage of -1 means no max; LinkSelection is one of first,
+	// same_domain_first or sample
+	MaxLinksPerPage         int    `yaml:"max_links_per_page"`
+	LinkSelection           string `yaml:"link_selection"`
+	NumSimultaneousFetchers int    `yaml:"num_simultaneous_fetchers"`
+	BlacklistPrivateIPs     bool   `yaml:"blacklist_private_ips"`
+	// CIDR ranges (or single IPs) fetchers may not connect to when
+	// BlacklistPrivateIPs is set, unless they are in AllowedNetworks
+	DeniedNetworks  []string `yaml:"denied_networks"`
+	AllowedNetworks []string `yaml:"allowed_networks"`
 
 	Dispatcher struct {
 		MaxLinksPerSegment   int     `yaml:"num_links_per_segment"`
 		RefreshPercentage    float64 `yaml:"refresh_percentage"`
 		NumConcurrentDomains int     `yaml:"num_concurrent_domains"`
+
+		// Seconds; a StaleClaimTimeout of 0 disables releasing stale claims
+		StaleClaimTimeout       int `yaml:"stale_claim_timeout"`
+		StaleClaimCheckInterval int `yaml:"stale_claim_check_interval"`
+
+		// Pages whose fingerprint hasn't changed in StableCrawlCount crawls
+		// are refreshed at most every StableRecrawlDelay seconds
+		StableCrawlCount   int `yaml:"stable_crawl_count"`
+		StableRecrawlDelay int `yaml:"stable_recrawl_delay"`
+
+		CollapseStructuralDuplicates bool `yaml:"collapse_structural_duplicates"`
+
+		// RecrawlPolicy is one of change_rate or age (see RecrawlPolicy);
+		// DefaultChangeInterval is in seconds
+		RecrawlPolicy         string `yaml:"recrawl_policy"`
+		DefaultChangeInterval int    `yaml:"default_change_interval"`
 	} `yaml:"dispatcher"`
 
+	// Rules applied to links before they are stored (see URL.Canonicalize)
+	Canonicalization struct {
+		LowercaseHost      bool     `yaml:"lowercase_host"`
+		StripDefaultPorts  bool     `yaml:"strip_default_ports"`
+		ResolveDotSegments bool     `yaml:"resolve_dot_segments"`
+		DropFragments      bool     `yaml:"drop_fragments"`
+		SortQuery          bool     `yaml:"sort_query"`
+		StripQueryParams   []string `yaml:"strip_query_params"`
+		HonorRelCanonical  bool     `yaml:"honor_rel_canonical"`
+	} `yaml:"canonicalization"`
+
+	// Links matching any of these are not stored (see DetectCrawlerTrap). A
+	// limit of 0 disables that check, except the calendar limits, which are
+	// disabled by a negative value.
+	TrapDetection struct {
+		MaxPathDepth            int      `yaml:"max_path_depth"`
+		MaxRepeatedPathSegments int      `yaml:"max_repeated_path_segments"`
+		MaxQueryParams          int      `yaml:"max_query_params"`
+		SessionIDParams         []string `yaml:"session_id_params"`
+		MaxCalendarYearsAhead   int      `yaml:"max_calendar_years_ahead"`
+		MaxCalendarYearsBack    int      `yaml:"max_calendar_years_back"`
+	} `yaml:"trap_detection"`
+
+	// Seconds that fetched robots.txt files are cached for; ErrorCacheTime
+	// applies when robots.txt could not be fetched or returned a 5XX.
+	// HonorPageDirectives sets whether meta robots tags, X-Robots-Tag headers
+	// and rel="nofollow" are obeyed.
+	Robots struct {
+		CacheTime           int  `yaml:"cache_time"`
+		ErrorCacheTime      int  `yaml:"error_cache_time"`
+		HonorPageDirectives bool `yaml:"honor_page_directives"`
+	} `yaml:"robots"`
+
+	// Discover sets whether fetchers read the sitemaps of the sites they
+	// crawl; MaxSitemaps limits how many are read per origin (following
+	// sitemap indexes)
+	Sitemaps struct {
+		Discover    bool `yaml:"discover"`
+		MaxSitemaps int  `yaml:"max_sitemaps"`
+	} `yaml:"sitemaps"`
+
+	// How redirects are followed. MaxHops of 0 follows none; Follow is one
+	// of same_host, same_domain or any
+	Redirects struct {
+		MaxHops int    `yaml:"max_hops"`
+		Follow  string `yaml:"follow"`
+	} `yaml:"redirects"`
+
+	// Seconds that DNS resolutions are cached for. Successful resolutions
+	// are cached for the TTL of their records, bounded by MinTTL and MaxTTL;
+	// failed ones are retried after NegativeTTL.
+	DNSCache struct {
+		MinTTL      int `yaml:"min_ttl"`
+		MaxTTL      int `yaml:"max_ttl"`
+		NegativeTTL int `yaml:"negative_ttl"`
+	} `yaml:"dns_cache"`
+
+	// Fetchers resolve the hosts of claimed domains in the background every
+	// Interval seconds. Domains none of whose hosts resolve are skipped for
+	// SkipUnresolvableFor seconds (0 never skips them).
+	DNSPrefetch struct {
+		Enabled             bool `yaml:"enabled"`
+		Interval            int  `yaml:"interval"`
+		SkipUnresolvableFor int  `yaml:"skip_unresolvable_for"`
+	} `yaml:"dns_prefetch"`
+
+	// Limits on the requests all fetchers make to each server (IP address),
+	// whatever domains it hosts. A MaxConcurrent of 0 means no limit; Delay
+	// is the seconds between the starts of requests to a server.
+	PerIPLimits struct {
+		MaxConcurrent int `yaml:"max_concurrent"`
+		Delay         int `yaml:"delay"`
+	} `yaml:"per_ip_limits"`
+
+	// Adapting the crawl delay of each domain to how it holds up: slowing
+	// down when its responses slow down or fail (with 429 or 5XX), and
+	// speeding up toward MinDelay while it is healthy. Seconds.
+	AutoThrottle struct {
+		Enabled  bool `yaml:"enabled"`
+		MinDelay int  `yaml:"min_delay"`
+		MaxDelay int  `yaml:"max_delay"`
+	} `yaml:"auto_throttle"`
+
+	// Seconds; 0 means no timeout. Body limits the total time spent reading
+	// a response body.
+	HTTPTimeouts struct {
+		Dial           int `yaml:"dial"`
+		TLSHandshake   int `yaml:"tls_handshake"`
+		ResponseHeader int `yaml:"response_header"`
+		Body           int `yaml:"body"`
+	} `yaml:"http_timeouts"`
+
+	// How failed fetches are retried. Backoffs are in seconds; a
+	// MaxHostFailures of 0 never gives up on a host.
+	Retry struct {
+		MaxAttempts     int   `yaml:"max_attempts"`
+		StatusCodes     []int `yaml:"status_codes"`
+		InitialBackoff  int   `yaml:"initial_backoff"`
+		MaxBackoff      int   `yaml:"max_backoff"`
+		MaxHostFailures int   `yaml:"max_host_failures"`
+	} `yaml:"retry"`
+
 	// TODO: consider these config items
 	// allowed schemes (file://, https://, etc.)
 	// allowed return content types (or file extensions)
-	// http timeout
-	// http max delays (how many attempts to give a webserver that's reporting 'busy')
-	// http content size limit
 	// ftp content limit
 	// ftp timeout
 	// regex matchers for hosts, paths, etc. to include or exclude
@@ -88,6 +212,11 @@ type WalkerConfig struct {
 		//Discovery        DiscoveryConfig
 	} `yaml:"cassandra"`
 
+	SQL struct {
+		Driver     string `yaml:"driver"`
+		DataSource string `yaml:"data_source"`
+	} `yaml:"sql"`
+
 	Console struct {
 		Port              int    `yaml:"port"`
 		TemplateDirectory string `yaml:"template_directory"`
@@ -98,6 +227,8 @@ type WalkerConfig struct {
 // SetDefaultConfig resets the Config object to default values, regardless of
 // what was set by any configuration file.
 func SetDefaultConfig() {
+	Config.Datastore = "cassandra"
+	Config.Seeds = []string{}
 	Config.AddNewDomains = false
 	Config.AddedDomainsCacheSize = 20000
 	Config.MaxDNSCacheEntries = 20000
@@ -106,19 +237,101 @@ func SetDefaultConfig() {
 	Config.AcceptProtocols = []string{"http", "https"}
 	Config.DefaultCrawlDelay = 1
 	Config.MaxHTTPContentSizeBytes = 20 * 1024 * 1024 // 20MB
+	Config.TruncateOversizedContent = true
 	Config.IgnoreTags = []string{"script", "img", "link"}
 	Config.MaxLinksPerPage = 1000
+	Config.LinkSelection = "first"
 	Config.NumSimultaneousFetchers = 10
 	Config.BlacklistPrivateIPs = true
+	Config.DeniedNetworks = []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local, including cloud metadata services
+		"172.16.0.0/12",  // private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // private
+		"198.18.0.0/15",  // benchmarking
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved, including broadcast
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	}
+	Config.AllowedNetworks = []string{}
 
 	Config.Dispatcher.MaxLinksPerSegment = 500
 	Config.Dispatcher.RefreshPercentage = 25
 	Config.Dispatcher.NumConcurrentDomains = 1
+	Config.Dispatcher.StaleClaimTimeout = 3600
+	Config.Dispatcher.StaleClaimCheckInterval = 60
+	Config.Dispatcher.StableCrawlCount = 3
+	Config.Dispatcher.StableRecrawlDelay = 604800
+	Config.Dispatcher.CollapseStructuralDuplicates = true
+	Config.Dispatcher.RecrawlPolicy = "change_rate"
+	Config.Dispatcher.DefaultChangeInterval = 86400
+
+	Config.Canonicalization.LowercaseHost = true
+	Config.Canonicalization.StripDefaultPorts = true
+	Config.Canonicalization.ResolveDotSegments = true
+	Config.Canonicalization.DropFragments = true
+	Config.Canonicalization.SortQuery = true
+	Config.Canonicalization.StripQueryParams = []string{"utm_*", "gclid", "fbclid", "mc_cid", "mc_eid"}
+	Config.Canonicalization.HonorRelCanonical = false
+
+	Config.TrapDetection.MaxPathDepth = 16
+	Config.TrapDetection.MaxRepeatedPathSegments = 3
+	Config.TrapDetection.MaxQueryParams = 12
+	Config.TrapDetection.SessionIDParams = []string{"jsessionid", "phpsessid", "aspsessionid", "sessionid", "sid", "cfid", "cftoken"}
+	Config.TrapDetection.MaxCalendarYearsAhead = 2
+	Config.TrapDetection.MaxCalendarYearsBack = 30
+
+	Config.Robots.CacheTime = 86400
+	Config.Robots.ErrorCacheTime = 600
+	Config.Robots.HonorPageDirectives = true
+
+	Config.Sitemaps.Discover = true
+	Config.Sitemaps.MaxSitemaps = 50
+
+	Config.Redirects.MaxHops = 10
+	Config.Redirects.Follow = "same_domain"
+
+	Config.DNSCache.MinTTL = 60
+	Config.DNSCache.MaxTTL = 3600
+	Config.DNSCache.NegativeTTL = 10
+
+	Config.DNSPrefetch.Enabled = true
+	Config.DNSPrefetch.Interval = 30
+	Config.DNSPrefetch.SkipUnresolvableFor = 3600
+
+	Config.PerIPLimits.MaxConcurrent = 2
+	Config.PerIPLimits.Delay = 1
+
+	Config.AutoThrottle.Enabled = true
+	Config.AutoThrottle.MinDelay = 1
+	Config.AutoThrottle.MaxDelay = 60
+
+	Config.HTTPTimeouts.Dial = 30
+	Config.HTTPTimeouts.TLSHandshake = 10
+	Config.HTTPTimeouts.ResponseHeader = 30
+	Config.HTTPTimeouts.Body = 120
+
+	Config.Retry.MaxAttempts = 3
+	Config.Retry.StatusCodes = []int{429, 503}
+	Config.Retry.InitialBackoff = 2
+	Config.Retry.MaxBackoff = 60
+	Config.Retry.MaxHostFailures = 10
 
 	Config.Cassandra.Hosts = []string{"localhost"}
 	Config.Cassandra.Keyspace = "walker"
 	Config.Cassandra.ReplicationFactor = 3
 
+	Config.SQL.Driver = "sqlite3"
+	Config.SQL.DataSource = "walker.db"
+
 	Config.Console.Port = 3000
 	Config.Console.TemplateDirectory = "console/templates"
 	Config.Console.PublicFolder = "console/public"
@@ -133,6 +346,42 @@ func ReadConfigFile(path string) error {
 
 func assertConfigInvariants() error {
 	var errs []string
+	switch Config.Datastore {
+	case "cassandra", "memory":
+	case "sql":
+		if Config.SQL.Driver != "sqlite3" && Config.SQL.Driver != "postgres" {
+			errs = append(errs, fmt.Sprintf("SQL.Driver must be one of sqlite3 or postgres, got %q", Config.SQL.Driver))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("Datastore must be one of cassandra, memory or sql, got %q", Config.Datastore))
+	}
+
+	for _, seed := range Config.Seeds {
+		if _, err := ParseURL(seed); err != nil {
+			errs = append(errs, fmt.Sprintf("Seeds must be URLs, failed to parse %q: %v", seed, err))
+		}
+	}
+
+	if Config.MaxHTTPContentSizeBytes < 1 {
+		errs = append(errs, "MaxHTTPContentSizeBytes must be greater than 0")
+	}
+
+	if _, err := parseNetworks(Config.DeniedNetworks); err != nil {
+		errs = append(errs, fmt.Sprintf("DeniedNetworks: %v", err))
+	}
+	if _, err := parseNetworks(Config.AllowedNetworks); err != nil {
+		errs = append(errs, fmt.Sprintf("AllowedNetworks: %v", err))
+	}
+
+	if Config.MaxLinksPerPage < -1 {
+		errs = append(errs, "MaxLinksPerPage must be -1 (no max) or greater")
+	}
+	switch Config.LinkSelection {
+	case "first", "same_domain_first", "sample":
+	default:
+		errs = append(errs, fmt.Sprintf("LinkSelection must be one of first, same_domain_first or sample, got %q", Config.LinkSelection))
+	}
+
 	dis := &Config.Dispatcher
 	if dis.RefreshPercentage < 0.0 || dis.RefreshPercentage > 100.0 {
 		errs = append(errs, "Dispatcher.RefreshPercentage must be a floating point number b/w 0 and 100")
@@ -143,6 +392,98 @@ func assertConfigInvariants() error {
 	if dis.NumConcurrentDomains < 1 {
 		errs = append(errs, "Dispatcher.NumConcurrentDomains must be greater than 0")
 	}
+	if dis.StaleClaimTimeout < 0 {
+		errs = append(errs, "Dispatcher.StaleClaimTimeout must be 0 or greater")
+	}
+	if dis.StaleClaimCheckInterval < 1 {
+		errs = append(errs, "Dispatcher.StaleClaimCheckInterval must be greater than 0")
+	}
+	if dis.StableCrawlCount < 0 {
+		errs = append(errs, "Dispatcher.StableCrawlCount must be 0 or greater")
+	}
+	if dis.StableRecrawlDelay < 0 {
+		errs = append(errs, "Dispatcher.StableRecrawlDelay must be 0 or greater")
+	}
+	if dis.RecrawlPolicy != "change_rate" && dis.RecrawlPolicy != "age" {
+		errs = append(errs, fmt.Sprintf("Dispatcher.RecrawlPolicy must be one of change_rate or age, got %q", dis.RecrawlPolicy))
+	}
+	if dis.DefaultChangeInterval < 1 {
+		errs = append(errs, "Dispatcher.DefaultChangeInterval must be greater than 0")
+	}
+
+	td := &Config.TrapDetection
+	if td.MaxPathDepth < 0 {
+		errs = append(errs, "TrapDetection.MaxPathDepth must be 0 or greater")
+	}
+	if td.MaxRepeatedPathSegments < 0 {
+		errs = append(errs, "TrapDetection.MaxRepeatedPathSegments must be 0 or greater")
+	}
+	if td.MaxQueryParams < 0 {
+		errs = append(errs, "TrapDetection.MaxQueryParams must be 0 or greater")
+	}
+
+	if Config.Robots.CacheTime < 0 || Config.Robots.ErrorCacheTime < 0 {
+		errs = append(errs, "Robots.CacheTime and Robots.ErrorCacheTime must be 0 or greater")
+	}
+
+	if Config.Sitemaps.MaxSitemaps < 1 {
+		errs = append(errs, "Sitemaps.MaxSitemaps must be greater than 0")
+	}
+
+	if Config.Redirects.MaxHops < 0 {
+		errs = append(errs, "Redirects.MaxHops must be 0 or greater")
+	}
+	switch Config.Redirects.Follow {
+	case "same_host", "same_domain", "any":
+	default:
+		errs = append(errs, fmt.Sprintf("Redirects.Follow must be one of same_host, same_domain or any, got %q", Config.Redirects.Follow))
+	}
+
+	dc := &Config.DNSCache
+	if dc.MinTTL < 0 || dc.NegativeTTL < 0 {
+		errs = append(errs, "DNSCache.MinTTL and DNSCache.NegativeTTL must be 0 or greater")
+	}
+	if dc.MaxTTL < dc.MinTTL {
+		errs = append(errs, "DNSCache.MaxTTL must be at least DNSCache.MinTTL")
+	}
+
+	if Config.DNSPrefetch.Interval < 1 {
+		errs = append(errs, "DNSPrefetch.Interval must be greater than 0")
+	}
+	if Config.DNSPrefetch.SkipUnresolvableFor < 0 {
+		errs = append(errs, "DNSPrefetch.SkipUnresolvableFor must be 0 or greater")
+	}
+
+	if Config.PerIPLimits.MaxConcurrent < 0 || Config.PerIPLimits.Delay < 0 {
+		errs = append(errs, "PerIPLimits.MaxConcurrent and PerIPLimits.Delay must be 0 or greater")
+	}
+
+	at := &Config.AutoThrottle
+	if at.MinDelay < 0 {
+		errs = append(errs, "AutoThrottle.MinDelay must be 0 or greater")
+	}
+	if at.MaxDelay < at.MinDelay {
+		errs = append(errs, "AutoThrottle.MaxDelay must be at least AutoThrottle.MinDelay")
+	}
+
+	ht := &Config.HTTPTimeouts
+	if ht.Dial < 0 || ht.TLSHandshake < 0 || ht.ResponseHeader < 0 || ht.Body < 0 {
+		errs = append(errs, "HTTPTimeouts must all be 0 or greater")
+	}
+
+	rc := &Config.Retry
+	if rc.MaxAttempts < 1 {
+		errs = append(errs, "Retry.MaxAttempts must be greater than 0")
+	}
+	if rc.InitialBackoff < 0 {
+		errs = append(errs, "Retry.InitialBackoff must be 0 or greater")
+	}
+	if rc.MaxBackoff < rc.InitialBackoff {
+		errs = append(errs, "Retry.MaxBackoff must be at least Retry.InitialBackoff")
+	}
+	if rc.MaxHostFailures < 0 {
+		errs = append(errs, "Retry.MaxHostFailures must be 0 or greater")
+	}
 
 	if len(errs) > 0 {
 		em := ""
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"code.google.com/p/log4go"
@@ -31,7 +32,11 @@ func Routes() []Route {
 		Route{Path: "/add/", Controller: AddLinkIndexController},
 		Route{Path: "/links/{domain}", Controller: LinksController},
 		Route{Path: "/links/{domain}/{seedUrl}", Controller: LinksController},
+		Route{Path: "/priority/{domain}", Controller: DomainPriorityController},
+		Route{Path: "/exclude/{domain}", Controller: ExcludeDomainController},
+		Route{Path: "/include/{domain}", Controller: IncludeDomainController},
 		Route{Path: "/historical/{url}", Controller: LinksHistoricalController},
+		Route{Path: "/traps/{domain}", Controller: TrapLinksController},
 		Route{Path: "/findLinks", Controller: FindLinksController},
 	}
 }
@@ -319,6 +324,93 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// DomainPriorityController sets the crawl priority of a domain from the form
+// on the links page, then sends the user back to that page.
+func DomainPriorityController(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	domain := vars["domain"]
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("User failed to specify domain for domainPriorityController"))
+		return
+	}
+	if req.Method != "POST" {
+		http.Redirect(w, req, "/links/"+domain, http.StatusSeeOther)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(req.Form.Get("priority")))
+	if err != nil {
+		replyServerError(w, fmt.Errorf("Priority must be an integer: %v", err))
+		return
+	}
+
+	err = DS.SetDomainPriority(domain, priority)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("SetDomainPriority: %v", err))
+		return
+	}
+	http.Redirect(w, req, "/links/"+domain, http.StatusSeeOther)
+}
+
+// ExcludeDomainController excludes a domain from the crawl using the reason
+// given in the form on the links page, then sends the user back to that page.
+func ExcludeDomainController(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	domain := vars["domain"]
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("User failed to specify domain for excludeDomainController"))
+		return
+	}
+	if req.Method != "POST" {
+		http.Redirect(w, req, "/links/"+domain, http.StatusSeeOther)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+	reason := strings.TrimSpace(req.Form.Get("reason"))
+	if reason == "" {
+		reason = "manually excluded"
+	}
+
+	err = DS.ExcludeDomain(domain, reason)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ExcludeDomain: %v", err))
+		return
+	}
+	http.Redirect(w, req, "/links/"+domain, http.StatusSeeOther)
+}
+
+// IncludeDomainController clears the exclusion of a domain, then sends the
+// user back to its links page.
+func IncludeDomainController(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	domain := vars["domain"]
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("User failed to specify domain for includeDomainController"))
+		return
+	}
+	if req.Method != "POST" {
+		http.Redirect(w, req, "/links/"+domain, http.StatusSeeOther)
+		return
+	}
+
+	err := DS.IncludeDomain(domain)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("IncludeDomain: %v", err))
+		return
+	}
+	http.Redirect(w, req, "/links/"+domain, http.StatusSeeOther)
+}
+
 func LinksHistoricalController(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	url := vars["url"]
@@ -346,6 +438,29 @@ func LinksHistoricalController(w http.ResponseWriter, req *http.Request) {
 	Render.HTML(w, http.StatusOK, "historical", mp)
 }
 
+// TrapLinksController lists the links of a domain that were not stored
+// because they looked like crawler traps, and why.
+func TrapLinksController(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	domain := vars["domain"]
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("User failed to specify domain for trapLinksController"))
+		return
+	}
+
+	tinfos, err := DS.ListTrapLinks(domain, 500)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListTrapLinks (%s): %v", domain, err))
+		return
+	}
+
+	mp := map[string]interface{}{
+		"Domain": domain,
+		"Tinfos": tinfos,
+	}
+	Render.HTML(w, http.StatusOK, "traps", mp)
+}
+
 func FindLinksController(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		mp := map[string]interface{}{}
@@ -19,6 +19,9 @@ type DomainInfo struct {
 	//Why did this domain get excluded, or empty if not excluded
 	ExcludeReason string
 
+	//Crawl priority of this domain, higher priority domains are crawled first
+	Priority int
+
 	//When did this domain last get queued to be crawled. Or TimeQueed.IsZero() if not crawled
 	TimeQueued time.Time
 
@@ -47,6 +50,20 @@ type LinkInfo struct {
 
 	//When did this link get crawled
 	CrawlTime time.Time
+
+	//How many links on the page were not stored because it had too many
+	DroppedLinks int
+}
+
+type TrapLinkInfo struct {
+	//URL of the link
+	Url string
+
+	//Why the link looked like a crawler trap
+	Reason string
+
+	//When was the link found
+	FoundTime time.Time
 }
 
 //
@@ -70,6 +87,15 @@ type Model interface {
 	// Find a specific domain
 	FindDomain(domain string) (*DomainInfo, error)
 
+	// Set the crawl priority of a domain
+	SetDomainPriority(domain string, priority int) error
+
+	// Exclude a domain from the crawl, for the given reason
+	ExcludeDomain(domain string, reason string) error
+
+	// Include a previously excluded domain in the crawl
+	IncludeDomain(domain string) error
+
 	// List domains
 	ListDomains(seedDomain string, limit int) ([]DomainInfo, error)
 
@@ -84,6 +110,10 @@ type Model interface {
 
 	// Find a link
 	FindLink(links string) (*LinkInfo, error)
+
+	// List links from the given domain that were not stored because they
+	// looked like crawler traps
+	ListTrapLinks(domain string, limit int) ([]TrapLinkInfo, error)
 }
 
 var DS Model
@@ -150,6 +180,7 @@ func (ds *CqlModel) InsertLinks(links []string) []error {
 			urls = append(urls, nil)
 			continue
 		}
+		url.Canonicalize()
 		domain, err := url.ToplevelDomainPlusOne()
 		if err != nil {
 			errList = append(errList, fmt.Errorf("%v # ToplevelDomainPlusOne: bad domain: %v", link, err))
@@ -258,21 +289,23 @@ func (ds *CqlModel) listDomainsImpl(seed string, limit int, working bool) ([]Dom
 
 	var itr *gocql.Iter
 	if seed == "" && !working {
-		itr = db.Query("SELECT dom, claim_tok, claim_time FROM domain_info LIMIT ?", limit).Iter()
+		itr = db.Query("SELECT dom, claim_tok, claim_time, priority, exclude_reason FROM domain_info LIMIT ?", limit).Iter()
 	} else if seed == "" {
-		itr = db.Query("SELECT dom, claim_tok, claim_time FROM domain_info WHERE dispatched = true LIMIT ?", limit).Iter()
+		itr = db.Query("SELECT dom, claim_tok, claim_time, priority, exclude_reason FROM domain_info WHERE dispatched = true LIMIT ?", limit).Iter()
 	} else if !working {
-		itr = db.Query("SELECT dom, claim_tok, claim_time FROM domain_info WHERE TOKEN(dom) > TOKEN(?) LIMIT ?", seed, limit).Iter()
+		itr = db.Query("SELECT dom, claim_tok, claim_time, priority, exclude_reason FROM domain_info WHERE TOKEN(dom) > TOKEN(?) LIMIT ?", seed, limit).Iter()
 	} else { //working==true AND seed != ""
-		itr = db.Query("SELECT dom, claim_tok, claim_time FROM domain_info WHERE dispatched = true AND TOKEN(dom) > TOKEN(?) LIMIT ?", seed, limit).Iter()
+		itr = db.Query("SELECT dom, claim_tok, claim_time, priority, exclude_reason FROM domain_info WHERE dispatched = true AND TOKEN(dom) > TOKEN(?) LIMIT ?", seed, limit).Iter()
 	}
 
 	var dinfos []DomainInfo
 	var domain string
 	var claim_tok gocql.UUID
 	var claim_time time.Time
-	for itr.Scan(&domain, &claim_tok, &claim_time) {
-		dinfos = append(dinfos, DomainInfo{Domain: domain, UuidOfQueued: claim_tok, TimeQueued: claim_time})
+	var priority int
+	var exclude_reason string
+	for itr.Scan(&domain, &claim_tok, &claim_time, &priority, &exclude_reason) {
+		dinfos = append(dinfos, DomainInfo{Domain: domain, UuidOfQueued: claim_tok, TimeQueued: claim_time, Priority: priority, ExcludeReason: exclude_reason})
 	}
 	err := itr.Close()
 	if err != nil {
@@ -300,15 +333,17 @@ func (ds *CqlModel) ListWorkingDomains(seedDomain string, limit int) ([]DomainIn
 //		itr = db.Query("SELECT domain, claim_tok, claim_time FROM domain_info WHERE dispatched = true AND TOKEN(domain) > TOKEN(?) LIMIT ?", seed, limit).Iter()
 func (ds *CqlModel) FindDomain(domain string) (*DomainInfo, error) {
 	db := ds.Db
-	itr := db.Query("SELECT claim_tok, claim_time FROM domain_info WHERE dom = ?", domain).Iter()
+	itr := db.Query("SELECT claim_tok, claim_time, priority, exclude_reason FROM domain_info WHERE dom = ?", domain).Iter()
 	var claim_tok gocql.UUID
 	var claim_time time.Time
-	if !itr.Scan(&claim_tok, &claim_time) {
+	var priority int
+	var exclude_reason string
+	if !itr.Scan(&claim_tok, &claim_time, &priority, &exclude_reason) {
 		err := itr.Close()
 		return nil, err
 	}
 
-	dinfo := &DomainInfo{Domain: domain, UuidOfQueued: claim_tok, TimeQueued: claim_time}
+	dinfo := &DomainInfo{Domain: domain, UuidOfQueued: claim_tok, TimeQueued: claim_time, Priority: priority, ExcludeReason: exclude_reason}
 	err := itr.Close()
 	if err != nil {
 		return dinfo, err
@@ -320,6 +355,63 @@ func (ds *CqlModel) FindDomain(domain string) (*DomainInfo, error) {
 	return dinfo, err
 }
 
+func (ds *CqlModel) SetDomainPriority(domain string, priority int) error {
+	applied, err := ds.Db.Query(`UPDATE domain_info SET priority = ? WHERE dom = ? IF EXISTS`,
+		priority, domain).ScanCAS()
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return fmt.Errorf("Domain %s not found", domain)
+	}
+	if priority != 0 {
+		// Fetchers look for domains one priority at a time, see the walker
+		// priorities table
+		err = ds.Db.Query(`INSERT INTO priorities (priority) VALUES (?)`, priority).Exec()
+	}
+	return err
+}
+
+func (ds *CqlModel) ExcludeDomain(domain string, reason string) error {
+	applied, err := ds.Db.Query(`UPDATE domain_info SET excluded = true, exclude_reason = ? WHERE dom = ? IF EXISTS`,
+		reason, domain).ScanCAS()
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return fmt.Errorf("Domain %s not found", domain)
+	}
+	return ds.undispatch(domain)
+}
+
+func (ds *CqlModel) IncludeDomain(domain string) error {
+	if err := ds.undispatch(domain); err != nil {
+		return err
+	}
+	applied, err := ds.Db.Query(`UPDATE domain_info SET excluded = false, exclude_reason = null WHERE dom = ? IF EXISTS`,
+		domain).ScanCAS()
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return fmt.Errorf("Domain %s not found", domain)
+	}
+	return nil
+}
+
+// undispatch marks domain undispatched and deletes its segment, unless a
+// fetcher has claimed it, so excluded domains don't take up the domains
+// fetchers read to claim, and included ones get a fresh segment.
+func (ds *CqlModel) undispatch(domain string) error {
+	var existingTok gocql.UUID
+	applied, err := ds.Db.Query(`UPDATE domain_info SET dispatched = false WHERE dom = ? IF claim_tok = ?`,
+		domain, gocql.UUID{}).ScanCAS(&existingTok)
+	if err != nil || !applied {
+		return err
+	}
+	return ds.Db.Query(`DELETE FROM segments WHERE dom = ?`, domain).Exec()
+}
+
 // Pagination note:
 // To paginate a single column you can do
 //
@@ -358,9 +450,9 @@ func (ds *CqlModel) collectLinkInfos(linfos []LinkInfo, rtimes map[string]rememb
 	var domain, subdomain, path, protocol, anerror string
 	var crawlTime time.Time
 	var robotsExcluded bool
-	var status int
+	var status, droppedLinks int
 
-	for itr.Scan(&domain, &subdomain, &path, &protocol, &crawlTime, &status, &anerror, &robotsExcluded) {
+	for itr.Scan(&domain, &subdomain, &path, &protocol, &crawlTime, &status, &anerror, &robotsExcluded, &droppedLinks) {
 
 		u, err := walker.CreateURL(domain, subdomain, path, protocol, crawlTime)
 		if err != nil {
@@ -380,6 +472,7 @@ func (ds *CqlModel) collectLinkInfos(linfos []LinkInfo, rtimes map[string]rememb
 			Error:          anerror,
 			RobotsExcluded: robotsExcluded,
 			CrawlTime:      crawlTime,
+			DroppedLinks:   droppedLinks,
 		}
 
 		nindex := -1
@@ -417,7 +510,7 @@ func (ds *CqlModel) ListLinks(domain string, seedUrl string, limit int) ([]LinkI
 	if seedUrl == "" {
 		table = []queryEntry{
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, dropped_links
                       FROM links 
                       WHERE dom = ?`,
 				args: []interface{}{domain},
@@ -444,7 +537,7 @@ func (ds *CqlModel) ListLinks(domain string, seedUrl string, limit int) ([]LinkI
 
 		table = []queryEntry{
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, dropped_links
                       FROM links 
                       WHERE dom = ? AND 
                             subdom = ? AND 
@@ -453,7 +546,7 @@ func (ds *CqlModel) ListLinks(domain string, seedUrl string, limit int) ([]LinkI
 				args: []interface{}{dom, sub, pat, pro},
 			},
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, dropped_links 
                       FROM links 
                       WHERE dom = ? AND 
                             subdom = ? AND 
@@ -461,7 +554,7 @@ func (ds *CqlModel) ListLinks(domain string, seedUrl string, limit int) ([]LinkI
 				args: []interface{}{dom, sub, pat},
 			},
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, dropped_links 
                       FROM links 
                       WHERE dom = ? AND 
                             subdom > ?`,
@@ -499,7 +592,7 @@ func (ds *CqlModel) ListLinkHistorical(linkUrl string, seedIndex int, limit int)
 		return nil, seedIndex, err
 	}
 
-	query := `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+	query := `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, dropped_links 
               FROM links
               WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`
 	tld1, err := u.ToplevelDomainPlusOne()
@@ -516,10 +609,10 @@ func (ds *CqlModel) ListLinkHistorical(linkUrl string, seedIndex int, limit int)
 	var linfos []LinkInfo
 	var dom, sub, path, prot, getError string
 	var crawlTime time.Time
-	var status int
+	var status, droppedLinks int
 	var robotsExcluded bool
 	count := 0
-	for itr.Scan(&dom, &sub, &path, &prot, &crawlTime, &status, &getError, &robotsExcluded) {
+	for itr.Scan(&dom, &sub, &path, &prot, &crawlTime, &status, &getError, &robotsExcluded, &droppedLinks) {
 		if count < seedIndex {
 			count++
 			continue
@@ -532,6 +625,7 @@ func (ds *CqlModel) ListLinkHistorical(linkUrl string, seedIndex int, limit int)
 			Error:          getError,
 			RobotsExcluded: robotsExcluded,
 			CrawlTime:      crawlTime,
+			DroppedLinks:   droppedLinks,
 		}
 		linfos = append(linfos, linfo)
 		if len(linfos) >= limit {
@@ -549,7 +643,7 @@ func (ds *CqlModel) FindLink(link string) (*LinkInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	query := `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+	query := `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, dropped_links 
                       FROM links 
                       WHERE dom = ? AND 
                             subdom = ? AND 
@@ -585,3 +679,29 @@ func (ds *CqlModel) FindLink(link string) (*LinkInfo, error) {
 		return &linfos[0], nil
 	}
 }
+
+func (ds *CqlModel) ListTrapLinks(domain string, limit int) ([]TrapLinkInfo, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("Bad value for limit parameter %d", limit)
+	}
+
+	var tinfos []TrapLinkInfo
+	var subdomain, path, protocol, reason string
+	var foundTime time.Time
+	itr := ds.Db.Query(`SELECT subdom, path, proto, reason, time
+						FROM trap_links
+						WHERE dom = ? LIMIT ?`, domain, limit).Iter()
+	for itr.Scan(&subdomain, &path, &protocol, &reason, &foundTime) {
+		u, err := walker.CreateURL(domain, subdomain, path, protocol, walker.NotYetCrawled)
+		if err != nil {
+			itr.Close()
+			return tinfos, err
+		}
+		tinfos = append(tinfos, TrapLinkInfo{
+			Url:       u.String(),
+			Reason:    reason,
+			FoundTime: foundTime,
+		})
+	}
+	return tinfos, itr.Close()
+}
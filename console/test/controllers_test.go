@@ -333,6 +333,7 @@ func TestListLinksWeb(t *testing.T) {
 	domainKeys := []string{
 		"Domain",
 		"ExcludeReason",
+		"Priority",
 		"TimeQueued",
 		"UuidOfQueued",
 		"NumberLinksTotal",
@@ -354,8 +355,8 @@ func TestListLinksWeb(t *testing.T) {
 	})
 
 	secondColSize := domainTable.Find("tr > td:nth-child(2)").Size()
-	if secondColSize != 6 {
-		t.Fatalf("[.container table tr > td:nth-child(2)] Second column mismatch got %d, expected %s", secondColSize, 6)
+	if secondColSize != 7 {
+		t.Fatalf("[.container table tr > td:nth-child(2)] Second column mismatch got %d, expected %s", secondColSize, 7)
 	}
 
 	thirdColSize := domainTable.Find("tr > td:nth-child(3)").Size()
@@ -622,6 +623,7 @@ func TestListHistorical(t *testing.T) {
 		"Robots Excluded",
 		"Status",
 		"Error",
+		"Links Dropped",
 	}
 	count := 0
 	tables.Find("thead th").Each(func(index int, sel *goquery.Selection) {
@@ -640,8 +642,8 @@ func TestListHistorical(t *testing.T) {
 
 	tables.Find("tbody tr").Each(func(index int, sel *goquery.Selection) {
 		ncol := sel.Children().Size()
-		if ncol != 4 {
-			t.Fatalf("[.container table tbody tr] Wrong column count got %d, expected %d", ncol, 4)
+		if ncol != 5 {
+			t.Fatalf("[.container table tbody tr] Wrong column count got %d, expected %d", ncol, 5)
 		}
 	})
 }
@@ -252,7 +252,7 @@ func getDs(t *testing.T) *console.CqlModel {
 	//
 	// Clear out the tables first
 	//
-	tables := []string{"links", "segments", "domain_info"}
+	tables := []string{"links", "segments", "domain_info", "trap_links"}
 	for _, table := range tables {
 		err := db.Query(fmt.Sprintf(`TRUNCATE %v`, table)).Exec()
 		if err != nil {
@@ -943,3 +943,97 @@ func TestCloseToLimitBug(t *testing.T) {
 		}
 	}
 }
+
+func TestSetDomainPriority(t *testing.T) {
+	store := getDs(t)
+	defer store.Close()
+
+	err := store.SetDomainPriority("foo.com", 7)
+	if err != nil {
+		t.Fatalf("SetDomainPriority direct error %v", err)
+	}
+	dinfo, err := store.FindDomain("foo.com")
+	if err != nil {
+		t.Fatalf("FindDomain direct error %v", err)
+	}
+	if dinfo.Priority != 7 {
+		t.Errorf("SetDomainPriority priority mismatch got %v, expected %v", dinfo.Priority, 7)
+	}
+
+	err = store.SetDomainPriority("notgoingtobethere.com", 7)
+	if err == nil {
+		t.Errorf("SetDomainPriority expected error for unknown domain")
+	}
+}
+
+func TestExcludeDomain(t *testing.T) {
+	store := getDs(t)
+	defer store.Close()
+
+	err := store.ExcludeDomain("foo.com", "spam")
+	if err != nil {
+		t.Fatalf("ExcludeDomain direct error %v", err)
+	}
+	dinfo, err := store.FindDomain("foo.com")
+	if err != nil {
+		t.Fatalf("FindDomain direct error %v", err)
+	}
+	if dinfo.ExcludeReason != "spam" {
+		t.Errorf("ExcludeDomain ExcludeReason mismatch got %q, expected %q", dinfo.ExcludeReason, "spam")
+	}
+
+	err = store.IncludeDomain("foo.com")
+	if err != nil {
+		t.Fatalf("IncludeDomain direct error %v", err)
+	}
+	dinfo, err = store.FindDomain("foo.com")
+	if err != nil {
+		t.Fatalf("FindDomain direct error %v", err)
+	}
+	if dinfo.ExcludeReason != "" {
+		t.Errorf("IncludeDomain ExcludeReason mismatch got %q, expected empty", dinfo.ExcludeReason)
+	}
+
+	err = store.ExcludeDomain("notgoingtobethere.com", "spam")
+	if err == nil {
+		t.Errorf("ExcludeDomain expected error for unknown domain")
+	}
+}
+
+func TestListTrapLinks(t *testing.T) {
+	store := getDs(t)
+	defer store.Close()
+
+	foundTime := time.Now().Truncate(time.Millisecond)
+	err := store.Db.Query(`INSERT INTO trap_links (dom, subdom, path, proto, reason, time)
+							VALUES (?, ?, ?, ?, ?, ?)`,
+		"foo.com", "www", "/cal/2099/01/", "http", "calendar date in 2099", foundTime).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert trap link: %v", err)
+	}
+
+	tinfos, err := store.ListTrapLinks("foo.com", 10)
+	if err != nil {
+		t.Fatalf("ListTrapLinks direct error %v", err)
+	}
+	if len(tinfos) != 1 {
+		t.Fatalf("ListTrapLinks expected 1 link, got %v", tinfos)
+	}
+	if tinfos[0].Url != "http://www.foo.com/cal/2099/01/" {
+		t.Errorf("ListTrapLinks Url mismatch got %q", tinfos[0].Url)
+	}
+	if tinfos[0].Reason != "calendar date in 2099" {
+		t.Errorf("ListTrapLinks Reason mismatch got %q", tinfos[0].Reason)
+	}
+	if !tinfos[0].FoundTime.Equal(foundTime) {
+		t.Errorf("ListTrapLinks FoundTime mismatch got %v, expected %v", tinfos[0].FoundTime, foundTime)
+	}
+
+	tinfos, err = store.ListTrapLinks("bar.com", 10)
+	if err != nil {
+		t.Fatalf("ListTrapLinks direct error %v", err)
+	}
+	if len(tinfos) != 0 {
+		t.Errorf("ListTrapLinks expected no links for bar.com, got %v", tinfos)
+	}
+}
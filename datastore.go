@@ -3,6 +3,7 @@ package walker
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
@@ -52,6 +53,92 @@ type Datastore interface {
 	StoreParsedURL(u *URL, fr *FetchResults)
 }
 
+// DomainPrioritizer is implemented by Datastores that support crawl
+// priorities. Higher priority domains have segments generated and are claimed
+// for crawling before lower priority ones. The default priority is 0.
+type DomainPrioritizer interface {
+	// SetDomainPriority sets the priority of a domain that is already part of
+	// the crawl, returning an error if it isn't.
+	SetDomainPriority(domain string, priority int) error
+}
+
+// DomainExcluder is implemented by Datastores that can exclude domains from
+// the crawl. Excluded domains are never dispatched or claimed until they are
+// included again.
+type DomainExcluder interface {
+	// ExcludeDomain excludes a domain from the crawl, recording the reason
+	// why. The domain is added to domain_info if it wasn't already there, so
+	// it is never crawled if it shows up later.
+	ExcludeDomain(domain string, reason string) error
+
+	// IncludeDomain clears an exclusion so the domain is crawled again,
+	// returning an error if the domain isn't part of the crawl.
+	IncludeDomain(domain string) error
+}
+
+// TrapRecorder is implemented by Datastores that keep track of the parsed
+// links the fetcher refused to store because they look like crawler traps (see
+// DetectCrawlerTrap), so they can be reviewed later (ex. in the console).
+type TrapRecorder interface {
+	// StoreTrapURL records that u was not stored, and why.
+	StoreTrapURL(u *URL, reason string)
+}
+
+// RobotsCache is implemented by Datastores that can cache robots.txt files,
+// so fetchers don't need to fetch them again every time they claim a host.
+type RobotsCache interface {
+	// CachedRobots returns the robots.txt stored for origin (ex.
+	// https://sub.test.com), or nil if there is none. The fetcher checks
+	// whether it has expired.
+	CachedRobots(origin string) *RobotsTxt
+
+	// StoreRobots stores r, replacing any robots.txt stored for its origin.
+	StoreRobots(r *RobotsTxt)
+}
+
+// ClaimRefresher is implemented by Datastores whose claims are released as
+// stale by the dispatcher (see Config.Dispatcher.StaleClaimTimeout), so
+// fetchers can keep the claim on a host they are still crawling.
+type ClaimRefresher interface {
+	// RefreshClaim updates the claim time of a host this crawler claimed,
+	// returning false if the claim has since been released or taken by
+	// another crawler.
+	RefreshClaim(host string) bool
+}
+
+// CrawlDelayCache is implemented by Datastores that remember the crawl delay
+// fetchers learned for each domain (see Config.AutoThrottle), so it carries
+// over to the next claim.
+type CrawlDelayCache interface {
+	// CachedCrawlDelay returns the crawl delay stored for domain; ok is false
+	// if there is none.
+	CachedCrawlDelay(domain string) (delay time.Duration, ok bool)
+
+	// StoreCrawlDelay stores the crawl delay learned for domain.
+	StoreCrawlDelay(domain string, delay time.Duration)
+}
+
+// ClaimedDomainLister is implemented by Datastores that claim domains ahead of
+// handing them to fetchers with ClaimNewHost. The FetchManager resolves the
+// hosts of those domains in the background (see Config.DNSPrefetch), so
+// fetchers don't stall on DNS lookups, and skips domains none of whose hosts
+// resolve.
+type ClaimedDomainLister interface {
+	// ClaimedDomains returns the domains claimed but not yet handed out by
+	// ClaimNewHost.
+	ClaimedDomains() []string
+
+	// SegmentHosts returns the hosts (ex. www.test.com) of the links in the
+	// segment of domain.
+	SegmentHosts(domain string) []string
+
+	// SkipUnresolvableDomain drops a domain returned by ClaimedDomains so it
+	// is never handed out, releasing our claim on it and recording why. Its
+	// segment is left as it is, to be claimed again once
+	// Config.DNSPrefetch.SkipUnresolvableFor has passed.
+	SkipUnresolvableDomain(domain string, reason string)
+}
+
 // CassandraDatastore is the primary Datastore implementation, using Apache
 // Cassandra as a highly scalable backend.
 type CassandraDatastore struct {
@@ -96,73 +183,241 @@ func NewCassandraDatastore() (*CassandraDatastore, error) {
 	return ds, nil
 }
 
-func (ds *CassandraDatastore) ClaimNewHost() string {
+// claimBatchSize is the number of domains ClaimNewHost claims at once, to
+// avoid querying domain_info for every claim.
+const claimBatchSize = 50
 
-	// Get our range of priority values, sort high to low and select starting
-	// with the highest priority
-	//priorities := []int{}
-	//var p int
-	//priority_iter := ds.db.Query(`SELECT DISTINCT priority FROM domains_to_crawl`).Iter()
-	//defer priority_iter.Close()
-	//for priority_iter.Scan(&p) {
-	//	priorities = append(priorities, p)
-	//}
-	//sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+// claimCandidateLimit is the number of domains of a priority ClaimNewHost
+// reads from domain_info at once; some may turn out to be excluded, skipped or
+// claimed by another crawler, so it reads more than it claims.
+const claimCandidateLimit = 2 * claimBatchSize
 
+func (ds *CassandraDatastore) ClaimNewHost() string {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
 	if len(ds.domains) == 0 {
-		start := time.Now()
-		var domain string
-		//TODO: when using priorities: `WHERE priority = ?`
-		domain_iter := ds.db.Query(`SELECT dom FROM domain_info
-									WHERE claim_tok = 00000000-0000-0000-0000-000000000000
-									AND dispatched = true
-									LIMIT 50 ALLOW FILTERING`).Iter()
-		for domain_iter.Scan(&domain) {
-			//TODO: use lightweight transaction to allow more crawlers
-			//TODO: use a per-crawler uuid
-			log4go.Debug("ClaimNewHost selected new domain in %v", time.Since(start))
-			start = time.Now()
-			err := ds.db.Query(`UPDATE domain_info SET claim_tok = ?, claim_time = ?
-								WHERE dom = ?`,
-				ds.crawlerUuid, time.Now(), domain).Exec()
-			if err != nil {
-				log4go.Error("Failed to claim segment %v: %v", domain, err)
-			} else {
-				log4go.Debug("Claimed segment %v with token %v in %v", domain, ds.crawlerUuid, time.Since(start))
-				ds.domains = append(ds.domains, domain)
+		// Cassandra can't order by a non-clustering column, so go through
+		// the priorities in use from highest to lowest, claiming a bounded
+		// number of the domains at each through the priority index
+		var claimed []string
+		for _, priority := range readPriorities(ds.db) {
+			if len(claimed) >= claimBatchSize {
+				break
 			}
+			claimed = append(claimed, ds.claimDomains(priority, claimBatchSize-len(claimed))...)
+		}
+
+		// Domains are popped off the end, so store them lowest priority first
+		for i := len(claimed) - 1; i >= 0; i-- {
+			ds.domains = append(ds.domains, claimed[i])
+		}
+	}
+
+	// Domains may have waited in ds.domains for a while, so make sure our
+	// claim on the one we hand out is still valid (and fresh, so it is not
+	// considered stale while we crawl it)
+	for len(ds.domains) > 0 {
+		// Pop the last element and return it
+		lastIndex := len(ds.domains) - 1
+		domain := ds.domains[lastIndex]
+		ds.domains = ds.domains[:lastIndex]
+		if ds.RefreshClaim(domain) {
+			return domain
 		}
-		err := domain_iter.Close()
+	}
+	return ""
+}
+
+// readPriorities returns the domain priorities in use (see the priorities
+// table), highest first.
+func readPriorities(db *gocql.Session) []int {
+	priorities := []int{0}
+	var priority int
+	iter := db.Query(`SELECT priority FROM priorities`).Iter()
+	for iter.Scan(&priority) {
+		if priority != 0 {
+			priorities = append(priorities, priority)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log4go.Error("Failed to read domain priorities: %v", err)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	return priorities
+}
+
+// claimDomains claims up to max dispatched domains of the given priority,
+// returning the ones it claimed. Only claimCandidateLimit domains are read at
+// a time, so a broad crawl doesn't cost a scan of all of domain_info.
+func (ds *CassandraDatastore) claimDomains(priority int, max int) []string {
+	start := time.Now()
+	var candidates []string
+	var domain string
+	var excluded bool
+	var dnsRetryTime time.Time
+	iter := ds.db.Query(`SELECT dom, excluded, dns_retry_time FROM domain_info
+							WHERE priority = ?
+							AND claim_tok = 00000000-0000-0000-0000-000000000000
+							AND dispatched = true
+							LIMIT ? ALLOW FILTERING`, priority, claimCandidateLimit).Iter()
+	for iter.Scan(&domain, &excluded, &dnsRetryTime) {
+		// excluded and dns_retry_time may be null, so we can't filter on
+		// them in the query
+		if excluded || dnsRetryTime.After(start) {
+			continue
+		}
+		candidates = append(candidates, domain)
+	}
+	if err := iter.Close(); err != nil {
+		log4go.Error("Domain iteration query failed: %v", err)
+	}
+	log4go.Debug("ClaimNewHost selected %v candidate domains of priority %v in %v",
+		len(candidates), priority, time.Since(start))
+
+	var claimed []string
+	for _, domain := range candidates {
+		if len(claimed) >= max {
+			break
+		}
+		start = time.Now()
+
+		// Use a lightweight transaction so only one crawler can ever claim a
+		// given domain
+		var existingTok gocql.UUID
+		applied, err := ds.db.Query(`UPDATE domain_info SET claim_tok = ?, claim_time = ?
+									WHERE dom = ?
+									IF claim_tok = ?`,
+			ds.crawlerUuid, time.Now(), domain, gocql.UUID{}).ScanCAS(&existingTok)
 		if err != nil {
-			log4go.Error("Domain iteration query failed: %v", err)
+			log4go.Error("Failed to claim segment %v: %v", domain, err)
+		} else if !applied {
+			log4go.Info("Claim conflict: domain %v was already claimed by %v", domain, existingTok)
+		} else {
+			log4go.Debug("Claimed segment %v (priority %v) with token %v in %v",
+				domain, priority, ds.crawlerUuid, time.Since(start))
+			claimed = append(claimed, domain)
 		}
 	}
+	return claimed
+}
 
-	if len(ds.domains) == 0 {
-		return ""
+// RefreshClaim updates claim_time on a domain this crawler has claimed,
+// returning false if the claim has since been released or taken by another
+// crawler (for example because a dispatcher found it stale).
+func (ds *CassandraDatastore) RefreshClaim(domain string) bool {
+	var existingTok gocql.UUID
+	applied, err := ds.db.Query(`UPDATE domain_info SET claim_time = ?
+								WHERE dom = ?
+								IF claim_tok = ?`,
+		time.Now(), domain, ds.crawlerUuid).ScanCAS(&existingTok)
+	if err != nil {
+		log4go.Error("Failed to refresh claim on %v: %v", domain, err)
+		return false
+	}
+	if !applied {
+		log4go.Warn("Lost claim on %v, it is now claimed by %v", domain, existingTok)
+		return false
+	}
+	return true
+}
+
+func (ds *CassandraDatastore) ClaimedDomains() []string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return append([]string{}, ds.domains...)
+}
+
+func (ds *CassandraDatastore) SegmentHosts(domain string) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	var subdom string
+	iter := ds.db.Query(`SELECT subdom FROM segments WHERE dom = ?`, domain).Iter()
+	for iter.Scan(&subdom) {
+		if !seen[subdom] {
+			seen[subdom] = true
+			hosts = append(hosts, segmentHost(domain, subdom))
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log4go.Error("Failed to read segment hosts of %v: %v", domain, err)
 	}
+	return hosts
+}
 
-	// Pop the last element and return it
-	lastIndex := len(ds.domains) - 1
-	domain := ds.domains[lastIndex]
-	ds.domains = ds.domains[:lastIndex]
-	return domain
+func (ds *CassandraDatastore) SkipUnresolvableDomain(domain string, reason string) {
+	if !ds.dropClaimedDomain(domain) {
+		// Already handed to a fetcher
+		return
+	}
+	// The domain is undispatched so it doesn't take up the candidates
+	// ClaimNewHost reads; the dispatcher generates a new segment for it once
+	// dns_retry_time has passed
+	retry := time.Now().Add(time.Duration(Config.DNSPrefetch.SkipUnresolvableFor) * time.Second)
+	var existingTok gocql.UUID
+	applied, err := ds.db.Query(`UPDATE domain_info SET claim_tok = ?, dispatched = false,
+									dns_retry_time = ?, dns_error = ?
+								WHERE dom = ?
+								IF claim_tok = ?`,
+		gocql.UUID{}, retry, reason, domain, ds.crawlerUuid).ScanCAS(&existingTok)
+	if err != nil {
+		log4go.Error("Failed to skip unresolvable domain %v: %v", domain, err)
+		return
+	} else if !applied {
+		log4go.Warn("Failed to skip %v, it is now claimed by %v", domain, existingTok)
+		return
+	}
+	if err := ds.db.Query(`DELETE FROM segments WHERE dom = ?`, domain).Exec(); err != nil {
+		log4go.Error("Failed deleting segment links for skipped domain %v: %v", domain, err)
+	}
+	log4go.Info("Skipping %v until %v: %v", domain, retry, reason)
+}
+
+// dropClaimedDomain removes domain from the domains waiting to be handed out
+// by ClaimNewHost, returning false if it wasn't there.
+func (ds *CassandraDatastore) dropClaimedDomain(domain string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for i, d := range ds.domains {
+		if d == domain {
+			ds.domains = append(ds.domains[:i], ds.domains[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// segmentHost returns the host of links in domain's segment with the given
+// subdomain, ex. www.test.com for subdomain www of test.com.
+func segmentHost(domain, subdom string) string {
+	if subdom == "" {
+		return domain
+	}
+	return subdom + "." + domain
 }
 
 func (ds *CassandraDatastore) UnclaimHost(host string) {
+	// Make sure we still own this domain before touching its segment; if our
+	// claim was released as stale another crawler may be working on it
+	if !ds.RefreshClaim(host) {
+		log4go.Warn("Not unclaiming %v since we no longer hold the claim", host)
+		return
+	}
+
 	err := ds.db.Query(`DELETE FROM segments WHERE dom = ?`, host).Exec()
 	if err != nil {
 		log4go.Error("Failed deleting segment links for %v: %v", host, err)
 	}
 
-	err = ds.db.Query(`UPDATE domain_info SET dispatched = false,
-							claim_tok = 00000000-0000-0000-0000-000000000000
-						WHERE dom = ?`, host).Exec()
+	var existingTok gocql.UUID
+	applied, err := ds.db.Query(`UPDATE domain_info SET dispatched = false, claim_tok = ?
+								WHERE dom = ?
+								IF claim_tok = ?`,
+		gocql.UUID{}, host, ds.crawlerUuid).ScanCAS(&existingTok)
 	if err != nil {
 		log4go.Error("Failed deleting %v from domains_to_crawl: %v", host, err)
+	} else if !applied {
+		log4go.Warn("Failed to unclaim %v, it is now claimed by %v", host, existingTok)
 	}
 }
 
@@ -199,11 +454,11 @@ func (ds *CassandraDatastore) StoreURLFetchResults(fr *FetchResults) {
 		url = fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
 	}
 
-	dom, subdom, err := fr.URL.TLDPlusOneAndSubdomain()
+	dom, subdom, err := url.TLDPlusOneAndSubdomain()
 	if err != nil {
 		// Consider storing in the link table so we don't keep trying to crawl
 		// this link
-		log4go.Error("StoreURLFetchResults not storing %v: %v", fr.URL, err)
+		log4go.Error("StoreURLFetchResults not storing %v: %v", url, err)
 		return
 	}
 
@@ -227,10 +482,35 @@ func (ds *CassandraDatastore) StoreURLFetchResults(fr *FetchResults) {
 		inserts = append(inserts, dbfield{"stat", fr.Response.StatusCode})
 	}
 
+	if r := fr.unfollowedRedirect(); r != nil {
+		inserts = append(inserts, dbfield{"redto_url", r.Location.String()})
+	}
+
 	if fr.MimeType != "" {
 		inserts = append(inserts, dbfield{"mime", fr.MimeType})
 	}
 
+	if etag := fr.etag(); etag != "" {
+		inserts = append(inserts, dbfield{"etag", etag})
+	}
+
+	if lastmod := fr.lastModified(); !lastmod.IsZero() {
+		inserts = append(inserts, dbfield{"last_modified", lastmod})
+	}
+
+	if fr.Fingerprint != 0 {
+		inserts = append(inserts, dbfield{"fp", fr.Fingerprint})
+		inserts = append(inserts, dbfield{"structfp", fr.StructFingerprint})
+	}
+
+	if fr.Truncated {
+		inserts = append(inserts, dbfield{"truncated", true})
+	}
+
+	if fr.DroppedLinks > 0 {
+		inserts = append(inserts, dbfield{"dropped_links", fr.DroppedLinks})
+	}
+
 	// Put the values together and run the query
 	names := []string{}
 	values := []interface{}{}
@@ -250,25 +530,20 @@ func (ds *CassandraDatastore) StoreURLFetchResults(fr *FetchResults) {
 		return
 	}
 
-	if len(fr.RedirectedFrom) > 0 {
-		// Only trick with this is that fr.URL redirected to RedirectedFrom[0], after that
-		// RedirectedFrom[n] redirected to RedirectedFrom[n+1]
-		rf := fr.RedirectedFrom
-		back := fr.URL
-		for i := 0; i < len(rf); i++ {
-			front := rf[i]
-			dom, subdom, err = back.TLDPlusOneAndSubdomain()
-			if err != nil {
-				log4go.Error("StoreURLFetchResults not storing info for url that redirected (%v): %v", back, err)
-				continue
-			}
-			err := ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time, redto_url) VALUES (?, ?, ?, ?, ?, ?)`,
-				dom, subdom, back.RequestURI(), back.Scheme, fr.FetchTime,
-				front.String()).Exec()
-			if err != nil {
-				log4go.Error("Failed to insert redirected link %s -> %s: %v", back.String(), front.String(), err)
-			}
-			back = front
+	// Only trick with this is that fr.URL redirected to RedirectedFrom[0], after that
+	// RedirectedFrom[n] redirected to RedirectedFrom[n+1]
+	for _, hop := range fr.redirectHops() {
+		back, front := hop.URL, hop.Location
+		dom, subdom, err = back.TLDPlusOneAndSubdomain()
+		if err != nil {
+			log4go.Error("StoreURLFetchResults not storing info for url that redirected (%v): %v", back, err)
+			continue
+		}
+		err := ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time, stat, redto_url) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			dom, subdom, back.RequestURI(), back.Scheme, fr.FetchTime,
+			hop.statusValue(), front.String()).Exec()
+		if err != nil {
+			log4go.Error("Failed to insert redirected link %s -> %s: %v", back.String(), front.String(), err)
 		}
 	}
 }
@@ -280,7 +555,7 @@ func (ds *CassandraDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
 	}
 	dom, subdom, err := u.TLDPlusOneAndSubdomain()
 	if err != nil {
-		log4go.Debug("StoreParsedURL not storing %v: %v", fr.URL, err)
+		log4go.Debug("StoreParsedURL not storing %v: %v", u, err)
 		return
 	}
 
@@ -288,14 +563,167 @@ func (ds *CassandraDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
 		ds.addDomainIfNew(dom)
 	}
 	log4go.Fine("Inserting parsed URL: %v", u)
-	err = ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time)
-						VALUES (?, ?, ?, ?, ?)`,
-		dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled).Exec()
+	if u.Sitemap != nil {
+		lastmod, changefreq := u.Sitemap.columnValues()
+		err = ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time,
+								sitemap_lastmod, sitemap_changefreq, sitemap_priority)
+							VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled,
+			lastmod, changefreq, u.Sitemap.Priority).Exec()
+	} else if u.SourceTag != "" {
+		err = ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time,
+								source_tag, source_attr)
+							VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled,
+			u.SourceTag, u.SourceAttr).Exec()
+	} else {
+		err = ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time)
+							VALUES (?, ?, ?, ?, ?)`,
+			dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled).Exec()
+	}
 	if err != nil {
 		log4go.Error("failed inserting parsed url (%v) to cassandra, %v", u, err)
 	}
 }
 
+func (ds *CassandraDatastore) StoreTrapURL(u *URL, reason string) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		log4go.Debug("StoreTrapURL not storing %v: %v", u, err)
+		return
+	}
+	err = ds.db.Query(`INSERT INTO trap_links (dom, subdom, path, proto, reason, time)
+						VALUES (?, ?, ?, ?, ?, ?)`,
+		dom, subdom, u.RequestURI(), u.Scheme, reason, time.Now()).Exec()
+	if err != nil {
+		log4go.Error("failed inserting trap url (%v) to cassandra, %v", u, err)
+	}
+}
+
+func (ds *CassandraDatastore) CachedRobots(origin string) *RobotsTxt {
+	r := &RobotsTxt{Origin: origin}
+	err := ds.db.Query(`SELECT stat, body, time, expires FROM robots WHERE origin = ?`,
+		origin).Scan(&r.StatusCode, &r.Body, &r.FetchTime, &r.Expires)
+	if err == gocql.ErrNotFound {
+		return nil
+	} else if err != nil {
+		log4go.Error("Failed to read cached robots.txt for %v: %v", origin, err)
+		return nil
+	}
+	return r
+}
+
+func (ds *CassandraDatastore) StoreRobots(r *RobotsTxt) {
+	err := ds.db.Query(`INSERT INTO robots (origin, stat, body, time, expires)
+						VALUES (?, ?, ?, ?, ?)`,
+		r.Origin, r.StatusCode, r.Body, r.FetchTime, r.Expires).Exec()
+	if err != nil {
+		log4go.Error("failed inserting robots.txt for %v to cassandra, %v", r.Origin, err)
+	}
+}
+
+func (ds *CassandraDatastore) CachedCrawlDelay(domain string) (time.Duration, bool) {
+	var ms *int
+	err := ds.db.Query(`SELECT crawl_delay_ms FROM domain_info WHERE dom = ?`, domain).Scan(&ms)
+	if err != nil {
+		if err != gocql.ErrNotFound {
+			log4go.Error("Failed to read crawl delay of %v: %v", domain, err)
+		}
+		return 0, false
+	}
+	if ms == nil {
+		return 0, false
+	}
+	return time.Duration(*ms) * time.Millisecond, true
+}
+
+func (ds *CassandraDatastore) StoreCrawlDelay(domain string, delay time.Duration) {
+	err := ds.db.Query(`UPDATE domain_info SET crawl_delay_ms = ? WHERE dom = ?`,
+		int(delay/time.Millisecond), domain).Exec()
+	if err != nil {
+		log4go.Error("Failed to store crawl delay of %v: %v", domain, err)
+	}
+}
+
+func (ds *CassandraDatastore) SetDomainPriority(domain string, priority int) error {
+	// IF EXISTS keeps us from creating a partial domain_info row
+	applied, err := ds.db.Query(`UPDATE domain_info SET priority = ? WHERE dom = ? IF EXISTS`,
+		priority, domain).ScanCAS()
+	if err != nil {
+		return fmt.Errorf("failed to set priority of %v: %v", domain, err)
+	}
+	if !applied {
+		return fmt.Errorf("%v is not part of the crawl", domain)
+	}
+	if err := recordPriority(ds.db, priority); err != nil {
+		return fmt.Errorf("failed to record priority %v: %v", priority, err)
+	}
+	return nil
+}
+
+// recordPriority adds priority to the priorities table, so the dispatcher and
+// ClaimNewHost look for domains of that priority.
+func recordPriority(db *gocql.Session, priority int) error {
+	if priority == 0 {
+		return nil
+	}
+	return db.Query(`INSERT INTO priorities (priority) VALUES (?)`, priority).Exec()
+}
+
+func (ds *CassandraDatastore) ExcludeDomain(domain string, reason string) error {
+	err := ds.db.Query(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority)
+						VALUES (?, ?, ?, ?) IF NOT EXISTS`,
+		domain, gocql.UUID{}, false, 0).Exec()
+	if err != nil {
+		return fmt.Errorf("failed to add excluded domain %v: %v", domain, err)
+	}
+	err = ds.db.Query(`UPDATE domain_info SET excluded = true, exclude_reason = ? WHERE dom = ?`,
+		reason, domain).Exec()
+	if err != nil {
+		return fmt.Errorf("failed to exclude %v: %v", domain, err)
+	}
+	// Excluded domains are skipped by ClaimNewHost, but would still take up
+	// the candidates it reads while dispatched
+	if err := ds.undispatch(domain); err != nil {
+		return fmt.Errorf("failed to undispatch excluded %v: %v", domain, err)
+	}
+	ds.addedDomains.Set(domain, nil)
+	log4go.Info("Excluded %v from the crawl: %v", domain, reason)
+	return nil
+}
+
+// IncludeDomain also undispatches the domain (unless it is claimed), in case
+// it was excluded while dispatched, so the dispatcher generates a fresh segment
+// for it.
+func (ds *CassandraDatastore) IncludeDomain(domain string) error {
+	if err := ds.undispatch(domain); err != nil {
+		return fmt.Errorf("failed to undispatch %v: %v", domain, err)
+	}
+	applied, err := ds.db.Query(`UPDATE domain_info SET excluded = false, exclude_reason = null
+								WHERE dom = ? IF EXISTS`, domain).ScanCAS()
+	if err != nil {
+		return fmt.Errorf("failed to include %v: %v", domain, err)
+	}
+	if !applied {
+		return fmt.Errorf("%v is not part of the crawl", domain)
+	}
+	log4go.Info("Included %v in the crawl", domain)
+	return nil
+}
+
+// undispatch marks domain undispatched and deletes its segment, unless a
+// crawler has claimed it, in which case that happens when it is unclaimed.
+func (ds *CassandraDatastore) undispatch(domain string) error {
+	var existingTok gocql.UUID
+	applied, err := ds.db.Query(`UPDATE domain_info SET dispatched = false
+								WHERE dom = ?
+								IF claim_tok = ?`, domain, gocql.UUID{}).ScanCAS(&existingTok)
+	if err != nil || !applied {
+		return err
+	}
+	return ds.db.Query(`DELETE FROM segments WHERE dom = ?`, domain).Exec()
+}
+
 // addDomainIfNew expects a toplevel domain, no subdomain
 func (ds *CassandraDatastore) addDomainIfNew(domain string) {
 	_, ok := ds.addedDomains.Get(domain)
@@ -319,18 +747,20 @@ func (ds *CassandraDatastore) addDomainIfNew(domain string) {
 }
 
 func (ds *CassandraDatastore) getSegmentLinks(domain string) (links []*URL, err error) {
-	q := ds.db.Query(`SELECT dom, subdom, path, proto, time
+	q := ds.db.Query(`SELECT dom, subdom, path, proto, time, last_modified, etag
 						FROM segments WHERE dom = ?`, domain)
 	iter := q.Iter()
 	defer func() { err = iter.Close() }()
 
-	var dbdomain, subdomain, path, protocol string
-	var crawl_time time.Time
-	for iter.Scan(&dbdomain, &subdomain, &path, &protocol, &crawl_time) {
+	var dbdomain, subdomain, path, protocol, etag string
+	var crawl_time, last_modified time.Time
+	for iter.Scan(&dbdomain, &subdomain, &path, &protocol, &crawl_time, &last_modified, &etag) {
 		u, e := CreateURL(dbdomain, subdomain, path, protocol, crawl_time)
 		if e != nil {
 			log4go.Error("Error adding link (%v) to crawl: %v", u, e)
 		} else {
+			u.LastModified = last_modified
+			u.ETag = etag
 			log4go.Debug("Adding link: %v", u)
 			links = append(links, u)
 		}
@@ -429,7 +859,8 @@ CREATE TABLE {{.Keyspace}}.links (
 	robot_ex boolean,
 
 	-- If this link redirects to another link target, the target link is stored
-	-- in this field
+	-- in this field (with the redirect's status code in stat). If the redirect
+	-- was not followed, the target is also stored as a link of its own.
 	redto_url text,
 
 	-- getnow is true if this link should be queued ASAP to be crawled
@@ -438,14 +869,41 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- mime type, also known as Content-Type (ex. "text/html")
 	mime text,
 
-	---- Items yet to be added to walker
+	-- ETag response header, sent back in If-None-Match when recrawling
+	etag text,
+
+	-- Last-Modified response header (null if the server didn't send one), sent
+	-- back in If-Modified-Since when recrawling
+	last_modified timestamp,
 
 	-- fingerprint, a hash of the page contents for identity comparison
-	--fp bigint,
+	fp bigint,
 
 	-- structure fingerprint, a hash of the page structure only (defined as:
 	-- html tags only, all contents and attributes stripped)
-	--structfp bigint,
+	structfp bigint,
+
+	-- true if the body was larger than max_http_content_size_bytes, so it was
+	-- truncated or the fetch aborted (null implies it was not)
+	truncated boolean,
+
+	-- number of links on the page that were not stored because it had more
+	-- than max_links_per_page (null implies none were dropped)
+	dropped_links int,
+
+	-- what the link's sitemap says about it, only set on the row of the parsed
+	-- link (null implies it was not found in a sitemap)
+	sitemap_lastmod timestamp,
+	sitemap_changefreq text,
+	sitemap_priority double,
+
+	-- the HTML tag and attribute the link was last parsed out of (ex. img and
+	-- srcset), only set on the row of the parsed link (null implies it was
+	-- not parsed out of a page)
+	source_tag text,
+	source_attr text,
+
+	---- Items yet to be added to walker
 
 	-- ip address of the remote server
 	--ip text,
@@ -469,12 +927,53 @@ CREATE TABLE {{.Keyspace}}.segments (
 	path text,
 	proto text,
 
-	-- time this link was last crawled, so that we can use if-modified-since headers
+	-- time this link was last crawled
+	time timestamp,
+
+	-- Last-Modified time (or the crawl time, if the server didn't send one) and
+	-- ETag of the last successful crawl of this link, for if-modified-since
+	-- and if-none-match headers
+	last_modified timestamp,
+	etag text,
+
+	PRIMARY KEY (dom, subdom, path, proto)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- trap_links contains parsed links that were not stored in links because they
+-- looked like crawler traps (ex. infinite calendars or session IDs)
+CREATE TABLE {{.Keyspace}}.trap_links (
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+
+	-- why this link looked like a crawler trap
+	reason text,
+
+	-- the last time this link was found
 	time timestamp,
 
 	PRIMARY KEY (dom, subdom, path, proto)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
 
+-- robots contains the robots.txt file of each origin (scheme, host and
+-- non-default port, ex. https://sub.test.com:8080) fetchers have fetched
+CREATE TABLE {{.Keyspace}}.robots (
+	origin text,
+
+	-- HTTP status of the robots.txt response, 0 if it could not be fetched
+	stat int,
+
+	-- contents of the robots.txt file, only set for 2XX responses
+	body blob,
+
+	-- when robots.txt was fetched, and when it should be fetched again
+	time timestamp,
+	expires timestamp,
+
+	PRIMARY KEY (origin)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
 CREATE TABLE {{.Keyspace}}.domain_info (
 	dom text,
 
@@ -498,18 +997,38 @@ CREATE TABLE {{.Keyspace}}.domain_info (
 	-- true if this domain has had a segment generated and is ready for crawling
 	dispatched boolean,
 
-	---- Items yet to be added to walker
-
 	-- true if this domain is excluded from the crawl (null implies not excluded)
-	--excluded boolean,
+	excluded boolean,
 	-- the reason this domain is excluded, null if not excluded
-	--exclude_reason text,
+	exclude_reason text,
+
+	-- set when none of this domain's hosts resolved while it was waiting to
+	-- be crawled: the domain is undispatched and not dispatched again until
+	-- dns_retry_time, and dns_error is why it failed to resolve
+	dns_retry_time timestamp,
+	dns_error text,
+
+	-- the crawl delay fetchers learned for this domain, in milliseconds (null
+	-- if none has been learned yet)
+	crawl_delay_ms int,
+
+	---- Items yet to be added to walker
 
 	-- If not null, identifies another domain as a mirror of this one
 	--mirr_for text,
 
 	PRIMARY KEY (dom)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- priorities lists the domain priorities other than the default (0) that have
+-- been given to domains, so the dispatcher and ClaimNewHost can look for
+-- domains one priority at a time (through the domain_info priority index), highest first. A priority
+-- is never removed, it costs little to look for domains of a priority no
+-- domain has anymore.
+CREATE TABLE {{.Keyspace}}.priorities (
+	priority int PRIMARY KEY
+);
+
 CREATE INDEX ON {{.Keyspace}}.domain_info (claim_tok);
 CREATE INDEX ON {{.Keyspace}}.domain_info (priority);
 CREATE INDEX ON {{.Keyspace}}.domain_info (dispatched);`
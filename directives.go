@@ -0,0 +1,127 @@
+package walker
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/go.net/html/charset"
+)
+
+// robotsDirectives are the indexing directives a page gives robots, through
+// <meta name="robots"> tags or X-Robots-Tag headers.
+type robotsDirectives struct {
+	noIndex  bool
+	noFollow bool
+}
+
+// xRobotsTagDirectives are directives whose X-Robots-Tag values contain a
+// colon, so they aren't mistaken for a user agent prefix (as in
+// "X-Robots-Tag: otherbot: noindex")
+var xRobotsTagDirectives = map[string]bool{
+	"unavailable_after": true,
+	"max-snippet":       true,
+	"max-image-preview": true,
+	"max-video-preview": true,
+}
+
+// robotName returns the name we answer to in user agent specific directives,
+// ex. "walker" for the default user agent.
+func robotName() string {
+	name := strings.ToLower(strings.TrimSpace(Config.UserAgent))
+	if i := strings.IndexAny(name, " /("); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// add applies a comma separated list of directives, ex. "noindex, nofollow".
+func (d *robotsDirectives) add(content string) {
+	for _, directive := range strings.Split(content, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "noindex":
+			d.noIndex = true
+		case "nofollow":
+			d.noFollow = true
+		case "none":
+			d.noIndex = true
+			d.noFollow = true
+		}
+	}
+}
+
+// headerRobotsDirectives returns the directives of the X-Robots-Tag headers
+// in header that apply to us: those without a user agent prefix and those
+// addressed to robotName().
+func headerRobotsDirectives(header http.Header) robotsDirectives {
+	var d robotsDirectives
+	for _, value := range header[http.CanonicalHeaderKey("X-Robots-Tag")] {
+		if i := strings.Index(value, ":"); i >= 0 {
+			agent := strings.ToLower(strings.TrimSpace(value[:i]))
+			if !xRobotsTagDirectives[agent] && !strings.Contains(agent, ",") {
+				if agent != robotName() {
+					continue
+				}
+				value = value[i+1:]
+			}
+		}
+		d.add(value)
+	}
+	return d
+}
+
+// getMetaRobots returns the directives of the page's <meta name="robots">
+// tags, along with any addressed to robotName() by name.
+func getMetaRobots(contents []byte) (robotsDirectives, error) {
+	var d robotsDirectives
+	utf8Reader, err := charset.NewReader(bytes.NewReader(contents), "text/html")
+	if err != nil {
+		return d, err
+	}
+	tokenizer := html.NewTokenizer(utf8Reader)
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return d, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tagName, hasAttrs := tokenizer.TagName()
+			if string(tagName) == "body" {
+				// Meta tags are only valid in the head
+				return d, nil
+			}
+			if string(tagName) != "meta" || !hasAttrs {
+				continue
+			}
+
+			var name, content string
+			for {
+				key, val, moreAttr := tokenizer.TagAttr()
+				switch string(key) {
+				case "name":
+					name = strings.ToLower(strings.TrimSpace(string(val)))
+				case "content":
+					content = string(val)
+				}
+				if !moreAttr {
+					break
+				}
+			}
+			if name == "robots" || name == robotName() {
+				d.add(content)
+			}
+		}
+	}
+}
+
+// isNoFollowRel returns true if the rel attribute value rel includes
+// nofollow, ex. rel="nofollow noopener".
+func isNoFollowRel(rel string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == "nofollow" {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"fmt"
 	"math"
+	"net/http"
 	"sync"
 	"time"
 
@@ -73,6 +74,14 @@ func (d *CassandraDispatcher) StartDispatcher() error {
 		}()
 	}
 
+	if Config.Dispatcher.StaleClaimTimeout > 0 {
+		d.finishWG.Add(1)
+		go func() {
+			runClaimReaper(d.quit, d.releaseStaleClaims)
+			d.finishWG.Done()
+		}()
+	}
+
 	d.domainIterator()
 	return nil
 }
@@ -85,26 +94,22 @@ func (d *CassandraDispatcher) StopDispatcher() error {
 	return nil
 }
 
+// dispatchPageSize is the number of domains the dispatcher reads from
+// domain_info per query page while iterating a priority.
+const dispatchPageSize = 100
+
 func (d *CassandraDispatcher) domainIterator() {
 	for {
 		log4go.Debug("Starting new domain iteration")
-		domainiter := d.db.Query(`SELECT dom, dispatched FROM domain_info
-									WHERE claim_tok = 00000000-0000-0000-0000-000000000000
-									AND dispatched = false ALLOW FILTERING`).Iter()
-
-		var domain string
-		var dispatched bool
-		for domainiter.Scan(&domain, &dispatched) {
-			select {
-			case <-d.quit:
+
+		// Cassandra can't order by a non-clustering column, so generate
+		// segments for the highest priority domains first by going through
+		// the priorities in use one at a time, through the priority index
+		for _, priority := range readPriorities(d.db) {
+			if !d.dispatchPriority(priority) {
 				log4go.Debug("Domain iterator signaled to stop")
 				close(d.domains)
 				return
-			default:
-			}
-
-			if !dispatched {
-				d.domains <- domain
 			}
 		}
 
@@ -117,16 +122,50 @@ func (d *CassandraDispatcher) domainIterator() {
 		default:
 		}
 
-		if err := domainiter.Close(); err != nil {
-			log4go.Error("Error iterating domains from domain_info: %v", err)
-		}
-
 		//TODO: configure this sleep time
 		time.Sleep(time.Second)
 		d.generatingWG.Wait()
 	}
 }
 
+// dispatchPriority passes the undispatched domains of the given priority to
+// the generator routines, reading them from domain_info a page at a time. It
+// returns false if the dispatcher was stopped while doing so.
+func (d *CassandraDispatcher) dispatchPriority(priority int) bool {
+	var domain string
+	var excluded bool
+	var dnsRetryTime time.Time
+	start := time.Now()
+	domainiter := d.db.Query(`SELECT dom, excluded, dns_retry_time FROM domain_info
+								WHERE priority = ?
+								AND claim_tok = 00000000-0000-0000-0000-000000000000
+								AND dispatched = false ALLOW FILTERING`, priority).
+		PageSize(dispatchPageSize).Iter()
+	defer func() {
+		if err := domainiter.Close(); err != nil {
+			log4go.Error("Error iterating domains of priority %v from domain_info: %v", priority, err)
+		}
+	}()
+	for domainiter.Scan(&domain, &excluded, &dnsRetryTime) {
+		// excluded and dns_retry_time may be null, so we can't filter on
+		// them in the query
+		if excluded {
+			log4go.Fine("Not dispatching excluded domain %v", domain)
+			continue
+		}
+		if dnsRetryTime.After(start) {
+			log4go.Fine("Not dispatching %v until it is retried at %v", domain, dnsRetryTime)
+			continue
+		}
+		select {
+		case <-d.quit:
+			return false
+		case d.domains <- domain:
+		}
+	}
+	return true
+}
+
 func (d *CassandraDispatcher) generateRoutine() {
 	for domain := range d.domains {
 		d.generatingWG.Add(1)
@@ -138,6 +177,63 @@ func (d *CassandraDispatcher) generateRoutine() {
 	log4go.Debug("Finishing generateRoutine")
 }
 
+// runClaimReaper calls release every Config.Dispatcher.StaleClaimCheckInterval
+// until quit is closed.
+func runClaimReaper(quit chan struct{}, release func()) {
+	interval := time.Duration(Config.Dispatcher.StaleClaimCheckInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			log4go.Debug("Claim reaper signaled to stop")
+			return
+		case <-ticker.C:
+			release()
+		}
+	}
+}
+
+// releaseStaleClaims unclaims any domain that has been claimed for longer than
+// Config.Dispatcher.StaleClaimTimeout, which implies the crawler that claimed
+// it stopped abnormally. The domain's segment is left in place so another
+// crawler can claim it and pick up where the last one left off.
+func (d *CassandraDispatcher) releaseStaleClaims() {
+	timeout := time.Duration(Config.Dispatcher.StaleClaimTimeout) * time.Second
+
+	// Claimed domains are always dispatched; claim_tok can't be filtered on
+	// with != so we check it here
+	iter := d.db.Query(`SELECT dom, claim_tok, claim_time FROM domain_info
+						WHERE dispatched = true ALLOW FILTERING`).Iter()
+	var domain string
+	var claimTok gocql.UUID
+	var claimTime time.Time
+	for iter.Scan(&domain, &claimTok, &claimTime) {
+		if claimTok == (gocql.UUID{}) || time.Since(claimTime) < timeout {
+			continue
+		}
+
+		// Only release the claim if nobody has claimed or refreshed it since
+		// we read it
+		var existingTok gocql.UUID
+		var existingTime time.Time
+		applied, err := d.db.Query(`UPDATE domain_info SET claim_tok = ?
+									WHERE dom = ?
+									IF claim_tok = ? AND claim_time = ?`,
+			gocql.UUID{}, domain, claimTok, claimTime).ScanCAS(&existingTok, &existingTime)
+		if err != nil {
+			log4go.Error("Failed to release stale claim on %v: %v", domain, err)
+		} else if applied {
+			log4go.Info("Released stale claim on %v held by %v since %v", domain, claimTok, claimTime)
+		} else {
+			log4go.Debug("Stale claim on %v changed before it could be released", domain)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log4go.Error("Error iterating domains to release stale claims: %v", err)
+	}
+}
+
 //
 // Some mathy type functions used in generateSegment
 //
@@ -169,6 +265,55 @@ type cell struct {
 	subdom, path, proto string
 	crawl_time          time.Time
 	getnow              bool
+	etag                string
+	last_modified       time.Time
+	stat                int
+	fp, structfp        int64
+
+	// ifModifiedSince and ifNoneMatch are what to send in the conditional
+	// headers of the next crawl of this link, from the last crawl (up to and
+	// including this one) that succeeded or found the page unchanged; a crawl
+	// that failed tells us nothing about the version of the page we have
+	ifModifiedSince time.Time
+	ifNoneMatch     string
+
+	// unchanged counts how many crawls in a row (up to and including this
+	// one) found the same content as the crawl before, see follow
+	unchanged int
+
+	// first is the time of the first crawl of this link, and observations
+	// and changes count the crawls (up to and including this one) we could
+	// compare with the crawl before, and how many of those found the content
+	// changed (see LinkHistory)
+	first        time.Time
+	observations int
+	changes      int
+
+	// lastmod, changefreq and priority are the link's SitemapHints (only
+	// stored on the row of the parsed link, follow carries them forward)
+	lastmod    time.Time
+	changefreq string
+	priority   float64
+}
+
+// resetHistory clears the crawl history of c, as for the first crawl of a
+// link. follow then carries the history forward from the crawl before.
+func (c *cell) resetHistory() {
+	c.unchanged = 0
+	c.first = c.crawl_time
+	c.observations = 0
+	c.changes = 0
+
+	c.ifModifiedSince, c.ifNoneMatch = time.Time{}, ""
+	switch {
+	case c.stat >= 200 && c.stat < 300:
+		c.ifModifiedSince, c.ifNoneMatch = c.last_modified, c.etag
+		if c.ifModifiedSince.IsZero() {
+			c.ifModifiedSince = c.crawl_time
+		}
+	case c.stat == http.StatusNotModified:
+		c.ifModifiedSince, c.ifNoneMatch = c.last_modified, c.etag
+	}
 }
 
 // 2 cells are equivalent if their full link renders to the same string.
@@ -178,11 +323,90 @@ func (c *cell) equivalent(other *cell) bool {
 		c.proto == other.proto
 }
 
+// follow carries the crawl history of a link forward from prev, the crawl
+// of the same link just before c. A 304 or a matching fingerprint means the
+// page was unchanged; a crawl without a fingerprint (ex. an error or non-HTML
+// page) tells us nothing, so it keeps the history as it was.
+func (c *cell) follow(prev *cell) {
+	c.first = prev.first
+	if prev.first.Equal(NotYetCrawled) {
+		// prev was the row of the link being parsed, not a crawl
+		c.first = c.crawl_time
+	}
+	c.observations, c.changes = prev.observations, prev.changes
+	if c.lastmod.IsZero() && c.changefreq == "" && c.priority == 0 {
+		c.lastmod, c.changefreq, c.priority = prev.lastmod, prev.changefreq, prev.priority
+	}
+	if c.stat < 200 || c.stat >= 300 {
+		// Only a successful crawl replaces the version of the page we have
+		if c.ifModifiedSince.IsZero() {
+			c.ifModifiedSince = prev.ifModifiedSince
+		}
+		if c.ifNoneMatch == "" {
+			c.ifNoneMatch = prev.ifNoneMatch
+		}
+	}
+	switch {
+	case c.stat == http.StatusNotModified:
+		c.fp, c.structfp = prev.fp, prev.structfp
+		c.unchanged = prev.unchanged + 1
+		c.observations++
+	case c.fp == 0:
+		c.fp, c.structfp = prev.fp, prev.structfp
+		c.unchanged = prev.unchanged
+	case prev.fp == 0:
+		// The first fingerprint of this link, nothing to compare it to
+		c.unchanged = 0
+	case c.fp == prev.fp:
+		c.unchanged = prev.unchanged + 1
+		c.observations++
+	default:
+		c.unchanged = 0
+		c.observations++
+		c.changes++
+	}
+}
+
+// sitemap returns the SitemapHints of the link c holds the crawl information
+// for, or nil if it wasn't found in a sitemap.
+func (c *cell) sitemap() *SitemapHints {
+	if c.lastmod.IsZero() && c.changefreq == "" && c.priority == 0 {
+		return nil
+	}
+	return &SitemapHints{LastMod: c.lastmod, ChangeFreq: c.changefreq, Priority: c.priority}
+}
+
+// history returns the LinkHistory of u, the link c holds the crawl
+// information for.
+func (c *cell) history(u *URL) *LinkHistory {
+	h := &LinkHistory{
+		URL:          u,
+		FirstCrawled: c.first,
+		LastCrawled:  u.LastCrawled,
+		Observations: c.observations,
+		Changes:      c.changes,
+		Sitemap:      c.sitemap(),
+	}
+	if h.FirstCrawled.IsZero() {
+		h.FirstCrawled = h.LastCrawled
+	}
+	return h
+}
+
+// stable returns true if this link's content hasn't changed in its last
+// Config.Dispatcher.StableCrawlCount crawls and it was crawled recently
+// enough that it doesn't need refreshing yet.
+func (c *cell) stable() bool {
+	count := Config.Dispatcher.StableCrawlCount
+	delay := time.Duration(Config.Dispatcher.StableRecrawlDelay) * time.Second
+	return count > 0 && c.unchanged >= count && time.Since(c.crawl_time) < delay
+}
+
 //
 // PriorityUrl is a heap of URLs, where the next element Pop'ed off the list
 // points to the oldest (as measured by LastCrawled) element in the list. This
-// class is designed to be used with the container/heap package. This type is
-// currently only used in generateSegments
+// class is designed to be used with the container/heap package. Segments
+// order crawled links with a RecrawlPolicy instead (see refreshQueue).
 //
 type PriorityUrl []*URL
 
@@ -210,41 +434,259 @@ func (pq *PriorityUrl) Pop() interface{} {
 	return x
 }
 
-// generateSegment reads links in for this domain, generates a segment for it,
-// and inserts the domain into domains_to_crawl (assuming a segment is ready to
-// go)
-func (d *CassandraDispatcher) generateSegment(domain string) error {
-	log4go.Info("Generating a crawl segment for %v", domain)
+// refreshLink is a crawled link along with its RecrawlPolicy score.
+type refreshLink struct {
+	u     *URL
+	score float64
+}
 
-	//
-	// Three lists to hold the 3 link types
-	//
-	var getNowLinks []*URL       // links marked getnow
-	var uncrawledLinks []*URL    // links that haven't been crawled
-	var crawledLinks PriorityUrl // already crawled links, oldest links out first
-	heap.Init(&crawledLinks)
-
-	// cell push will push the argument cell onto one of the three link-lists.
-	// logs failure if CreateURL fails.
-	var limit = Config.Dispatcher.MaxLinksPerSegment
-	cell_push := func(c *cell) {
-		u, err := CreateURL(domain, c.subdom, c.path, c.proto, c.crawl_time)
-		if err != nil {
-			log4go.Error("CreateURL: " + err.Error())
-			return
+// refreshQueue is a heap of crawled links, where the next element Pop'ed off
+// the list is the one with the highest score (the oldest one for equal
+// scores). It is designed to be used with the container/heap package.
+type refreshQueue []refreshLink
+
+func (q refreshQueue) Len() int {
+	return len(q)
+}
+
+func (q refreshQueue) Less(i, j int) bool {
+	if q[i].score != q[j].score {
+		return q[i].score > q[j].score
+	}
+	return q[i].u.LastCrawled.Before(q[j].u.LastCrawled)
+}
+
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	*q = append(*q, x.(refreshLink))
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[0 : n-1]
+	return x
+}
+
+// uncrawledLink is a link that hasn't been crawled yet along with its sitemap
+// priority. seq is the order it was pushed in, which keeps the order of links
+// with equal priority stable.
+type uncrawledLink struct {
+	u        *URL
+	priority float64
+	seq      int
+}
+
+// uncrawledQueue is a heap of uncrawled links, where the next element Pop'ed
+// off the list is the one with the lowest priority (the last pushed for equal
+// priorities). This lets segmentBuilder keep the highest priority links seen
+// so far, dropping the lowest when it is full.
+type uncrawledQueue []uncrawledLink
+
+func (q uncrawledQueue) Len() int {
+	return len(q)
+}
+
+func (q uncrawledQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].seq > q[j].seq
+}
+
+func (q uncrawledQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *uncrawledQueue) Push(x interface{}) {
+	*q = append(*q, x.(uncrawledLink))
+}
+
+func (q *uncrawledQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[0 : n-1]
+	return x
+}
+
+// segmentBuilder sorts the links of a single domain into the three link types
+// we dispatch (getnow, uncrawled and already crawled links), then merges them
+// into a segment. It is shared by the Dispatcher implementations (and any
+// Datastore that generates its own segments) so they select links the same
+// way.
+type segmentBuilder struct {
+	domain string
+	limit  int
+
+	getNowLinks    []*URL         // links marked getnow
+	uncrawledLinks uncrawledQueue // links that haven't been crawled, lowest sitemap priority out first
+	crawledLinks   refreshQueue   // already crawled links, highest RecrawlPolicy score out first
+	uncrawledSeq   int            // number of uncrawled links pushed so far
+
+	policy RecrawlPolicy
+	now    time.Time
+
+	// structfps holds the structure fingerprint of crawled links, for
+	// collapsing structural duplicates
+	structfps map[*URL]int64
+}
+
+func newSegmentBuilder(domain string) *segmentBuilder {
+	sb := &segmentBuilder{
+		domain:    domain,
+		limit:     Config.Dispatcher.MaxLinksPerSegment,
+		structfps: map[*URL]int64{},
+		policy:    currentRecrawlPolicy(),
+		now:       time.Now(),
+	}
+	heap.Init(&sb.uncrawledLinks)
+	heap.Init(&sb.crawledLinks)
+	return sb
+}
+
+// push will push the argument cell onto one of the three link-lists. Logs
+// failure if CreateURL fails.
+func (sb *segmentBuilder) push(c *cell) {
+	u, err := CreateURL(sb.domain, c.subdom, c.path, c.proto, c.crawl_time)
+	if err != nil {
+		log4go.Error("CreateURL: " + err.Error())
+		return
+	}
+	u.LastModified, u.ETag = c.ifModifiedSince, c.ifNoneMatch
+	sb.pushURL(u, c)
+}
+
+// pushURL is the same as push for a link we already have as a URL; its
+// LastCrawled must be set. c holds the rest of the link's crawl information
+// (its link fields are ignored).
+func (sb *segmentBuilder) pushURL(u *URL, c *cell) {
+	if c.getnow {
+		if len(sb.getNowLinks) < sb.limit {
+			sb.getNowLinks = append(sb.getNowLinks, u)
 		}
+	} else if u.LastCrawled.Equal(NotYetCrawled) {
+		sb.pushUncrawled(u, sitemapPriority(c.sitemap()))
+	} else if c.stable() {
+		log4go.Fine("Not refreshing stable link %v", u)
+	} else {
+		heap.Push(&sb.crawledLinks, refreshLink{u: u, score: sb.policy.RefreshScore(c.history(u), sb.now)})
+		if c.structfp != 0 {
+			sb.structfps[u] = c.structfp
+		}
+	}
+}
+
+// pushUncrawled adds an uncrawled link, keeping only the sb.limit links with
+// the highest sitemap priority (the first pushed for equal priorities).
+func (sb *segmentBuilder) pushUncrawled(u *URL, priority float64) {
+	l := uncrawledLink{u: u, priority: priority, seq: sb.uncrawledSeq}
+	sb.uncrawledSeq++
+	if sb.uncrawledLinks.Len() < sb.limit {
+		heap.Push(&sb.uncrawledLinks, l)
+	} else if priority > sb.uncrawledLinks[0].priority {
+		sb.uncrawledLinks[0] = l
+		heap.Fix(&sb.uncrawledLinks, 0)
+	}
+}
+
+// uncrawled returns the uncrawled links, highest sitemap priority first.
+func (sb *segmentBuilder) uncrawled() []*URL {
+	q := append(uncrawledQueue{}, sb.uncrawledLinks...)
+	links := make([]*URL, q.Len())
+	for i := len(links) - 1; i >= 0; i-- {
+		links[i] = heap.Pop(&q).(uncrawledLink).u
+	}
+	return links
+}
 
-		if c.getnow {
-			getNowLinks = append(getNowLinks, u)
-		} else if c.crawl_time.Equal(NotYetCrawled) {
-			if len(uncrawledLinks) < limit {
-				uncrawledLinks = append(uncrawledLinks, u)
+// popRefreshLink pops the crawled link most in need of refreshing off the
+// heap, skipping links with the same structure as one already in this segment
+// if Config.Dispatcher.CollapseStructuralDuplicates is set. seen tracks the
+// structures already in the segment. Returns nil if no links are left.
+func (sb *segmentBuilder) popRefreshLink(seen map[int64]bool) *URL {
+	for sb.crawledLinks.Len() > 0 {
+		u := heap.Pop(&sb.crawledLinks).(refreshLink).u
+		structfp, ok := sb.structfps[u]
+		if ok && Config.Dispatcher.CollapseStructuralDuplicates {
+			if seen[structfp] {
+				log4go.Fine("Not refreshing structural duplicate %v", u)
+				continue
 			}
-		} else {
-			heap.Push(&crawledLinks, u)
+			seen[structfp] = true
+		}
+		return u
+	}
+	return nil
+}
+
+// full returns true if the segment will consist only of getnow links, so
+// there is no point in reading any more links.
+func (sb *segmentBuilder) full() bool {
+	return len(sb.getNowLinks) >= sb.limit
+}
+
+// segment merges the 3 link types into a segment of at most
+// Config.Dispatcher.MaxLinksPerSegment links. All getnow links are taken
+// first; the remaining space is split between uncrawled links (highest
+// sitemap priority first) and refresh links (ranked by the RecrawlPolicy)
+// according to
+// Config.Dispatcher.RefreshPercentage, backfilling from either list if the
+// other runs short.
+func (sb *segmentBuilder) segment() []*URL {
+	limit := sb.limit
+	uncrawledLinks := sb.uncrawled()
+	seen := map[int64]bool{}
+
+	var links []*URL
+	links = append(links, sb.getNowLinks...)
+
+	numRemain := limit - len(links)
+	if numRemain > 0 {
+		refreshDecimal := Config.Dispatcher.RefreshPercentage / 100.0
+		idealCrawled := round(refreshDecimal * float64(numRemain))
+		idealUncrawled := numRemain - idealCrawled
+
+		for i := 0; i < idealUncrawled && len(uncrawledLinks) > 0 && len(links) < limit; i++ {
+			links = append(links, uncrawledLinks[0])
+			uncrawledLinks = uncrawledLinks[1:]
+		}
+
+		for i := 0; i < idealCrawled && len(links) < limit; i++ {
+			u := sb.popRefreshLink(seen)
+			if u == nil {
+				break
+			}
+			links = append(links, u)
+		}
+
+		for len(uncrawledLinks) > 0 && len(links) < limit {
+			links = append(links, uncrawledLinks[0])
+			uncrawledLinks = uncrawledLinks[1:]
+		}
+
+		for len(links) < limit {
+			u := sb.popRefreshLink(seen)
+			if u == nil {
+				break
+			}
+			links = append(links, u)
 		}
-		return
 	}
+	return links
+}
+
+// generateSegment reads links in for this domain, generates a segment for it,
+// and inserts the domain into domains_to_crawl (assuming a segment is ready to
+// go)
+func (d *CassandraDispatcher) generateSegment(domain string) error {
+	log4go.Info("Generating a crawl segment for %v", domain)
+
+	sb := newSegmentBuilder(domain)
 
 	//
 	// Do the scan, and populate the 3 lists
@@ -253,31 +695,35 @@ func (d *CassandraDispatcher) generateSegment(domain string) error {
 	var finish = true
 	var current cell
 	var previous cell
-	iter := d.db.Query(`SELECT subdom, path, proto, time, getnow
+	iter := d.db.Query(`SELECT subdom, path, proto, time, getnow, etag, last_modified, stat, fp, structfp,
+							sitemap_lastmod, sitemap_changefreq, sitemap_priority
 						FROM links WHERE dom = ?`, domain).Iter()
-	for iter.Scan(&current.subdom, &current.path, &current.proto, &current.crawl_time, &current.getnow) {
-		if start {
-			previous = current
-			start = false
-		}
+	for iter.Scan(&current.subdom, &current.path, &current.proto, &current.crawl_time,
+		&current.getnow, &current.etag, &current.last_modified, &current.stat, &current.fp, &current.structfp,
+		&current.lastmod, &current.changefreq, &current.priority) {
+		current.resetHistory()
 
 		// IMPL NOTE: So the trick here is that, within a given domain, the entries
 		// come out so that the crawl_time increases as you iterate. So in order to
 		// get the most recent link, simply take the last link in a series that shares
 		// dom, subdom, path, and protocol
-		if !current.equivalent(&previous) {
-			cell_push(&previous)
+		if start {
+			start = false
+		} else if !current.equivalent(&previous) {
+			sb.push(&previous)
+		} else {
+			current.follow(&previous)
 		}
 
 		previous = current
 
-		if len(getNowLinks) >= limit {
+		if sb.full() {
 			finish = false
 			break
 		}
 	}
-	if finish {
-		cell_push(&previous)
+	if finish && !start {
+		sb.push(&previous)
 	}
 	if err := iter.Close(); err != nil {
 		return fmt.Errorf("error selecting links for %v: %v", domain, err)
@@ -286,33 +732,7 @@ func (d *CassandraDispatcher) generateSegment(domain string) error {
 	//
 	// Merge the 3 link types
 	//
-	var links []*URL
-	links = append(links, getNowLinks...)
-
-	numRemain := limit - len(links)
-	if numRemain > 0 {
-		refreshDecimal := Config.Dispatcher.RefreshPercentage / 100.0
-		idealCrawled := round(refreshDecimal * float64(numRemain))
-		idealUncrawled := numRemain - idealCrawled
-
-		for i := 0; i < idealUncrawled && len(uncrawledLinks) > 0 && len(links) < limit; i++ {
-			links = append(links, uncrawledLinks[0])
-			uncrawledLinks = uncrawledLinks[1:]
-		}
-
-		for i := 0; i < idealCrawled && crawledLinks.Len() > 0 && len(links) < limit; i++ {
-			links = append(links, heap.Pop(&crawledLinks).(*URL))
-		}
-
-		for len(uncrawledLinks) > 0 && len(links) < limit {
-			links = append(links, uncrawledLinks[0])
-			uncrawledLinks = uncrawledLinks[1:]
-		}
-
-		for crawledLinks.Len() > 0 && len(links) < limit {
-			links = append(links, heap.Pop(&crawledLinks).(*URL))
-		}
-	}
+	links := sb.segment()
 
 	//
 	// Got any links
@@ -333,9 +753,9 @@ func (d *CassandraDispatcher) generateSegment(domain string) error {
 			return err
 		}
 		err = d.db.Query(`INSERT INTO segments
-			(dom, subdom, path, proto, time)
-			VALUES (?, ?, ?, ?, ?)`,
-			dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled).Exec()
+			(dom, subdom, path, proto, time, last_modified, etag)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled, u.lastModifiedValue(), u.ETag).Exec()
 		if err != nil {
 			log4go.Error("Failed to insert link (%v), error: %v", u, err)
 		}
@@ -1,34 +1,39 @@
 package walker
 
 import (
+	"expvar"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/dropbox/godropbox/container/lrucache"
 )
 
-//TODO:
-//  - use a time-based cache instead of entry-capped, since we know we'll
-//    need most of the recently-accessed domains and few of the aging entries
-//  - consider not caching failures or doing any blacklisting here; the more
-//    likely usecase will be to retry a few times (in which case we don't want
-//    caching) and then not bother crawling this host at all
-
-// DNSCachingDial wraps the given dial function with Caching of DNS
-// resolutions. When a hostname is found in the cache it will call the provided
-// dial with the IP address instead of the hostname, so no DNS lookup need be
-// performed. It will also cache DNS failures.
+// DNSCachingDial wraps the given dial function with caching of DNS
+// resolutions. Hosts are resolved with the DNSResolver (see SetDNSResolver)
+// and the provided dial is called with one of their IP addresses instead of
+// the hostname. Dials to a host with several addresses stick to one of them
+// until it fails to connect or the host is resolved again, which moves on to
+// the next address, so each address gets its turn.
 //
+// Resolutions are cached for the TTL of their DNS records, bounded by
+// Config.DNSCache.MinTTL and MaxTTL. Failed resolutions are cached for
+// Config.DNSCache.NegativeTTL, so a host that failed to resolve is retried
+// soon after. At most maxEntries hosts are cached, evicting the least
+// recently used.
 func DNSCachingDial(dial func(network, addr string) (net.Conn, error), maxEntries int) func(network, addr string) (net.Conn, error) {
+	return newDNSCache(dial, maxEntries).dial
+}
+
+func newDNSCache(dial func(network, addr string) (net.Conn, error), maxEntries int) *dnsCache {
 	if dial == nil {
 		dial = net.Dial
 	}
-	c := &dnsCache{
+	return &dnsCache{
 		wrappedDial: dial,
 		cache:       lrucache.New(maxEntries),
 	}
-	return c.dial
 }
 
 // dnsCache wraps a net.Dial-type function with it's own version that will
@@ -36,84 +41,274 @@ func DNSCachingDial(dial func(network, addr string) (net.Conn, error), maxEntrie
 type dnsCache struct {
 	wrappedDial func(network, address string) (net.Conn, error)
 	cache       *lrucache.LRUCache
-	mu          sync.RWMutex
+	mu          sync.Mutex
 }
 
+// hostrecord is a cached resolution of a host: either its addresses, or the
+// error resolving it failed with.
 type hostrecord struct {
-	ipaddr      string
-	blacklisted bool
-	err         error
-	lastQuery   time.Time
+	ips     []net.IP
+	err     error
+	expires time.Time
+
+	// next is the index in ips of the address dials to the host go to
+	next int
+
+	// dialTried is true once a failed lookup has been retried by the
+	// wrapped dial
+	dialTried bool
+}
+
+// DNSResolver looks up the IP addresses of host, returning them along with
+// how long they may be cached for (the TTL of their DNS records).
+type DNSResolver func(host string) ([]net.IP, time.Duration, error)
+
+var dnsResolver struct {
+	sync.RWMutex
+	resolver DNSResolver
+}
+
+// SetDNSResolver sets the DNSResolver used by DNS caches in this process.
+// Passing nil goes back to the default, which queries the nameservers in
+// /etc/resolv.conf for A and AAAA records.
+func SetDNSResolver(r DNSResolver) {
+	dnsResolver.Lock()
+	defer dnsResolver.Unlock()
+	dnsResolver.resolver = r
+}
+
+// currentDNSResolver returns the resolver set with SetDNSResolver, or the
+// default one.
+func currentDNSResolver() DNSResolver {
+	dnsResolver.RLock()
+	defer dnsResolver.RUnlock()
+	if dnsResolver.resolver != nil {
+		return dnsResolver.resolver
+	}
+	return lookupIPTTL
+}
+
+// DNSCacheCounts are totals of DNS cache activity in this process. They are
+// also published through expvar, as walker_dns_cache.
+type DNSCacheCounts struct {
+	// Hits are lookups answered from the cache, including cached failures
+	Hits int64
+
+	// Misses are lookups that had to go to the DNSResolver
+	Misses int64
+
+	// Failures are lookups the DNSResolver failed to answer
+	Failures int64
+}
+
+var dnsCacheStats = struct {
+	hits, misses, failures *expvar.Int
+}{new(expvar.Int), new(expvar.Int), new(expvar.Int)}
+
+func init() {
+	m := expvar.NewMap("walker_dns_cache")
+	m.Set("hits", dnsCacheStats.hits)
+	m.Set("misses", dnsCacheStats.misses)
+	m.Set("failures", dnsCacheStats.failures)
+}
+
+// DNSCacheStats returns the DNS cache counts of this process so far.
+func DNSCacheStats() DNSCacheCounts {
+	return DNSCacheCounts{
+		Hits:     dnsCacheStats.hits.Value(),
+		Misses:   dnsCacheStats.misses.Value(),
+		Failures: dnsCacheStats.failures.Value(),
+	}
 }
 
 func (c *dnsCache) dial(network, addr string) (net.Conn, error) {
-	mapEntryName := network + addr
-	c.mu.RLock()
-	if entry, ok := c.cache.Get(mapEntryName); ok {
-		record := entry.(hostrecord)
-		lastQueryTime := record.lastQuery
-		if time.Since(lastQueryTime) > 5*time.Minute {
-			c.mu.RUnlock()
-			c.cacheHost(network, addr)
-			c.mu.RLock()
-			entry, _ = c.cache.Get(mapEntryName)
-			record = entry.(hostrecord)
-		}
-		resolvedAddr := record.ipaddr
-		if record.blacklisted {
-			returnErr := record.err
-			c.mu.RUnlock()
-			return nil, returnErr
-		} else {
-			c.mu.RUnlock()
-			return c.wrappedDial(network, resolvedAddr)
-		}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if net.ParseIP(host) != nil {
+		return c.wrappedDial(network, addr)
+	}
+
+	record := c.cached(host)
+	if record != nil {
+		dnsCacheStats.hits.Add(1)
 	} else {
-		c.mu.RUnlock()
-		return c.cacheHost(network, addr)
+		record = c.lookup(host)
+	}
+	if record.err == nil {
+		return c.dialRecord(network, addr, port, record)
 	}
-}
 
-// cacheHost caches the DNS lookup for this host, overwriting any entry
-// that may have previously existed.
-func (c *dnsCache) cacheHost(network, addr string) (net.Conn, error) {
-	mapEntryName := network + addr
-	newConn, err := c.wrappedDial(network, addr)
-	queryTime := time.Now()
+	// The resolver doesn't know host, but the wrapped dial may (ex. through
+	// /etc/hosts), so let it resolve host itself once per failed lookup and
+	// remember where it connected to.
 	c.mu.Lock()
+	tried := record.dialTried
+	record.dialTried = true
+	c.mu.Unlock()
+	if tried {
+		return nil, record.err
+	}
+	conn, err := c.wrappedDial(network, addr)
 	if err != nil {
-		c.cache.Set(mapEntryName, hostrecord{
-			ipaddr:      "",
-			blacklisted: true,
-			err:         err,
-			lastQuery:   queryTime,
-		})
-		c.mu.Unlock()
+		if !isDNSError(err) {
+			// host resolved, the connection failed; no reason to hold the
+			// resolver's failure against it
+			c.forget(host)
+		}
 		return nil, err
-	} else {
-		remoteipaddr := newConn.RemoteAddr().String()
-		c.cache.Set(mapEntryName, hostrecord{
-			ipaddr:      remoteipaddr,
-			blacklisted: false,
-			err:         nil,
-			lastQuery:   queryTime,
-		})
-		c.mu.Unlock()
-		return newConn, nil
-	}
-}
-
-// get returns the hostrecord associated with the passed network:address, if it exists.
-// The second return value represents whether the record exists.
-func (c *dnsCache) get(network, addr string) (hostrecord, bool) {
-	key := network + addr
-	c.mu.RLock()
-	valinterface, ok := c.cache.Get(key)
-	if valinterface == nil {
-		c.mu.RUnlock()
-		return hostrecord{}, ok
-	}
-	val := valinterface.(hostrecord)
-	c.mu.RUnlock()
-	return val, ok
+	}
+	if ip := net.ParseIP(hostOf(conn.RemoteAddr().String())); ip != nil {
+		c.set(host, &hostrecord{ips: []net.IP{ip}, expires: time.Now().Add(cacheTTL(0))})
+	}
+	return conn, nil
+}
+
+// lookup resolves host with the DNSResolver and caches the result.
+func (c *dnsCache) lookup(host string) *hostrecord {
+	dnsCacheStats.misses.Add(1)
+	ips, ttl, err := currentDNSResolver()(host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host}
+	}
+	if err != nil {
+		dnsCacheStats.failures.Add(1)
+		negativeTTL := time.Duration(Config.DNSCache.NegativeTTL) * time.Second
+		return c.set(host, &hostrecord{err: err, expires: time.Now().Add(negativeTTL)})
+	}
+	// Start one address further along than the previous resolution did
+	next := 0
+	c.mu.Lock()
+	if entry, ok := c.cache.Get(host); ok {
+		next = (entry.(*hostrecord).next + 1) % len(ips)
+	}
+	c.mu.Unlock()
+	return c.set(host, &hostrecord{ips: ips, next: next, expires: time.Now().Add(cacheTTL(ttl))})
+}
+
+// prefetch resolves host unless it is already cached, returning the error
+// resolving it failed with, if any.
+func (c *dnsCache) prefetch(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	record := c.cached(host)
+	if record == nil {
+		record = c.lookup(host)
+	}
+	return record.err
+}
+
+// addr returns the address dials to host go to, resolving it if it isn't
+// cached, or nil if it doesn't resolve.
+func (c *dnsCache) addr(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	record := c.cached(host)
+	if record == nil {
+		record = c.lookup(host)
+	}
+	if len(record.ips) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return record.ips[record.next]
+}
+
+// dialRecord dials the addresses of record suitable for network in turn,
+// starting with the one dials to the host go to, until one of them connects.
+// If that address fails to connect, the one that did takes its place.
+func (c *dnsCache) dialRecord(network, addr, port string, record *hostrecord) (net.Conn, error) {
+	c.mu.Lock()
+	start := record.next
+	c.mu.Unlock()
+
+	var err error
+	for i := range record.ips {
+		n := (start + i) % len(record.ips)
+		ip := record.ips[n]
+		is4 := ip.To4() != nil
+		if (strings.HasSuffix(network, "4") && !is4) || (strings.HasSuffix(network, "6") && is4) {
+			continue
+		}
+		target := ip.String()
+		if port != "" {
+			target = net.JoinHostPort(target, port)
+		}
+		var conn net.Conn
+		failed := err != nil
+		conn, err = c.wrappedDial(network, target)
+		if err == nil {
+			if failed {
+				c.mu.Lock()
+				record.next = n
+				c.mu.Unlock()
+			}
+			return conn, nil
+		}
+		if berr := blacklistError(err); berr != nil {
+			// Report the address that was asked for, so the fetcher can
+			// tell which host was blacklisted
+			berr.Addr = addr
+			return nil, err
+		}
+	}
+	if err == nil {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: hostOf(addr)}
+	}
+	return nil, err
+}
+
+// cached returns the unexpired record for host, or nil if there isn't one.
+func (c *dnsCache) cached(host string) *hostrecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache.Get(host)
+	if !ok {
+		return nil
+	}
+	record := entry.(*hostrecord)
+	if !time.Now().Before(record.expires) {
+		return nil
+	}
+	return record
+}
+
+func (c *dnsCache) set(host string, record *hostrecord) *hostrecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache.Set(host, record)
+	return record
+}
+
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache.Delete(host)
+}
+
+// cacheTTL bounds the TTL of a resolution by Config.DNSCache.MinTTL and
+// MaxTTL.
+func cacheTTL(ttl time.Duration) time.Duration {
+	min := time.Duration(Config.DNSCache.MinTTL) * time.Second
+	max := time.Duration(Config.DNSCache.MaxTTL) * time.Second
+	if ttl < min {
+		ttl = min
+	}
+	if ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// isDNSError returns true if err is (or wraps) a failure to resolve a host.
+func isDNSError(err error) bool {
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	_, ok := err.(*net.DNSError)
+	return ok
 }
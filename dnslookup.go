@@ -0,0 +1,181 @@
+package walker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQueryTimeout is how long we wait for each nameserver to answer
+const dnsQueryTimeout = 5 * time.Second
+
+var resolvConf struct {
+	sync.Once
+	nameservers []string
+}
+
+// systemNameservers returns the nameservers listed in /etc/resolv.conf.
+func systemNameservers() []string {
+	resolvConf.Do(func() {
+		data, err := ioutil.ReadFile("/etc/resolv.conf")
+		if err != nil {
+			log4go.Info("Failed to read nameservers, DNS TTLs will not be known: %v", err)
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				resolvConf.nameservers = append(resolvConf.nameservers, fields[1])
+			}
+		}
+	})
+	return resolvConf.nameservers
+}
+
+// lookupIPTTL is the default DNSResolver. It asks the system's nameservers
+// for the A and AAAA records of host, returning their addresses and the
+// smallest TTL of the records (including any CNAMEs leading to them). Either
+// query may fail (ex. nameservers that answer AAAA queries with SERVFAIL) as
+// long as the other one finds addresses. If the nameservers can't be queried
+// it falls back to net.LookupIP, which doesn't report TTLs, returning a TTL of
+// 0.
+func lookupIPTTL(host string) ([]net.IP, time.Duration, error) {
+	servers := systemNameservers()
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if len(servers) == 0 || err != nil {
+		return lookupIPNoTTL(host)
+	}
+
+	var ips []net.IP
+	var rcodeErr error
+	unanswered := false
+	ttl := time.Duration(-1)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, server, err := queryNameservers(servers, name, qtype)
+		if err != nil {
+			log4go.Debug("Failed to query %v records of %v: %v", qtype, host, err)
+			unanswered = true
+			continue
+		}
+		switch msg.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			rcodeErr = &net.DNSError{Err: "no such host", Name: host, Server: server}
+			continue
+		default:
+			if rcodeErr == nil {
+				rcodeErr = &net.DNSError{Err: fmt.Sprintf("server failure (%v)", msg.RCode), Name: host, Server: server}
+			}
+			continue
+		}
+
+		for _, rr := range msg.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+			case *dnsmessage.CNAMEResource:
+			default:
+				continue
+			}
+			if rrTTL := time.Duration(rr.Header.TTL) * time.Second; ttl < 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if unanswered {
+		log4go.Debug("Falling back to system resolver for %v", host)
+		return lookupIPNoTTL(host)
+	}
+	if rcodeErr != nil {
+		return nil, 0, rcodeErr
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host}
+}
+
+// lookupIPNoTTL resolves host with net.LookupIP.
+func lookupIPNoTTL(host string) ([]net.IP, time.Duration, error) {
+	ips, err := net.LookupIP(host)
+	return ips, 0, err
+}
+
+// queryNameservers asks servers in turn for the qtype records of name,
+// returning the first answer and the server that gave it.
+func queryNameservers(servers []string, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, string, error) {
+	var err error
+	for _, server := range servers {
+		var msg *dnsmessage.Message
+		msg, err = queryNameserver(server, name, qtype)
+		if err == nil {
+			return msg, server, nil
+		}
+	}
+	return nil, "", err
+}
+
+func queryNameserver(server string, name dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	// The ID is the only secret an off-path attacker has to guess to spoof
+	// an answer, so it must not be predictable
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, "53"), dnsQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !answers(&msg, id, name, qtype) {
+			// Not the answer to our query; keep waiting for it
+			continue
+		}
+		if msg.Truncated {
+			return nil, fmt.Errorf("truncated answer from %v", server)
+		}
+		return &msg, nil
+	}
+}
+
+// answers returns true if msg is a response to the query with the given ID
+// for the qtype records of name.
+func answers(msg *dnsmessage.Message, id uint16, name dnsmessage.Name, qtype dnsmessage.Type) bool {
+	if !msg.Response || msg.ID != id || len(msg.Questions) != 1 {
+		return false
+	}
+	q := msg.Questions[0]
+	return q.Type == qtype && q.Class == dnsmessage.ClassINET && strings.EqualFold(q.Name.String(), name.String())
+}
@@ -0,0 +1,132 @@
+package walker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// dnsPrefetchWorkers is how many domains are resolved at once
+const dnsPrefetchWorkers = 8
+
+// dnsPrefetchFailedRounds is how many prefetch rounds in a row a domain must
+// fail to resolve in before it is skipped, so a single failure (already
+// retried after Config.DNSCache.NegativeTTL) doesn't cost us the domain
+const dnsPrefetchFailedRounds = 2
+
+// dnsPrefetcher resolves the hosts of the domains a ClaimedDomainLister has
+// claimed into a dnsCache.
+type dnsPrefetcher struct {
+	cache  *dnsCache
+	lister ClaimedDomainLister
+	quit   chan struct{}
+
+	// hosts are the segment hosts of each claimed domain, and failures how
+	// many rounds in a row it failed to resolve in
+	hosts    map[string][]string
+	failures map[string]int
+}
+
+func newDNSPrefetcher(cache *dnsCache, lister ClaimedDomainLister) *dnsPrefetcher {
+	return &dnsPrefetcher{
+		cache:    cache,
+		lister:   lister,
+		quit:     make(chan struct{}),
+		hosts:    map[string][]string{},
+		failures: map[string]int{},
+	}
+}
+
+// start prefetches every Config.DNSPrefetch.Interval seconds until stop is
+// called.
+func (p *dnsPrefetcher) start() {
+	ticker := time.NewTicker(time.Duration(Config.DNSPrefetch.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		p.prefetch()
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *dnsPrefetcher) stop() {
+	close(p.quit)
+}
+
+// prefetch resolves the hosts of every claimed domain that aren't cached, and
+// skips domains that failed to resolve dnsPrefetchFailedRounds times.
+func (p *dnsPrefetcher) prefetch() {
+	hosts := map[string][]string{}
+	failures := map[string]int{}
+	for _, domain := range p.lister.ClaimedDomains() {
+		if h, ok := p.hosts[domain]; ok {
+			hosts[domain] = h
+		} else {
+			hosts[domain] = p.lister.SegmentHosts(domain)
+		}
+		failures[domain] = p.failures[domain]
+	}
+	p.hosts, p.failures = hosts, failures
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, dnsPrefetchWorkers)
+	for domain, domainHosts := range hosts {
+		if len(domainHosts) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(domain string, domainHosts []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := p.resolve(domainHosts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				failures[domain] = 0
+				return
+			}
+			failures[domain]++
+			log4go.Debug("Failed to resolve any host of %v (%v rounds in a row): %v", domain, failures[domain], err)
+			if failures[domain] >= dnsPrefetchFailedRounds && Config.DNSPrefetch.SkipUnresolvableFor > 0 {
+				p.lister.SkipUnresolvableDomain(domain, fmt.Sprintf("Failed to resolve: %v", err))
+			}
+		}(domain, domainHosts)
+	}
+	wg.Wait()
+}
+
+// warm resolves the hosts of domain, which was just handed to a fetcher, so
+// the fetcher finds them cached when it gets to their links.
+func (p *dnsPrefetcher) warm(domain string) {
+	if err := p.resolve(p.lister.SegmentHosts(domain)); err != nil {
+		log4go.Debug("Failed to resolve any host of %v: %v", domain, err)
+	}
+}
+
+// resolve prefetches hosts, returning nil if any of them resolved, or the
+// error the first of them failed with if none did.
+func (p *dnsPrefetcher) resolve(hosts []string) error {
+	var firstErr error
+	resolved := false
+	for _, host := range hosts {
+		if err := p.cache.prefetch(host); err == nil {
+			resolved = true
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if resolved {
+		return nil
+	}
+	return firstErr
+}
@@ -0,0 +1,234 @@
+package walker
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/iParadigms/walker/mimetools"
+)
+
+// LinkExtractor parses the links out of fetched content. Extractors are
+// registered for the media types they understand with RegisterLinkExtractor;
+// walker has built-in extractors for HTML, RSS and Atom feeds, XML sitemaps,
+// CSS and plain text.
+type LinkExtractor interface {
+	// ExtractLinks returns the links in contents, the body of the response
+	// in fr (truncated to Config.MaxHTTPContentSizeBytes). Relative links are
+	// resolved against fr.BaseURL() (the URL that served the body, after
+	// redirects) by the fetcher, which then stores them like any other parsed
+	// link (subject to robots directives, max_links_per_page, etc.).
+	ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error)
+}
+
+// registeredExtractor is a LinkExtractor with the media types it handles
+type registeredExtractor struct {
+	mediaTypes *mimetools.Matcher
+	extractor  LinkExtractor
+}
+
+var linkExtractors struct {
+	sync.RWMutex
+	registered []registeredExtractor
+}
+
+// builtinExtractors are the extractors used for media types no registered
+// extractor handles
+var builtinExtractors = []registeredExtractor{
+	mustRegisteredExtractor([]string{"text/html", "application/xhtml+xml"}, htmlLinkExtractor{}),
+	mustRegisteredExtractor([]string{"application/rss+xml", "application/atom+xml", "application/rdf+xml"}, feedLinkExtractor{}),
+	mustRegisteredExtractor([]string{"text/xml", "application/xml"}, xmlLinkExtractor{}),
+	mustRegisteredExtractor([]string{"text/css"}, cssLinkExtractor{}),
+	mustRegisteredExtractor([]string{"text/plain"}, textLinkExtractor{}),
+}
+
+func mustRegisteredExtractor(mediaTypes []string, e LinkExtractor) registeredExtractor {
+	mm, err := mimetools.NewMatcher(mediaTypes)
+	if err != nil {
+		panic(err)
+	}
+	return registeredExtractor{mediaTypes: mm, extractor: e}
+}
+
+// RegisterLinkExtractor sets e as the LinkExtractor for content of the given
+// media types in this process, which may include wildcards (ex. "text/*").
+// Extractors registered later take precedence over earlier ones, and all of
+// them over the built-in extractors.
+func RegisterLinkExtractor(mediaTypes []string, e LinkExtractor) error {
+	mm, err := mimetools.NewMatcher(mediaTypes)
+	if err != nil {
+		return err
+	}
+	linkExtractors.Lock()
+	defer linkExtractors.Unlock()
+	linkExtractors.registered = append(linkExtractors.registered, registeredExtractor{mediaTypes: mm, extractor: e})
+	return nil
+}
+
+// linkExtractorFor returns the LinkExtractor for mediaType, or nil if there
+// isn't one.
+func linkExtractorFor(mediaType string) LinkExtractor {
+	if mediaType == "" {
+		return nil
+	}
+	linkExtractors.RLock()
+	defer linkExtractors.RUnlock()
+	for i := len(linkExtractors.registered) - 1; i >= 0; i-- {
+		r := linkExtractors.registered[i]
+		if ok, _ := r.mediaTypes.Match(mediaType); ok {
+			return r.extractor
+		}
+	}
+	for _, r := range builtinExtractors {
+		if ok, _ := r.mediaTypes.Match(mediaType); ok {
+			return r.extractor
+		}
+	}
+	return nil
+}
+
+// htmlLinkExtractor extracts links from HTML tags (see getLinks)
+type htmlLinkExtractor struct{}
+
+func (htmlLinkExtractor) ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error) {
+	return getLinks(contents, fr.BaseURL())
+}
+
+// feedLinkExtractor extracts the item links, comment links and enclosures of
+// RSS and Atom feeds
+type feedLinkExtractor struct{}
+
+func (feedLinkExtractor) ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(contents))
+	decoder.Strict = false
+
+	var links []*URL
+	add := func(ref string) {
+		if u, err := ParseURL(strings.TrimSpace(ref)); err == nil && ref != "" {
+			links = append(links, u)
+		}
+	}
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return links, nil
+		} else if err != nil {
+			return links, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "link":
+			// Atom links are in href; RSS links are the element's text
+			if href, ok := xmlAttr(start, "href"); ok {
+				add(href)
+				continue
+			}
+			fallthrough
+		case "comments":
+			var text string
+			if err := decoder.DecodeElement(&text, &start); err != nil {
+				return links, err
+			}
+			add(text)
+		case "enclosure":
+			if u, ok := xmlAttr(start, "url"); ok {
+				add(u)
+			}
+		}
+	}
+}
+
+// xmlAttr returns the value of the attribute of start named name.
+func xmlAttr(start xml.StartElement, name string) (string, bool) {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// sitemapLinkExtractor extracts the links of XML sitemaps, along with their
+// sitemap hints, and the sitemaps listed in sitemap indexes
+type sitemapLinkExtractor struct{}
+
+func (sitemapLinkExtractor) ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error) {
+	links, sitemaps, err := ParseSitemap(bytes.NewReader(contents))
+	return append(links, sitemaps...), err
+}
+
+// xmlLinkExtractor extracts links from documents served with a generic XML
+// media type, which are parsed as sitemaps or feeds depending on their root
+// element
+type xmlLinkExtractor struct{}
+
+func (xmlLinkExtractor) ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(contents))
+	decoder.Strict = false
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			// Not XML we know how to read
+			return nil, nil
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			switch start.Name.Local {
+			case "urlset", "sitemapindex":
+				return sitemapLinkExtractor{}.ExtractLinks(fr, contents)
+			case "rss", "feed", "RDF":
+				return feedLinkExtractor{}.ExtractLinks(fr, contents)
+			}
+			return nil, nil
+		}
+	}
+}
+
+// cssURL matches url() references in CSS, ex. url("img/bg.png")
+var cssURL = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+
+// cssImport matches @import rules without url(), ex. @import "print.css";
+var cssImport = regexp.MustCompile(`(?i)@import\s+(?:"([^"]*)"|'([^']*)')`)
+
+// cssLinkExtractor extracts url() references and @import rules from CSS
+type cssLinkExtractor struct{}
+
+func (cssLinkExtractor) ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error) {
+	var links []*URL
+	for _, re := range []*regexp.Regexp{cssImport, cssURL} {
+		for _, m := range re.FindAllSubmatch(contents, -1) {
+			// Only one of the quoting alternatives matched
+			ref := strings.TrimSpace(string(bytes.Join(m[1:], nil)))
+			if ref == "" || strings.HasPrefix(strings.ToLower(ref), "data:") {
+				continue
+			}
+			if u, err := ParseURL(ref); err == nil {
+				links = append(links, u)
+			}
+		}
+	}
+	return links, nil
+}
+
+// textURL matches absolute http(s) links in plain text
+var textURL = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'()\[\]{}]+`)
+
+// textLinkExtractor scans plain text for absolute links
+type textLinkExtractor struct{}
+
+func (textLinkExtractor) ExtractLinks(fr *FetchResults, contents []byte) ([]*URL, error) {
+	var links []*URL
+	for _, m := range textURL.FindAll(contents, -1) {
+		// Punctuation ending a sentence is not part of the link
+		ref := strings.TrimRight(string(m), ".,;:!?")
+		if u, err := ParseURL(ref); err == nil {
+			links = append(links, u)
+		}
+	}
+	return links, nil
+}
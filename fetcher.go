@@ -2,15 +2,20 @@ package walker
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/iParadigms/walker/mimetools"
 
-	"github.com/temoto/robotstxt.go"
-
 	"mime"
 	"net"
 	"net/http"
@@ -45,6 +50,11 @@ type FetchResults struct {
 	// and this is the URL that furnished the http.Response.
 	RedirectedFrom []*URL
 
+	// Redirects holds every redirect response received, in order. Those that
+	// were followed match RedirectedFrom; if the last one was not followed
+	// (see Config.Redirects) it is also the Response.
+	Redirects []Redirect
+
 	// Response object; nil if there was a FetchError or ExcludedByRobots is
 	// true. Response.Body may not be the same object the HTTP request actually
 	// returns; the fetcher may have read in the response to parse out links,
@@ -64,6 +74,166 @@ type FetchResults struct {
 
 	// The Content-Type of the fetched page.
 	MimeType string
+
+	// Fingerprint is a hash of the page contents, for detecting whether a
+	// page changed between crawls. StructFingerprint is a hash of the page's
+	// HTML tag structure only (all text and attributes stripped), for
+	// detecting pages built from the same template. Both are only computed
+	// for HTML pages, and are 0 otherwise.
+	Fingerprint       int64
+	StructFingerprint int64
+
+	// Truncated is true if the response body was larger than
+	// Config.MaxHTTPContentSizeBytes. If Config.TruncateOversizedContent is
+	// set, only the first MaxHTTPContentSizeBytes of the body were read (and
+	// passed to the Handler); otherwise the fetch was aborted, and FetchError
+	// is ErrContentTooLarge.
+	Truncated bool
+
+	// DroppedLinks is the number of links parsed out of the page that were
+	// not stored because the page had more than Config.MaxLinksPerPage.
+	DroppedLinks int
+
+	// CanonicalURL is the link from the page's <link rel="canonical"> tag,
+	// or nil if it has none or Config.Canonicalization.HonorRelCanonical is
+	// false.
+	CanonicalURL *URL
+
+	// TimedOut is true if the fetch failed because one of
+	// Config.HTTPTimeouts was exceeded, in which case FetchError is a
+	// *TimeoutError.
+	TimedOut bool
+
+	// NoIndex and NoFollow are set if the page's <meta name="robots"> tags or
+	// X-Robots-Tag headers ask robots not to index it or not to follow its
+	// links. Handlers should not index NoIndex pages; links of NoFollow pages
+	// are not stored. Neither is set if Config.Robots.HonorPageDirectives is
+	// false.
+	NoIndex  bool
+	NoFollow bool
+}
+
+// Redirect is one redirect response received while fetching a link.
+type Redirect struct {
+	// URL that was requested and responded with the redirect
+	URL *URL
+
+	// StatusCode of the response, ex. 301
+	StatusCode int
+
+	// Location the response redirected to, resolved against URL
+	Location *URL
+
+	// Followed is false if Location was not requested because of
+	// Config.Redirects
+	Followed bool
+}
+
+// statusValue returns StatusCode for storing in the datastore, or nil (i.e.
+// null) if it is unknown.
+func (r *Redirect) statusValue() interface{} {
+	if r.StatusCode == 0 {
+		return nil
+	}
+	return r.StatusCode
+}
+
+// lastModifiedValue returns LastModified for storing in the datastore, or nil
+// (i.e. null) if it is unknown.
+func (u *URL) lastModifiedValue() interface{} {
+	if u.LastModified.IsZero() {
+		return nil
+	}
+	return u.LastModified
+}
+
+// redirectHops returns the redirects that were followed. FetchResults built
+// without Redirects (only RedirectedFrom) return hops with no StatusCode.
+func (fr *FetchResults) redirectHops() []Redirect {
+	var hops []Redirect
+	for _, r := range fr.Redirects {
+		if r.Followed {
+			hops = append(hops, r)
+		}
+	}
+	if len(hops) == len(fr.RedirectedFrom) {
+		return hops
+	}
+
+	hops = nil
+	back := fr.URL
+	for _, front := range fr.RedirectedFrom {
+		hops = append(hops, Redirect{URL: back, Location: front, Followed: true})
+		back = front
+	}
+	return hops
+}
+
+// BaseURL returns the URL that served the Response, which relative links in
+// its body are resolved against: the last of RedirectedFrom, or URL if no
+// redirects were followed.
+func (fr *FetchResults) BaseURL() *URL {
+	if n := len(fr.RedirectedFrom); n > 0 {
+		return fr.RedirectedFrom[n-1]
+	}
+	return fr.URL
+}
+
+// unfollowedRedirect returns the redirect that was not followed, which is
+// the Response, or nil if there isn't one.
+func (fr *FetchResults) unfollowedRedirect() *Redirect {
+	if n := len(fr.Redirects); n > 0 && !fr.Redirects[n-1].Followed {
+		return &fr.Redirects[n-1]
+	}
+	return nil
+}
+
+// TimeoutError is the FetchError of a fetch that took longer than one of
+// Config.HTTPTimeouts allows. Phase is the timeout that was exceeded (dial,
+// tls_handshake, response_header or body), or empty if we could not tell.
+type TimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Phase == "" {
+		return fmt.Sprintf("timeout: %v", e.Err)
+	}
+	return fmt.Sprintf("timeout (%v): %v", e.Phase, e.Err)
+}
+
+// Timeout and Temporary make TimeoutError a net.Error
+func (e *TimeoutError) Timeout() bool   { return true }
+func (e *TimeoutError) Temporary() bool { return true }
+
+// lastModified returns the Last-Modified header of this fetch's response, or
+// the zero time if there is none (or it doesn't parse).
+func (fr *FetchResults) lastModified() time.Time {
+	if fr.Response == nil {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(fr.Response.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// etag returns the entity tag to store for this fetch. A 304 (Not Modified)
+// response need not repeat the ETag, in which case the one we sent still
+// applies.
+func (fr *FetchResults) etag() string {
+	if fr.Response == nil {
+		return ""
+	}
+	if etag := fr.Response.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	if fr.Response.StatusCode == http.StatusNotModified {
+		return fr.URL.ETag
+	}
+	return ""
 }
 
 // URL is the walker URL object, which embeds *url.URL but has extra data and
@@ -72,9 +242,30 @@ type FetchResults struct {
 type URL struct {
 	*url.URL
 
-	// LastCrawled is the last time we crawled this URL, for example to use a
-	// Last-Modified header.
+	// LastCrawled is the last time we crawled (or tried to crawl) this URL.
 	LastCrawled time.Time
+
+	// LastModified is when the page was last modified as of the last time we
+	// crawled this URL successfully: the Last-Modified header the server
+	// sent, or the time of that crawl if it didn't send one. It is the zero
+	// time if we never crawled it successfully. It is sent in
+	// If-Modified-Since.
+	LastModified time.Time
+
+	// ETag is the entity tag the server sent the last time we crawled this
+	// URL successfully, or empty if it didn't send one. It is sent back in
+	// If-None-Match.
+	ETag string
+
+	// Sitemap holds what a sitemap says about this URL, or nil if it was not
+	// found in a sitemap
+	Sitemap *SitemapHints
+
+	// SourceTag and SourceAttr are the HTML tag and attribute this URL was
+	// parsed out of (ex. "img" and "srcset"), or empty if it was not parsed
+	// out of a page. StoreParsedURL stores them with the link.
+	SourceTag  string
+	SourceAttr string
 }
 
 // CreateURL creates a walker URL from values usually pulled out of the
@@ -174,6 +365,17 @@ type FetchManager struct {
 	fetchWait sync.WaitGroup
 	started   bool
 
+	// dns caches the resolutions of the transport's dials, if it is an
+	// *http.Transport
+	dns *dnsCache
+
+	// resolves the hosts of claimed domains ahead of the fetchers, if the
+	// datastore claims domains ahead of time
+	prefetcher *dnsPrefetcher
+
+	// limits requests to each server across fetchers
+	servers *ipScheduler
+
 	// used to match Content-Type headers
 	acceptFormats *mimetools.Matcher
 }
@@ -204,25 +406,23 @@ func (fm *FetchManager) Start() {
 	fm.started = true
 
 	if fm.Transport == nil {
-		// Set fm.Transport == http.DefaultTransport, but create a new one; we
-		// want to override Dial but don't want to globally override it in
-		// http.DefaultTransport.
-		fm.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
+		fm.Transport = newTransport()
 	}
 	t, ok := fm.Transport.(*http.Transport)
 	if ok {
-		t.Dial = DNSCachingDial(t.Dial, Config.MaxDNSCacheEntries)
+		blacklistDial(t)
+		fm.dns = newDNSCache(t.Dial, Config.MaxDNSCacheEntries)
+		t.Dial = fm.dns.dial
+		if lister, ok := fm.Datastore.(ClaimedDomainLister); ok && Config.DNSPrefetch.Enabled {
+			fm.prefetcher = newDNSPrefetcher(fm.dns, lister)
+			go fm.prefetcher.start()
+		}
 	} else {
-		log4go.Info("Given an non-http transport, not using dns caching")
+		log4go.Info("Given an non-http transport, not using dns caching or IP blacklisting")
 	}
 
+	fm.servers = newIPScheduler()
+
 	numFetchers := Config.NumSimultaneousFetchers
 	fm.fetchers = make([]*fetcher, numFetchers)
 	for i := 0; i < numFetchers; i++ {
@@ -237,6 +437,36 @@ func (fm *FetchManager) Start() {
 	fm.fetchWait.Wait()
 }
 
+// newTransport creates the transport a FetchManager uses when none is set. It
+// is like http.DefaultTransport, but a new one (we want to override Dial but
+// don't want to globally override it in http.DefaultTransport) with
+// Config.HTTPTimeouts applied.
+func newTransport() *http.Transport {
+	timeouts := &Config.HTTPTimeouts
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   time.Duration(timeouts.Dial) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   time.Duration(timeouts.TLSHandshake) * time.Second,
+		ResponseHeaderTimeout: time.Duration(timeouts.ResponseHeader) * time.Second,
+	}
+}
+
+// blacklistDial makes t refuse to connect to blacklisted IP addresses, if
+// Config.BlacklistPrivateIPs is set.
+func blacklistDial(t *http.Transport) {
+	if !Config.BlacklistPrivateIPs {
+		return
+	}
+	blacklist, err := newIPBlacklist()
+	if err != nil {
+		panic(fmt.Errorf("Failed to create IP blacklist: %v", err))
+	}
+	t.Dial = blacklist.wrapDial(t.Dial)
+}
+
 // Stop notifies the fetchers to finish their current requests. It blocks until
 // all fetchers have finished.
 func (fm *FetchManager) Stop() {
@@ -244,6 +474,9 @@ func (fm *FetchManager) Stop() {
 	if !fm.started {
 		panic("Cannot stop a FetchManager that has not been started")
 	}
+	if fm.prefetcher != nil {
+		fm.prefetcher.stop()
+	}
 	for _, f := range fm.fetchers {
 		go f.stop()
 	}
@@ -257,9 +490,29 @@ type fetcher struct {
 	fm         *FetchManager
 	host       string
 	httpclient *http.Client
-	robots     *robotstxt.Group
 	crawldelay time.Duration
 
+	// delay is the crawl delay of the current host before robots.txt is
+	// taken into account; it adapts to the host when Config.AutoThrottle is
+	// enabled
+	delay time.Duration
+
+	// robots holds the robots.txt rules of each origin of the current host
+	// we have fetched links from (see robotsFor)
+	robots map[string]*robotsRules
+
+	// hostFailures counts retryable fetch failures in a row on the current
+	// host (see Config.Retry.MaxHostFailures)
+	hostFailures int
+
+	// claimRefreshed is when the claim on the current host was last
+	// refreshed (see holdsClaim)
+	claimRefreshed time.Time
+
+	// releaseServer releases the request slot held on the server of the
+	// last link fetched (see waitForServer), or is nil if none is held
+	releaseServer func()
+
 	// quit signals the fetcher to stop
 	quit chan struct{}
 
@@ -284,10 +537,12 @@ func newFetcher(fm *FetchManager) *fetcher {
 func (f *fetcher) start() {
 	log4go.Debug("Starting new fetcher")
 	for {
+		f.doneWithServer()
 		if f.host != "" {
 			//TODO: ensure that this unclaim will happen... probably want the
 			//logic below in a function where the Unclaim is deferred
 			log4go.Info("Finished crawling %v, unclaiming", f.host)
+			f.storeCrawlDelay()
 			f.fm.Datastore.UnclaimHost(f.host)
 		}
 
@@ -304,40 +559,81 @@ func (f *fetcher) start() {
 			continue
 		}
 
-		if f.checkForBlacklisting(f.host) {
-			continue
+		f.hostFailures = 0
+		f.claimRefreshed = time.Now()
+		f.robots = map[string]*robotsRules{}
+		f.initCrawlDelay()
+		log4go.Info("Crawling host: %v", f.host)
+		if f.fm.prefetcher != nil {
+			go f.fm.prefetcher.warm(f.host)
 		}
 
-		f.fetchRobots(f.host)
-		f.crawldelay = time.Duration(Config.DefaultCrawlDelay) * time.Second
-		if f.robots != nil && int(f.robots.CrawlDelay) > Config.DefaultCrawlDelay {
-			f.crawldelay = f.robots.CrawlDelay
-		}
-		log4go.Info("Crawling host: %v with crawl delay %v", f.host, f.crawldelay)
-
 		for link := range f.fm.Datastore.LinksForHost(f.host) {
 			//TODO: check <-f.quit and clean up appropriately
 
+			if f.hostDown() {
+				log4go.Info("Abandoning segment for %v after %v failed fetches in a row",
+					f.host, f.hostFailures)
+				break
+			}
+			if !f.holdsClaim() {
+				log4go.Warn("Lost the claim on %v, abandoning its segment", f.host)
+				break
+			}
+
+			f.doneWithServer()
 			fr := &FetchResults{URL: link}
 
-			if f.robots != nil && !f.robots.Test(link.String()) {
+			robots := f.robotsFor(link)
+			if robots.unavailable {
+				// Leave the link uncrawled so it is dispatched again later
+				log4go.Debug("Not fetching %v, robots.txt is temporarily unavailable", link)
+				continue
+			}
+			if !robots.allowed(link) {
 				log4go.Debug("Not fetching due to robots rules: %v", link)
 				fr.ExcludedByRobots = true
 				f.fm.Datastore.StoreURLFetchResults(fr)
 				continue
 			}
 
+			f.crawldelay = f.delay
+			if delay := robots.crawlDelay(); delay > f.crawldelay {
+				f.crawldelay = delay
+			}
+
 			time.Sleep(f.crawldelay)
 
-			fr.FetchTime = time.Now()
-			fr.Response, fr.RedirectedFrom, fr.FetchError = f.fetch(link)
+			fr = f.fetchWithRetries(link)
 			if fr.FetchError != nil {
 				log4go.Debug("Error fetching %v: %v", link, fr.FetchError)
 				f.fm.Datastore.StoreURLFetchResults(fr)
+				if berr := blacklistError(fr.FetchError); berr != nil && strings.EqualFold(hostOf(berr.Addr), f.host) {
+					f.excludeHost(berr)
+					break
+				}
 				continue
 			}
 			log4go.Debug("Fetched %v -- %v", link, fr.Response.Status)
 
+			if r := fr.unfollowedRedirect(); r != nil {
+				// The redirect target is crawled as a link of its own
+				log4go.Debug("Storing unfollowed redirect target of %v: %v", link, r.Location)
+				target := *r.Location.URL
+				f.storeParsedURL(&URL{URL: &target, LastCrawled: NotYetCrawled}, fr)
+				fr.Response.Body.Close()
+				f.fm.Datastore.StoreURLFetchResults(fr)
+				continue
+			}
+
+			if fr.Response.StatusCode == http.StatusNotModified {
+				// Nothing to parse or handle; record the unchanged visit
+				log4go.Debug("Not modified since last crawl: %v", link)
+				fr.Response.Body.Close()
+				f.fm.Datastore.StoreURLFetchResults(fr)
+				continue
+			}
+
 			ctype, ctypeOk := fr.Response.Header["Content-Type"]
 			if ctypeOk && len(ctype) > 0 {
 				media_type, _, err := mime.ParseMediaType(ctype[0])
@@ -348,41 +644,107 @@ func (f *fetcher) start() {
 				}
 			}
 
-			canSearch := isHTML(fr.Response)
+			if Config.Robots.HonorPageDirectives {
+				d := headerRobotsDirectives(fr.Response.Header)
+				fr.NoIndex, fr.NoFollow = d.noIndex, d.noFollow
+			}
+
+			isPage := isHTML(fr.Response)
+			extractor := linkExtractorFor(fr.MimeType)
+			if extractor == nil && isPage {
+				extractor = htmlLinkExtractor{}
+			}
+			canSearch := extractor != nil
 			if canSearch {
-				log4go.Debug("Reading and parsing as HTML (%v)", link)
+				log4go.Debug("Reading and parsing as %v (%v)", fr.MimeType, link)
 
-				//TODO: ReadAll is inefficient. We should use a properly sized
-				//		buffer here (determined by
-				//		Config.MaxHTTPContentSizeBytes or possibly
-				//		Content-Length of the response)
 				var body []byte
-				body, fr.FetchError = ioutil.ReadAll(fr.Response.Body)
+				body, fr.FetchError = readBody(fr)
+				fr.Response.Body.Close()
 				if fr.FetchError != nil {
 					log4go.Debug("Error reading body of %v: %v", link, fr.FetchError)
 					f.fm.Datastore.StoreURLFetchResults(fr)
 					continue
 				}
+				if fr.Truncated {
+					log4go.Debug("Truncated body of %v to %v bytes", link, len(body))
+				}
 				fr.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-				outlinks, err := getLinks(body)
+				if isPage {
+					var err error
+					fr.Fingerprint = contentFingerprint(body)
+					fr.StructFingerprint, err = structureFingerprint(body)
+					if err != nil {
+						log4go.Debug("error fingerprinting HTML structure of %v: %v", link, err)
+					}
+
+					if Config.Robots.HonorPageDirectives {
+						d, err := getMetaRobots(body)
+						if err != nil {
+							log4go.Debug("error parsing meta robots for page %v: %v", link, err)
+						}
+						fr.NoIndex = fr.NoIndex || d.noIndex
+						fr.NoFollow = fr.NoFollow || d.noFollow
+					}
+				}
+
+				// Extractors may return the links they found before an
+				// error, which we still store
+				outlinks, err := extractor.ExtractLinks(fr, body)
 				if err != nil {
-					log4go.Debug("error parsing HTML for page %v: %v", link, err)
+					log4go.Debug("error extracting links from page %v: %v", link, err)
+				}
+				if fr.NoFollow {
+					log4go.Debug("Not storing links of nofollow page %v", link)
 				} else {
+					// Links are limited only once we know which ones would be
+					// stored, so duplicates and traps don't take the place of
+					// links that would be
+					var storable []*URL
+					seen := map[string]bool{}
 					for _, outlink := range outlinks {
-						outlink.MakeAbsolute(link)
-						log4go.Fine("Parsed link: %v", outlink)
-						if shouldStore(outlink) {
-							f.fm.Datastore.StoreParsedURL(outlink, fr)
+						outlink.MakeAbsolute(fr.BaseURL())
+						log4go.Fine("Parsed link: %v (from %v %v)", outlink, outlink.SourceTag, outlink.SourceAttr)
+						if f.acceptParsedURL(outlink) && !seen[outlink.String()] {
+							seen[outlink.String()] = true
+							storable = append(storable, outlink)
+						}
+					}
+					storable, fr.DroppedLinks = limitLinks(storable, link)
+					if fr.DroppedLinks > 0 {
+						log4go.Debug("Dropped %v links from page %v", fr.DroppedLinks, link)
+					}
+					for _, outlink := range storable {
+						f.fm.Datastore.StoreParsedURL(outlink, fr)
+					}
+				}
+
+				if isPage && Config.Canonicalization.HonorRelCanonical {
+					canonical, err := getCanonicalLink(body)
+					if err != nil {
+						log4go.Debug("error parsing canonical link for page %v: %v", link, err)
+					} else if canonical != nil {
+						canonical.MakeAbsolute(fr.BaseURL())
+						canonical.Canonicalize()
+						fr.CanonicalURL = canonical
+						if canonical.String() != fr.BaseURL().String() {
+							log4go.Debug("Page %v has canonical link %v", link, canonical)
+							f.storeParsedURL(canonical, fr)
 						}
 					}
 				}
 			}
 
-			// handle any doc that we searched or that is in our AcceptFormats
-			// list
+			// handle any HTML page or doc that is in our AcceptFormats list
 			canHandle := isHandleable(fr.Response, f.fm.acceptFormats)
-			if canSearch || canHandle {
+			if !canSearch && canHandle && !capBody(fr) {
+				log4go.Debug("Not handling url %v -- content too large", link)
+				fr.Response.Body.Close()
+				f.fm.Datastore.StoreURLFetchResults(fr)
+				continue
+			}
+			if isPage || canHandle {
 				f.fm.Handler.HandleResponse(fr)
 			} else {
 				ctype := strings.Join(fr.Response.Header["Content-Type"], ",")
@@ -396,37 +758,217 @@ func (f *fetcher) start() {
 	}
 }
 
-// stop signals a fetcher to stop and waits until completion.
-func (f *fetcher) stop() {
-	f.quit <- struct{}{}
-	<-f.done
+// fetchWithRetries fetches link, retrying connection errors, timeouts and
+// Config.Retry.StatusCodes responses with exponential backoff. Each failed
+// attempt that is retried is stored as a visit of its own; the results of
+// the last attempt are returned for the caller to process and store.
+func (f *fetcher) fetchWithRetries(link *URL) *FetchResults {
+	backoff := time.Duration(Config.Retry.InitialBackoff) * time.Second
+	maxBackoff := time.Duration(Config.Retry.MaxBackoff) * time.Second
+	for attempt := 1; ; attempt++ {
+		f.waitForServer(link)
+		fr := &FetchResults{URL: link}
+		fr.FetchTime = time.Now()
+		fr.Response, fr.Redirects, fr.FetchError = f.fetch(link)
+		latency := time.Since(fr.FetchTime)
+		for _, r := range fr.Redirects {
+			if r.Followed {
+				fr.RedirectedFrom = append(fr.RedirectedFrom, r.Location)
+			}
+		}
+		if fr.FetchError != nil {
+			fr.FetchError = classifyTimeout(fr.FetchError)
+			_, fr.TimedOut = fr.FetchError.(*TimeoutError)
+		} else {
+			timeBody(fr.Response, fr)
+		}
+		f.adjustCrawlDelay(fr, latency)
+		if !isRetryable(fr) {
+			f.hostFailures = 0
+			return fr
+		}
+		f.hostFailures++
+		if attempt >= Config.Retry.MaxAttempts || f.hostDown() {
+			return fr
+		}
+
+		wait := backoff
+		if fr.Response != nil {
+			if after, ok := retryAfter(fr.Response, fr.FetchTime); ok {
+				if after > maxBackoff {
+					log4go.Debug("Not retrying %v, Retry-After of %v is longer than max backoff", link, after)
+					return fr
+				}
+				if after > wait {
+					wait = after
+				}
+			}
+		}
+		if wait < f.crawldelay {
+			wait = f.crawldelay
+		}
+
+		if fr.FetchError != nil {
+			log4go.Debug("Retrying %v in %v after attempt %v failed: %v", link, wait, attempt, fr.FetchError)
+		} else {
+			log4go.Debug("Retrying %v in %v after attempt %v returned %v", link, wait, attempt, fr.Response.Status)
+			fr.Response.Body.Close()
+		}
+		f.fm.Datastore.StoreURLFetchResults(fr)
+		f.doneWithServer()
+
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
 }
 
-func (f *fetcher) fetchRobots(host string) {
-	u := &URL{
-		URL: &url.URL{
-			Scheme: "http",
-			Host:   host,
-			Path:   "robots.txt",
-		},
+// waitForServer blocks until Config.PerIPLimits allow another request to the
+// server of link, taking a request slot on it that is held until
+// doneWithServer is called. Servers are identified by the address the DNS
+// cache dials for their host, or by host name if it doesn't resolve.
+func (f *fetcher) waitForServer(link *URL) {
+	f.doneWithServer()
+	server := link.Host
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		server = host
 	}
-	res, _, err := f.fetch(u)
-	if err != nil {
-		log4go.Debug("Could not fetch %v, assuming there is no robots.txt (error: %v)", u, err)
-		f.robots = nil
-		return
+	if f.fm.dns != nil {
+		if ip := f.fm.dns.addr(server); ip != nil {
+			server = ip.String()
+		}
+	}
+	f.releaseServer = f.fm.servers.acquire(server)
+}
+
+// doneWithServer releases the request slot taken by waitForServer, if any.
+func (f *fetcher) doneWithServer() {
+	if f.releaseServer != nil {
+		f.releaseServer()
+		f.releaseServer = nil
+	}
+}
+
+// holdsClaim refreshes the claim on the current host every third of
+// Config.Dispatcher.StaleClaimTimeout (if the datastore is a ClaimRefresher),
+// so a dispatcher doesn't release it as stale while we are still crawling it.
+// It returns false if the claim has been lost, in which case another crawler
+// may be crawling the host.
+func (f *fetcher) holdsClaim() bool {
+	refresher, ok := f.fm.Datastore.(ClaimRefresher)
+	timeout := time.Duration(Config.Dispatcher.StaleClaimTimeout) * time.Second
+	if !ok || timeout <= 0 || time.Since(f.claimRefreshed) < timeout/3 {
+		return true
 	}
-	robots, err := robotstxt.FromResponse(res)
-	res.Body.Close()
+	f.claimRefreshed = time.Now()
+	return refresher.RefreshClaim(f.host)
+}
+
+// hostDown returns true if the current host has failed enough fetches in a
+// row that the rest of its segment should be abandoned.
+func (f *fetcher) hostDown() bool {
+	max := Config.Retry.MaxHostFailures
+	return max > 0 && f.hostFailures >= max
+}
+
+// isRetryable returns true if fr failed in a way that may succeed if we try
+// again: a connection error, timeout, or one of Config.Retry.StatusCodes. A
+// host that doesn't resolve (ex. NXDOMAIN) won't by the time we retry.
+func isRetryable(fr *FetchResults) bool {
+	if fr.FetchError != nil {
+		err := fr.FetchError
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		inner := err
+		if operr, ok := inner.(*net.OpError); ok {
+			inner = operr.Err
+		}
+		if dnserr, ok := inner.(*net.DNSError); ok && !dnserr.Temporary() {
+			return false
+		}
+		if _, ok := err.(net.Error); ok {
+			return true
+		}
+		return err == io.EOF || err == io.ErrUnexpectedEOF
+	}
+	for _, code := range Config.Retry.StatusCodes {
+		if fr.Response.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header of res, which is either a number
+// of seconds or an HTTP date, into how long to wait from now. ok is false if
+// the header is missing or invalid.
+func retryAfter(res *http.Response, now time.Time) (wait time.Duration, ok bool) {
+	header := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
 	if err != nil {
-		log4go.Debug("Error parsing robots.txt (%v) assuming there is no robots.txt: %v", u, err)
-		f.robots = nil
-		return
+		return 0, false
+	}
+	wait = date.Sub(now)
+	if wait < 0 {
+		wait = 0
 	}
-	f.robots = robots.FindGroup(Config.UserAgent)
+	return wait, true
 }
 
-func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
+// storeParsedURL canonicalizes a link parsed out of the page fetched in fr and
+// stores it, unless it should not be stored (see acceptParsedURL). u must be
+// absolute.
+func (f *fetcher) storeParsedURL(u *URL, fr *FetchResults) {
+	if f.acceptParsedURL(u) {
+		f.fm.Datastore.StoreParsedURL(u, fr)
+	}
+}
+
+// acceptParsedURL canonicalizes u, an absolute parsed link, and returns true
+// if it should be stored. Links that look like crawler traps are not, and are
+// recorded as such if the datastore is a TrapRecorder.
+func (f *fetcher) acceptParsedURL(u *URL) bool {
+	u.Canonicalize()
+	if !shouldStore(u) {
+		return false
+	}
+	if reason := DetectCrawlerTrap(u); reason != "" {
+		log4go.Debug("Not storing crawler trap %v: %v", u, reason)
+		if recorder, ok := f.fm.Datastore.(TrapRecorder); ok {
+			recorder.StoreTrapURL(u, reason)
+		}
+		return false
+	}
+	return true
+}
+
+// stop signals a fetcher to stop and waits until completion.
+func (f *fetcher) stop() {
+	f.quit <- struct{}{}
+	<-f.done
+}
+
+// fetch requests u, following redirects as Config.Redirects allows. It
+// returns every redirect response received along the way.
+func (f *fetcher) fetch(u *URL) (*http.Response, []Redirect, error) {
+	return f.fetchRedirecting(u, redirectNotFollowed)
+}
+
+// fetchRedirecting requests u like fetch, following the redirects notFollowed
+// gives no reason not to follow (see redirectNotFollowed).
+func (f *fetcher) fetchRedirecting(u *URL, notFollowed func(link, target *URL, hops int) string) (*http.Response, []Redirect, error) {
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to create new request object for %v): %v", u, err)
@@ -435,11 +977,37 @@ func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
 	req.Header.Set("User-Agent", Config.UserAgent)
 	req.Header.Set("Accept", strings.Join(Config.AcceptFormats, ","))
 
+	// Conditional GET so unchanged pages come back as 304 Not Modified
+	// instead of being downloaded again
+	if !u.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", u.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if u.ETag != "" {
+		req.Header.Set("If-None-Match", u.ETag)
+	}
+
 	log4go.Debug("Sending request: %+v", req)
 
-	var redirectedFrom []*URL
+	var redirects []Redirect
 	f.httpclient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		redirectedFrom = append(redirectedFrom, &URL{URL: req.URL})
+		r := Redirect{
+			URL:      &URL{URL: via[len(via)-1].URL},
+			Location: &URL{URL: req.URL},
+		}
+		if req.Response != nil {
+			r.StatusCode = req.Response.StatusCode
+		}
+		if reason := notFollowed(u, r.Location, len(via)); reason != "" {
+			log4go.Debug("Not following redirect %v -> %v: %v", r.URL, r.Location, reason)
+			redirects = append(redirects, r)
+			return http.ErrUseLastResponse
+		}
+		r.Followed = true
+		redirects = append(redirects, r)
+
+		// The conditions only apply to the link we were asked to fetch
+		req.Header.Del("If-Modified-Since")
+		req.Header.Del("If-None-Match")
 		return nil
 	}
 
@@ -447,45 +1015,270 @@ func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	return res, redirectedFrom, nil
+	return res, redirects, nil
 }
 
-// checkForBlacklisting returns true if this site is blacklisted or should be
-// blacklisted. If we detect that this site should be blacklisted, this
-// function will call the datastore appropriately.
-//
-// One example of blacklisting is detection of IP addresses that resolve to
-// localhost or other bad IP ranges.
-//
-// TODO: since different subdomains my resolve to different IPs, find a way to
-// check this for every HTTP fetch without extraneous connections or fetching
-// data we aren't going to care about
-func (f *fetcher) checkForBlacklisting(host string) bool {
-	t, ok := f.fm.Transport.(*http.Transport)
-	if !ok {
-		// We need to get the transport's Dial function in order to check the
-		// IP address
-		return false
+// redirectNotFollowed returns why the hops-th redirect of the fetch of link,
+// to target, should not be followed according to Config.Redirects, or an
+// empty string if it should be.
+func redirectNotFollowed(link, target *URL, hops int) string {
+	if hops > Config.Redirects.MaxHops {
+		return fmt.Sprintf("more than %v redirects", Config.Redirects.MaxHops)
+	}
+	if !shouldStore(target) {
+		return fmt.Sprintf("scheme %v is not accepted", target.Scheme)
+	}
+	switch Config.Redirects.Follow {
+	case "same_host":
+		if !strings.EqualFold(target.Host, link.Host) {
+			return "not the same host"
+		}
+	case "same_domain":
+		dom, err := link.ToplevelDomainPlusOne()
+		targetDom, targetErr := target.ToplevelDomainPlusOne()
+		if err != nil || targetErr != nil || !strings.EqualFold(dom, targetDom) {
+			return "not the same domain"
+		}
+	}
+	return ""
+}
+
+// excludeHost excludes the current host in the datastore (if the datastore
+// supports it), so it is not claimed again, because the domain itself
+// resolved to a blacklisted IP address. Subdomains that resolve to
+// blacklisted addresses only fail their own fetches, since different
+// subdomains may resolve to different IPs.
+func (f *fetcher) excludeHost(berr *BlacklistedAddrError) {
+	log4go.Debug("Host (%v) resolved to private IP address, blacklisting", f.host)
+	if excluder, ok := f.fm.Datastore.(DomainExcluder); ok {
+		reason := fmt.Sprintf("Resolved to private IP address %v", berr.IP)
+		if err := excluder.ExcludeDomain(f.host, reason); err != nil {
+			log4go.Error("Failed to exclude blacklisted host %v: %v", f.host, err)
+		}
+	}
+}
+
+// ErrContentTooLarge is the FetchError for responses larger than
+// Config.MaxHTTPContentSizeBytes when Config.TruncateOversizedContent is false.
+var ErrContentTooLarge = errors.New("content larger than max_http_content_size_bytes")
+
+// readBody reads the body of fr.Response into memory, reading at most
+// Config.MaxHTTPContentSizeBytes. It sets fr.Truncated if the body is larger,
+// returning the truncated body or ErrContentTooLarge as configured.
+func readBody(fr *FetchResults) ([]byte, error) {
+	limit := Config.MaxHTTPContentSizeBytes
+	size := fr.Response.ContentLength
+	if size > limit {
+		fr.Truncated = true
+		if !Config.TruncateOversizedContent {
+			return nil, ErrContentTooLarge
+		}
 	}
 
-	conn, err := t.Dial("tcp", net.JoinHostPort(host, "80"))
+	// Size the buffer from Content-Length when the server sends one, so we
+	// read the body without reallocating
+	var buf bytes.Buffer
+	if size > 0 {
+		if size > limit {
+			size = limit
+		}
+		buf.Grow(int(size) + bytes.MinRead)
+	}
+	n, err := buf.ReadFrom(io.LimitReader(fr.Response.Body, limit+1))
 	if err != nil {
-		// Don't simply blacklist because we couldn't connect; the TLD+1 may
-		// not work but subdomains may work
-		log4go.Debug("Could not connect to host (%v, %v) to check blacklisting", host, err)
-		return false
+		return nil, err
+	}
+	if n > limit {
+		fr.Truncated = true
+		if !Config.TruncateOversizedContent {
+			return nil, ErrContentTooLarge
+		}
+		return buf.Bytes()[:limit], nil
 	}
-	defer conn.Close()
+	return buf.Bytes(), nil
+}
 
-	if Config.BlacklistPrivateIPs && isPrivateAddr(conn.RemoteAddr().String()) {
-		log4go.Debug("Host (%v) resolved to private IP address, blacklisting", host)
-		return true
+// capBody limits fr.Response.Body to Config.MaxHTTPContentSizeBytes, for
+// bodies we pass to the Handler without reading them first. It returns false
+// (setting fr.FetchError) if the Content-Length is already too large and
+// Config.TruncateOversizedContent is false.
+func capBody(fr *FetchResults) bool {
+	limit := Config.MaxHTTPContentSizeBytes
+	if fr.Response.ContentLength > limit {
+		fr.Truncated = true
+		if !Config.TruncateOversizedContent {
+			fr.FetchError = ErrContentTooLarge
+			return false
+		}
 	}
-	return false
+	fr.Response.Body = &cappedBody{ReadCloser: fr.Response.Body, remaining: limit, fr: fr}
+	return true
+}
+
+// cappedBody wraps a response body, reading at most `remaining` bytes from it.
+// If the body turns out to be longer it sets fr.Truncated, then either ends
+// the body early or returns ErrContentTooLarge depending on
+// Config.TruncateOversizedContent.
+type cappedBody struct {
+	io.ReadCloser
+	remaining int64
+	fr        *FetchResults
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Check whether there is anything past the limit
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n == 0 {
+			return 0, err
+		}
+		b.fr.Truncated = true
+		if !Config.TruncateOversizedContent {
+			return 0, ErrContentTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// classifyTimeout returns err as a *TimeoutError if it is the result of a
+// request timing out, or err unchanged otherwise.
+func classifyTimeout(err error) error {
+	inner := err
+	if uerr, ok := inner.(*url.Error); ok {
+		inner = uerr.Err
+	}
+	if terr, ok := inner.(*TimeoutError); ok {
+		return terr
+	}
+
+	nerr, ok := inner.(net.Error)
+	timedOut := ok && nerr.Timeout()
+
+	// net/http does not export its timeout errors, so the TLS and response
+	// header timeouts can only be told apart by their messages
+	var phase string
+	msg := inner.Error()
+	if operr, ok := inner.(*net.OpError); ok && operr.Op == "dial" {
+		phase = "dial"
+	} else if strings.Contains(msg, "TLS handshake timeout") {
+		phase = "tls_handshake"
+		timedOut = true
+	} else if strings.Contains(msg, "timeout awaiting response headers") {
+		phase = "response_header"
+		timedOut = true
+	}
+
+	if !timedOut {
+		return err
+	}
+	return &TimeoutError{Phase: phase, Err: err}
+}
+
+// timeBody enforces Config.HTTPTimeouts.Body on res.Body, closing it if it
+// has not been read and closed in time. A read that fails because of this is
+// recorded in fr (if not nil) as a timeout.
+func timeBody(res *http.Response, fr *FetchResults) {
+	timeout := time.Duration(Config.HTTPTimeouts.Body) * time.Second
+	if timeout <= 0 {
+		return
+	}
+	b := &timedBody{ReadCloser: res.Body, fr: fr}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		b.ReadCloser.Close()
+	})
+	res.Body = b
+}
+
+// timedBody is a response body that is closed from under the reader when it
+// takes too long to read (see timeBody)
+type timedBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	expired int32
+	fr      *FetchResults
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && atomic.LoadInt32(&b.expired) == 1 {
+		err = &TimeoutError{
+			Phase: "body",
+			Err:   fmt.Errorf("body not read within %vs", Config.HTTPTimeouts.Body),
+		}
+		if b.fr != nil && b.fr.FetchError == nil {
+			b.fr.FetchError = err
+			b.fr.TimedOut = true
+		}
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// contentFingerprint hashes the full contents of a page.
+func contentFingerprint(contents []byte) int64 {
+	h := fnv.New64a()
+	h.Write(contents)
+	return int64(h.Sum64())
+}
+
+// structureFingerprint hashes the sequence of HTML tags in a page, ignoring
+// text, comments and attributes, so pages generated from the same template
+// (ex. calendar pages or session ID duplicates) get the same fingerprint.
+func structureFingerprint(contents []byte) (int64, error) {
+	utf8Reader, err := charset.NewReader(bytes.NewReader(contents), "text/html")
+	if err != nil {
+		return 0, err
+	}
+	tokenizer := html.NewTokenizer(utf8Reader)
+	h := fnv.New64a()
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return int64(h.Sum64()), nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tagName, _ := tokenizer.TagName()
+			h.Write([]byte{'<'})
+			h.Write(tagName)
+		case html.EndTagToken:
+			tagName, _ := tokenizer.TagName()
+			h.Write([]byte{'<', '/'})
+			h.Write(tagName)
+		}
+	}
+}
+
+// linkAttrs is the table of attributes holding links for each tag getLinks
+// extracts links from. meta content is only a link in
+// <meta http-equiv="refresh" content="0; url=..."> tags.
+var linkAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"form":   {"action"},
+	"frame":  {"src"},
+	"iframe": {"src"},
+	"script": {"src"},
+	"link":   {"href"},
+	"img":    {"src", "srcset"},
+	"meta":   {"content"},
 }
 
 // getLinks parses the response for links, doing it's best with bad HTML.
-func getLinks(contents []byte) ([]*URL, error) {
+// Links are made absolute, resolving relative ones against the page's <base
+// href> if it has one, or else against page. Each link's SourceTag and
+// SourceAttr are set to where it was found.
+func getLinks(contents []byte, page *URL) ([]*URL, error) {
 	utf8Reader, err := charset.NewReader(bytes.NewReader(contents), "text/html")
 	if err != nil {
 		return nil, err
@@ -493,6 +1286,7 @@ func getLinks(contents []byte) ([]*URL, error) {
 	tokenizer := html.NewTokenizer(utf8Reader)
 
 	var links []*URL
+	var base *URL
 	tags := getIncludedTags()
 
 	for {
@@ -501,32 +1295,41 @@ func getLinks(contents []byte) ([]*URL, error) {
 		case html.ErrorToken:
 			//TODO: should use tokenizer.Err() to see if this is io.EOF
 			//		(meaning success) or an actual error
-			return links, nil
-		case html.StartTagToken:
 
+			// The first <base href> applies to the whole document, even links
+			// that came before it
+			resolveBase := page
+			if base != nil {
+				base.MakeAbsolute(page)
+				resolveBase = base
+			}
+			for _, u := range links {
+				u.MakeAbsolute(resolveBase)
+			}
+			return links, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
 			tagName, hasAttrs := tokenizer.TagName()
-			if hasAttrs && tags[string(tagName)] {
-				links = parseAnchorAttrs(tokenizer, links)
+			if !hasAttrs {
+				continue
+			}
+			tag := string(tagName)
+			if tag == "base" && base == nil {
+				if href := getTagAttrs(tokenizer)["href"]; href != "" {
+					base, _ = ParseURL(strings.TrimSpace(href))
+				}
+			} else if tags[tag] {
+				links = append(links, tagLinks(tag, getTagAttrs(tokenizer))...)
 			}
 		}
 	}
-
-	return links, nil
 }
 
 // getIncludedTags gets a map of tags we should check for outlinks. It uses
-// ignored_tags in the config to exclude ones we don't want. Tags are []byte
-// types (not strings) because []byte is what the parser uses.
+// ignored_tags in the config to exclude ones we don't want.
 func getIncludedTags() map[string]bool {
-	tags := map[string]bool{
-		"a":      true,
-		"area":   true,
-		"form":   true,
-		"frame":  true,
-		"iframe": true,
-		"script": true,
-		"link":   true,
-		"img":    true,
+	tags := map[string]bool{}
+	for tag := range linkAttrs {
+		tags[tag] = true
 	}
 	for _, t := range Config.IgnoreTags {
 		delete(tags, t)
@@ -534,24 +1337,116 @@ func getIncludedTags() map[string]bool {
 	return tags
 }
 
-// parseAnchorAttrs iterates over all of the attributes in the current anchor token.
-// If a href is found, it adds the link value to the links slice.
-// Returns the new link slice.
-func parseAnchorAttrs(tokenizer *html.Tokenizer, links []*URL) []*URL {
-	//TODO: rework this to be cleaner, passing in `links` to be appended to
-	//isn't great
+// getTagAttrs reads all of the attributes of the current tag token.
+func getTagAttrs(tokenizer *html.Tokenizer) map[string]string {
+	attrs := map[string]string{}
 	for {
 		key, val, moreAttr := tokenizer.TagAttr()
-		if bytes.Compare(key, []byte("href")) == 0 {
-			u, err := ParseURL(strings.TrimSpace(string(val)))
-			if err == nil {
-				links = append(links, u)
-			}
+		if _, dup := attrs[string(key)]; !dup {
+			attrs[string(key)] = string(val)
 		}
 		if !moreAttr {
-			return links
+			return attrs
+		}
+	}
+}
+
+// tagLinks returns the links in attrs, the attributes of a tag, according to
+// linkAttrs. It returns nothing if the tag has rel="nofollow" and
+// Config.Robots.HonorPageDirectives is set.
+func tagLinks(tag string, attrs map[string]string) []*URL {
+	if Config.Robots.HonorPageDirectives && isNoFollowRel(attrs["rel"]) {
+		return nil
+	}
+	if tag == "meta" && strings.ToLower(strings.TrimSpace(attrs["http-equiv"])) != "refresh" {
+		return nil
+	}
+
+	var links []*URL
+	for _, attr := range linkAttrs[tag] {
+		val, ok := attrs[attr]
+		if !ok {
+			continue
+		}
+		var refs []string
+		switch {
+		case attr == "srcset":
+			refs = srcsetLinks(val)
+		case tag == "meta":
+			if ref := metaRefreshLink(val); ref != "" {
+				refs = []string{ref}
+			}
+		default:
+			refs = []string{strings.TrimSpace(val)}
+		}
+		for _, ref := range refs {
+			u, err := ParseURL(ref)
+			if err != nil {
+				continue
+			}
+			u.SourceTag = tag
+			u.SourceAttr = attr
+			links = append(links, u)
+		}
+	}
+	return links
+}
+
+// srcsetLinks returns the links of the image candidates in a srcset
+// attribute, ex. "small.jpg 480w, large.jpg 1080w".
+func srcsetLinks(srcset string) []string {
+	var links []string
+	for len(srcset) > 0 {
+		srcset = strings.TrimLeft(srcset, " \t\n\r\f,")
+		if srcset == "" {
+			break
+		}
+		// A candidate's link runs to the next whitespace (so it may contain
+		// commas, except at the end), followed by optional descriptors up to
+		// the next comma
+		end := strings.IndexAny(srcset, " \t\n\r\f")
+		if end < 0 {
+			end = len(srcset)
+		}
+		link := srcset[:end]
+		srcset = srcset[end:]
+		if strings.HasSuffix(link, ",") {
+			link = strings.TrimRight(link, ",")
+		} else if i := strings.Index(srcset, ","); i >= 0 {
+			srcset = srcset[i+1:]
+		} else {
+			srcset = ""
+		}
+		if link != "" {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// metaRefreshLink returns the link in the content of a
+// <meta http-equiv="refresh"> tag, ex. "5; url=/next.html", or an empty
+// string if it only reloads the page.
+func metaRefreshLink(content string) string {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return ""
+	}
+	ref := strings.TrimSpace(content[i+1:])
+	if len(ref) >= 3 && strings.EqualFold(ref[:3], "url") {
+		rest := strings.TrimSpace(ref[3:])
+		if strings.HasPrefix(rest, "=") {
+			ref = strings.TrimSpace(rest[1:])
+		}
+	}
+	if len(ref) > 0 && (ref[0] == '\'' || ref[0] == '"') {
+		if end := strings.IndexByte(ref[1:], ref[0]); end >= 0 {
+			ref = ref[1 : end+1]
+		} else {
+			ref = ref[1:]
 		}
 	}
+	return strings.TrimSpace(ref)
 }
 
 func isHTML(r *http.Response) bool {
@@ -576,6 +1471,41 @@ func isHandleable(r *http.Response, mm *mimetools.Matcher) bool {
 	return false
 }
 
+// limitLinks returns at most Config.MaxLinksPerPage of the (canonical,
+// distinct) links parsed out of page that would be stored, chosen according to Config.LinkSelection, along with the number of
+// links it dropped.
+func limitLinks(links []*URL, page *URL) ([]*URL, int) {
+	max := Config.MaxLinksPerPage
+	if max < 0 || len(links) <= max {
+		return links, 0
+	}
+	dropped := len(links) - max
+
+	switch Config.LinkSelection {
+	case "same_domain_first":
+		dom, _ := page.ToplevelDomainPlusOne()
+		var same, other []*URL
+		for _, u := range links {
+			if d, err := u.ToplevelDomainPlusOne(); err == nil && d == dom {
+				same = append(same, u)
+			} else {
+				other = append(other, u)
+			}
+		}
+		links = append(same, other...)
+	case "sample":
+		// Keep the sampled links in page order
+		keep := rand.Perm(len(links))[:max]
+		sort.Ints(keep)
+		sampled := make([]*URL, max)
+		for i, k := range keep {
+			sampled[i] = links[k]
+		}
+		return sampled, dropped
+	}
+	return links[:max], dropped
+}
+
 // shouldStore determines if a link should be stored as a parsed link.
 func shouldStore(u *URL) bool {
 	// Could also check extension here, possibly
@@ -586,41 +1516,3 @@ func shouldStore(u *URL) bool {
 	}
 	return false
 }
-
-var privateNetworks = []*net.IPNet{
-	parseCIDR("10.0.0.0/8"),
-	parseCIDR("192.168.0.0/16"),
-	parseCIDR("172.16.0.0/12"),
-	parseCIDR("127.0.0.0/8"),
-}
-
-// parseCIDR is a convenience for creating our static private IPNet ranges
-func parseCIDR(netstring string) *net.IPNet {
-	_, network, err := net.ParseCIDR(netstring)
-	if err != nil {
-		panic(err.Error())
-	}
-	return network
-}
-
-// isPrivateAddr determines whether the input address belongs to any of the
-// private networks specified in privateNetworkStrings. It returns an error
-// if the input string does not represent an IP address.
-func isPrivateAddr(addr string) bool {
-	// Remove the port number if there is one
-	if index := strings.LastIndex(addr, ":"); index != -1 {
-		addr = addr[:index]
-	}
-
-	thisIP := net.ParseIP(addr)
-	if thisIP == nil {
-		log4go.Error("Failed to parse as IP address: %v", addr)
-		return false
-	}
-	for _, network := range privateNetworks {
-		if network.Contains(thisIP) {
-			return true
-		}
-	}
-	return false
-}
@@ -15,7 +15,8 @@ type Handler interface {
 	// Handlers can do whatever they want with responses. HandleResponse will
 	// be called as long as the request successfully reached the remote server
 	// and got an HTTP code. This means there should never be a FetchError set
-	// on the FetchResults.
+	// on the FetchResults. Handlers that index pages should skip those with
+	// NoIndex set.
 	HandleResponse(res *FetchResults)
 }
 
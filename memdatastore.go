@@ -0,0 +1,384 @@
+package walker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// MemoryDatastore is a Datastore implementation that keeps all links, crawl
+// history, and domain state in process memory. It does not need a Dispatcher;
+// segments are generated on the fly when a host is claimed.
+//
+// It is intended for focused, single-process crawls and for testing. Nothing
+// is persisted, so all state is lost when the process exits.
+type MemoryDatastore struct {
+	mu sync.Mutex
+
+	// links holds every link we know about, keyed by TLD+1 and then by the
+	// link's string representation (which deduplicates them)
+	links map[string]map[string]*memLink
+
+	// domains holds the domains that are part of the crawl (the equivalent of
+	// domain_info), and domainOrder the order they were added in so claiming
+	// is deterministic
+	domains     map[string]*memDomain
+	domainOrder []string
+
+	// nextDomain is the index into domainOrder where the next ClaimNewHost
+	// call starts looking, so domains are claimed round-robin
+	nextDomain int
+
+	// robots holds cached robots.txt files by origin
+	robots map[string]*RobotsTxt
+}
+
+// memLink is a single link along with its full crawl history.
+type memLink struct {
+	url     *URL
+	getnow  bool
+	sitemap *SitemapHints
+
+	// sourceTag and sourceAttr are where the link was last parsed out of a
+	// page, see URL.SourceTag
+	sourceTag  string
+	sourceAttr string
+
+	// visits is every fetch (or attempted fetch) of this link, oldest first
+	visits []memVisit
+}
+
+// memVisit records one fetch of a link, the equivalent of a non-epoch row in
+// the links table.
+type memVisit struct {
+	time      time.Time
+	stat      int
+	err       string
+	robotEx   bool
+	redtoURL  string
+	mime      string
+	etag      string
+	lastmod   time.Time
+	fp        int64
+	structfp  int64
+	truncated bool
+	dropped   int
+}
+
+// memDomain is the in-memory equivalent of a domain_info row.
+type memDomain struct {
+	priority  int
+	claimed   bool
+	excluded  bool
+	reason    string
+	claimTime time.Time
+
+	// crawlDelay is the crawl delay learned for the domain, if
+	// hasCrawlDelay is set
+	crawlDelay    time.Duration
+	hasCrawlDelay bool
+
+	// segment is the set of links handed out for the current claim
+	segment []*URL
+}
+
+// NewMemoryDatastore creates an empty MemoryDatastore.
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{
+		links:   map[string]map[string]*memLink{},
+		domains: map[string]*memDomain{},
+		robots:  map[string]*RobotsTxt{},
+	}
+}
+
+func (ds *MemoryDatastore) ClaimNewHost() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// Claim the highest priority domain that has links to crawl, round-robin
+	// among domains of equal priority. Segments are only generated for the
+	// domains we try to claim, so pick the domain first and move on to the
+	// next only if it has nothing to crawl.
+	seen := map[int]bool{}
+	var priorities []int
+	for _, d := range ds.domains {
+		if !d.claimed && !d.excluded && !seen[d.priority] {
+			seen[d.priority] = true
+			priorities = append(priorities, d.priority)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	for _, priority := range priorities {
+		for i := 0; i < len(ds.domainOrder); i++ {
+			index := (ds.nextDomain + i) % len(ds.domainOrder)
+			domain := ds.domainOrder[index]
+			d := ds.domains[domain]
+			if d.claimed || d.excluded || d.priority != priority {
+				continue
+			}
+
+			segment := ds.generateSegment(domain)
+			if len(segment) == 0 {
+				continue
+			}
+			d.claimed = true
+			d.claimTime = time.Now()
+			d.segment = segment
+			ds.nextDomain = (index + 1) % len(ds.domainOrder)
+			log4go.Debug("Claimed %v with %v links", domain, len(d.segment))
+			return domain
+		}
+	}
+	return ""
+}
+
+func (ds *MemoryDatastore) UnclaimHost(host string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	d, ok := ds.domains[host]
+	if !ok {
+		log4go.Error("Tried to unclaim unknown host %v", host)
+		return
+	}
+	d.claimed = false
+	d.segment = nil
+}
+
+func (ds *MemoryDatastore) LinksForHost(domain string) <-chan *URL {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	var links []*URL
+	if d, ok := ds.domains[domain]; ok {
+		links = d.segment
+	}
+	log4go.Info("Returning %v links to crawl domain %v", len(links), domain)
+
+	linkchan := make(chan *URL, len(links))
+	for _, l := range links {
+		linkchan <- l
+	}
+	close(linkchan)
+	return linkchan
+}
+
+func (ds *MemoryDatastore) StoreURLFetchResults(fr *FetchResults) {
+	url := fr.URL
+	if len(fr.RedirectedFrom) > 0 {
+		// Remember that the actual response of this FetchResults is from
+		// the url at the end of RedirectedFrom
+		url = fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
+	}
+
+	v := memVisit{
+		time:      fr.FetchTime,
+		robotEx:   fr.ExcludedByRobots,
+		mime:      fr.MimeType,
+		etag:      fr.etag(),
+		lastmod:   fr.lastModified(),
+		fp:        fr.Fingerprint,
+		structfp:  fr.StructFingerprint,
+		truncated: fr.Truncated,
+		dropped:   fr.DroppedLinks,
+	}
+	if fr.FetchError != nil {
+		v.err = fr.FetchError.Error()
+	}
+	if fr.Response != nil {
+		v.stat = fr.Response.StatusCode
+	}
+	if r := fr.unfollowedRedirect(); r != nil {
+		v.redtoURL = r.Location.String()
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	l, err := ds.getOrAddLink(url)
+	if err != nil {
+		log4go.Error("StoreURLFetchResults not storing %v: %v", url, err)
+		return
+	}
+	l.visits = append(l.visits, v)
+	l.getnow = false
+
+	// As in CassandraDatastore, fr.URL redirected to RedirectedFrom[0], and
+	// after that RedirectedFrom[n] redirected to RedirectedFrom[n+1]
+	for _, hop := range fr.redirectHops() {
+		l, err := ds.getOrAddLink(hop.URL)
+		if err != nil {
+			log4go.Error("StoreURLFetchResults not storing info for url that redirected (%v): %v", hop.URL, err)
+		} else {
+			l.visits = append(l.visits, memVisit{time: fr.FetchTime, stat: hop.StatusCode, redtoURL: hop.Location.String()})
+			l.getnow = false
+		}
+	}
+}
+
+func (ds *MemoryDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
+	if !u.IsAbs() {
+		log4go.Warn("Link should not have made it to StoreParsedURL: %v", u)
+		return
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	l, err := ds.getOrAddLink(u)
+	if err != nil {
+		log4go.Debug("StoreParsedURL not storing %v: %v", u, err)
+		return
+	}
+	if u.Sitemap != nil {
+		l.sitemap = u.Sitemap
+	}
+	if u.SourceTag != "" {
+		l.sourceTag, l.sourceAttr = u.SourceTag, u.SourceAttr
+	}
+
+	if Config.AddNewDomains {
+		dom, err := u.ToplevelDomainPlusOne()
+		if err == nil {
+			ds.addDomainIfNew(dom)
+		}
+	}
+	log4go.Fine("Inserted parsed URL: %v", u)
+}
+
+func (ds *MemoryDatastore) CachedRobots(origin string) *RobotsTxt {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.robots[origin]
+}
+
+func (ds *MemoryDatastore) StoreRobots(r *RobotsTxt) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.robots[r.Origin] = r
+}
+
+func (ds *MemoryDatastore) CachedCrawlDelay(domain string) (time.Duration, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	d, ok := ds.domains[domain]
+	if !ok || !d.hasCrawlDelay {
+		return 0, false
+	}
+	return d.crawlDelay, true
+}
+
+func (ds *MemoryDatastore) StoreCrawlDelay(domain string, delay time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if d, ok := ds.domains[domain]; ok {
+		d.crawlDelay = delay
+		d.hasCrawlDelay = true
+	}
+}
+
+func (ds *MemoryDatastore) SetDomainPriority(domain string, priority int) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	d, ok := ds.domains[domain]
+	if !ok {
+		return fmt.Errorf("%v is not part of the crawl", domain)
+	}
+	d.priority = priority
+	return nil
+}
+
+func (ds *MemoryDatastore) ExcludeDomain(domain string, reason string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.addDomainIfNew(domain)
+	d := ds.domains[domain]
+	d.excluded = true
+	d.reason = reason
+	log4go.Info("Excluded %v from the crawl: %v", domain, reason)
+	return nil
+}
+
+func (ds *MemoryDatastore) IncludeDomain(domain string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	d, ok := ds.domains[domain]
+	if !ok {
+		return fmt.Errorf("%v is not part of the crawl", domain)
+	}
+	d.excluded = false
+	d.reason = ""
+	log4go.Info("Included %v in the crawl", domain)
+	return nil
+}
+
+// getOrAddLink returns the memLink for u, creating it as a not-yet-crawled
+// link if we have not seen it before. Callers must hold ds.mu.
+func (ds *MemoryDatastore) getOrAddLink(u *URL) (*memLink, error) {
+	dom, err := u.ToplevelDomainPlusOne()
+	if err != nil {
+		return nil, err
+	}
+
+	domLinks, ok := ds.links[dom]
+	if !ok {
+		domLinks = map[string]*memLink{}
+		ds.links[dom] = domLinks
+	}
+
+	key := u.String()
+	l, ok := domLinks[key]
+	if !ok {
+		stored, err := ParseURL(key)
+		if err != nil {
+			return nil, err
+		}
+		l = &memLink{url: stored}
+		domLinks[key] = l
+	}
+	return l, nil
+}
+
+// addDomainIfNew expects a toplevel domain, no subdomain. Callers must hold
+// ds.mu.
+func (ds *MemoryDatastore) addDomainIfNew(domain string) {
+	if _, ok := ds.domains[domain]; ok {
+		return
+	}
+	ds.domains[domain] = &memDomain{}
+	ds.domainOrder = append(ds.domainOrder, domain)
+}
+
+// generateSegment selects the links to crawl for this domain, using the same
+// rules as CassandraDispatcher. Callers must hold ds.mu.
+func (ds *MemoryDatastore) generateSegment(domain string) []*URL {
+	sb := newSegmentBuilder(domain)
+	for _, l := range ds.links[domain] {
+		u := &URL{URL: l.url.URL, LastCrawled: NotYetCrawled}
+		c := cell{crawl_time: NotYetCrawled}
+		for i, v := range l.visits {
+			next := cell{crawl_time: v.time, etag: v.etag, last_modified: v.lastmod, stat: v.stat,
+				fp: v.fp, structfp: v.structfp}
+			next.resetHistory()
+			if i > 0 {
+				next.follow(&c)
+			}
+			c = next
+			u.LastCrawled = v.time
+		}
+		u.LastModified, u.ETag = c.ifModifiedSince, c.ifNoneMatch
+		c.getnow = l.getnow
+		if l.sitemap != nil {
+			c.lastmod, c.changefreq, c.priority = l.sitemap.LastMod, l.sitemap.ChangeFreq, l.sitemap.Priority
+		}
+		sb.pushURL(u, &c)
+	}
+	return sb.segment()
+}
@@ -0,0 +1,93 @@
+package walker
+
+import (
+	"sync"
+	"time"
+)
+
+// ipScheduler limits the requests all fetchers of a FetchManager make to each
+// server, identified by IP address, so a server hosting many of the domains
+// being crawled isn't hit by every fetcher at once (see Config.PerIPLimits).
+type ipScheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	servers map[string]*serverSlots
+
+	// lastSweep is when idle servers were last dropped from servers
+	lastSweep time.Time
+}
+
+// serverSlots is the state of requests to one server
+type serverSlots struct {
+	// active counts requests in progress or waiting for their start time
+	active int
+
+	// tickets counts the requests that have asked for a slot and served
+	// those that got one; slots are handed out in ticket order
+	tickets int
+	served  int
+
+	// next is the earliest time the next request may start
+	next time.Time
+}
+
+func newIPScheduler() *ipScheduler {
+	s := &ipScheduler{servers: map[string]*serverSlots{}, lastSweep: time.Now()}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire blocks until a request to server is allowed by
+// Config.PerIPLimits, returning the func to call when the request is done.
+// Requests start in the order acquire was called.
+func (s *ipScheduler) acquire(server string) (release func()) {
+	max := Config.PerIPLimits.MaxConcurrent
+	delay := time.Duration(Config.PerIPLimits.Delay) * time.Second
+
+	s.mu.Lock()
+	s.sweep()
+	slots, ok := s.servers[server]
+	if !ok {
+		slots = &serverSlots{}
+		s.servers[server] = slots
+	}
+	ticket := slots.tickets
+	slots.tickets++
+	for ticket != slots.served || (max > 0 && slots.active >= max) {
+		s.cond.Wait()
+	}
+	slots.served++
+	slots.active++
+
+	start := time.Now()
+	if slots.next.After(start) {
+		start = slots.next
+	}
+	slots.next = start.Add(delay)
+	s.mu.Unlock()
+	// The next ticket may be able to go too
+	s.cond.Broadcast()
+
+	time.Sleep(start.Sub(time.Now()))
+	return func() {
+		s.mu.Lock()
+		slots.active--
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+// sweep drops servers nothing is waiting on and whose delay has passed, at
+// most once a minute. s.mu must be held.
+func (s *ipScheduler) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for server, slots := range s.servers {
+		if slots.active == 0 && slots.tickets == slots.served && !slots.next.After(now) {
+			delete(s.servers, server)
+		}
+	}
+}
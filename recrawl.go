@@ -0,0 +1,127 @@
+package walker
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LinkHistory summarizes the crawl history of an already crawled link, as
+// read from its rows in the links table. It is what a RecrawlPolicy bases its
+// decisions on.
+type LinkHistory struct {
+	URL *URL
+
+	// FirstCrawled and LastCrawled are the times of the first and most recent
+	// crawls of this link
+	FirstCrawled time.Time
+	LastCrawled  time.Time
+
+	// Observations is the number of crawls we could compare with the crawl
+	// before (i.e. both had a content fingerprint, or the later one was a
+	// 304), and Changes how many of those found the content had changed
+	Observations int
+	Changes      int
+
+	// Sitemap holds what the link's sitemap says about it, or nil if it
+	// wasn't found in a sitemap
+	Sitemap *SitemapHints
+}
+
+// RecrawlPolicy decides which already crawled links are refreshed first when
+// dispatching a segment. The dispatcher refreshes the links with the highest
+// score, up to the refresh_percentage of the segment.
+type RecrawlPolicy interface {
+	// RefreshScore returns how urgently the link should be refreshed at time
+	// now; links with higher scores are refreshed first.
+	RefreshScore(h *LinkHistory, now time.Time) float64
+}
+
+// AgeRecrawlPolicy refreshes the links crawled longest ago first, ignoring
+// how often they change.
+type AgeRecrawlPolicy struct{}
+
+func (p AgeRecrawlPolicy) RefreshScore(h *LinkHistory, now time.Time) float64 {
+	return now.Sub(h.LastCrawled).Seconds()
+}
+
+// ChangeRateRecrawlPolicy estimates how often each link changes from its crawl
+// history, and refreshes the links most likely to have changed since their
+// last crawl first. This means a news section that changes on every crawl is
+// refreshed far more often than an archive page that never does.
+//
+// Changes are modeled as a Poisson process with rate
+//
+//  (Changes + 1) / (LastCrawled - FirstCrawled + DefaultChangeInterval)
+//
+// so a link with little history is assumed to change about once per
+// DefaultChangeInterval. The score is the probability the link has changed
+// since it was last crawled. Note we can only see whether a link changed
+// between crawls, not how many times, so links that change much faster than
+// we crawl them are underestimated (they still score close to 1).
+//
+// Sitemap hints are used when a link has them: a lastmod after the last crawl
+// means the link certainly changed, and changefreq replaces
+// DefaultChangeInterval as the assumed change interval. The score is then
+// scaled by the sitemap priority relative to the default of 0.5, so sites can
+// have their most important pages refreshed first.
+type ChangeRateRecrawlPolicy struct {
+	DefaultChangeInterval time.Duration
+}
+
+func (p ChangeRateRecrawlPolicy) RefreshScore(h *LinkHistory, now time.Time) float64 {
+	interval := p.DefaultChangeInterval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	weight := sitemapPriority(h.Sitemap) / 0.5
+	if h.Sitemap != nil {
+		if h.Sitemap.LastMod.After(h.LastCrawled) {
+			return weight
+		}
+		if ci := h.Sitemap.ChangeInterval(); ci > 0 {
+			interval = ci
+		}
+	}
+
+	span := h.LastCrawled.Sub(h.FirstCrawled) + interval
+	rate := float64(h.Changes+1) / span.Seconds()
+	age := now.Sub(h.LastCrawled).Seconds()
+	if age < 0 {
+		age = 0
+	}
+	return weight * (1 - math.Exp(-rate*age))
+}
+
+var recrawlPolicy struct {
+	sync.RWMutex
+	policy RecrawlPolicy
+}
+
+// SetRecrawlPolicy sets the RecrawlPolicy used by dispatchers in this process,
+// overriding the `dispatcher.recrawl_policy` config setting. Passing nil goes
+// back to using the config setting.
+func SetRecrawlPolicy(p RecrawlPolicy) {
+	recrawlPolicy.Lock()
+	defer recrawlPolicy.Unlock()
+	recrawlPolicy.policy = p
+}
+
+// currentRecrawlPolicy returns the policy set with SetRecrawlPolicy, or the
+// one selected in the config.
+func currentRecrawlPolicy() RecrawlPolicy {
+	recrawlPolicy.RLock()
+	defer recrawlPolicy.RUnlock()
+	if recrawlPolicy.policy != nil {
+		return recrawlPolicy.policy
+	}
+
+	switch Config.Dispatcher.RecrawlPolicy {
+	case "age":
+		return AgeRecrawlPolicy{}
+	default:
+		return ChangeRateRecrawlPolicy{
+			DefaultChangeInterval: time.Duration(Config.Dispatcher.DefaultChangeInterval) * time.Second,
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package walker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/temoto/robotstxt.go"
+)
+
+// robotsMaxSizeBytes is how much of a robots.txt file we read; the rest is
+// ignored (crawlers are required to parse at least the first 500 KiB)
+const robotsMaxSizeBytes = 500 * 1024
+
+// robotsMaxRedirects is how many redirects we follow fetching a robots.txt,
+// wherever they lead (RFC 9309 asks crawlers to follow at least five)
+const robotsMaxRedirects = 5
+
+// RobotsTxt is the result of fetching the robots.txt file of one origin, as
+// cached by a RobotsCache.
+type RobotsTxt struct {
+	// Origin is the scheme, host and (non-default) port the file applies to,
+	// ex. https://sub.test.com:8080
+	Origin string
+
+	// StatusCode of the robots.txt response, or 0 if the server could not be
+	// reached
+	StatusCode int
+
+	// Body of a 2XX response, at most robotsMaxSizeBytes long
+	Body []byte
+
+	FetchTime time.Time
+
+	// Expires is when the file should be fetched again
+	Expires time.Time
+}
+
+// robotsOrigin returns the origin whose robots.txt applies to u. Each scheme,
+// host and port combination has its own robots.txt, so
+// http://test.com/page1.html, https://test.com/page1.html and
+// http://sub.test.com/page1.html may all be subject to different rules.
+func robotsOrigin(u *URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if h, port, err := net.SplitHostPort(host); err == nil && port == defaultPorts[scheme] {
+		if strings.Contains(h, ":") {
+			h = "[" + h + "]"
+		}
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+// robotsRules are the rules from one origin's robots.txt that apply to us.
+type robotsRules struct {
+	// unavailable is true if the server failed (with a 5XX) to serve
+	// robots.txt or could not be reached, in which case nothing may be
+	// fetched from the origin until robots.txt is fetched again
+	unavailable bool
+
+	// group is the part of the file that applies to our user agent, or nil if
+	// there is no robots.txt
+	group *robotstxt.Group
+
+	// sitemaps are the links of any Sitemap directives
+	sitemaps []string
+}
+
+// newRobotsRules interprets a fetched robots.txt. A 4XX response (or a
+// redirect that wasn't followed) means there is no robots.txt, so everything
+// is allowed, while a 5XX or an unreachable server means the origin is
+// temporarily unavailable.
+func newRobotsRules(r *RobotsTxt) *robotsRules {
+	switch {
+	case r.StatusCode >= 200 && r.StatusCode < 300:
+		data, err := robotstxt.FromBytes(r.Body)
+		if err != nil {
+			log4go.Debug("Error parsing robots.txt for %v, assuming there is no robots.txt: %v", r.Origin, err)
+			return &robotsRules{}
+		}
+		return &robotsRules{group: data.FindGroup(Config.UserAgent), sitemaps: data.Sitemaps}
+	case r.StatusCode == 0 || r.StatusCode >= 500:
+		return &robotsRules{unavailable: true}
+	default:
+		return &robotsRules{}
+	}
+}
+
+// allowed returns true if u may be fetched.
+func (r *robotsRules) allowed(u *URL) bool {
+	if r.unavailable {
+		return false
+	}
+	return r.group == nil || r.group.Test(u.RequestURI())
+}
+
+// crawlDelay returns the Crawl-delay set for us, or 0 if there isn't one.
+func (r *robotsRules) crawlDelay() time.Duration {
+	if r.group == nil {
+		return 0
+	}
+	return r.group.CrawlDelay
+}
+
+// robotsFor returns the robots.txt rules that apply to link. They come from
+// the rules already loaded for the current host, the datastore (if it is a
+// RobotsCache and the cached file has not expired), or else by fetching
+// robots.txt from link's origin.
+func (f *fetcher) robotsFor(link *URL) *robotsRules {
+	origin := robotsOrigin(link)
+	if rules, ok := f.robots[origin]; ok {
+		return rules
+	}
+
+	cache, canCache := f.fm.Datastore.(RobotsCache)
+	var r *RobotsTxt
+	if canCache {
+		r = cache.CachedRobots(origin)
+		if r != nil && !time.Now().Before(r.Expires) {
+			r = nil
+		}
+	}
+	fetched := r == nil
+	if fetched {
+		r = f.fetchRobots(origin)
+		if r == nil {
+			// The fetches of the origin's links fail the same way, and are
+			// stored as such
+			rules := &robotsRules{}
+			f.robots[origin] = rules
+			return rules
+		}
+		if canCache {
+			cache.StoreRobots(r)
+		}
+	}
+
+	rules := newRobotsRules(r)
+	f.robots[origin] = rules
+
+	// Sitemaps are read along with robots.txt, so (with a RobotsCache) they
+	// are read again once it expires
+	if fetched && !rules.unavailable && Config.Sitemaps.Discover {
+		f.readSitemaps(origin, rules)
+	}
+	return rules
+}
+
+// fetchRobots fetches the robots.txt for origin, setting when it expires from
+// Config.Robots. It returns nil if the origin can't be fetched from at all
+// (ex. it doesn't resolve or resolves to a blacklisted address), as opposed to
+// being unreachable for now.
+func (f *fetcher) fetchRobots(origin string) *RobotsTxt {
+	r := &RobotsTxt{Origin: origin, FetchTime: time.Now()}
+	expiry := time.Duration(Config.Robots.CacheTime) * time.Second
+	errExpiry := time.Duration(Config.Robots.ErrorCacheTime) * time.Second
+	r.Expires = r.FetchTime.Add(errExpiry)
+
+	u, err := ParseURL(origin + "/robots.txt")
+	if err != nil {
+		log4go.Error("Failed to build robots.txt link for %v: %v", origin, err)
+		return r
+	}
+	f.waitForServer(u)
+	defer f.doneWithServer()
+	res, _, err := f.fetchRedirecting(u, robotsRedirectNotFollowed)
+	if err != nil {
+		if !isRetryable(&FetchResults{FetchError: err}) {
+			log4go.Debug("Could not fetch %v, assuming there is no robots.txt (error: %v)", u, err)
+			return nil
+		}
+		log4go.Debug("Could not reach %v, treating %v as unavailable (error: %v)", u, origin, err)
+		return r
+	}
+	timeBody(res, nil)
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		r.Body, err = ioutil.ReadAll(io.LimitReader(res.Body, robotsMaxSizeBytes))
+		if err != nil {
+			log4go.Debug("Error reading %v, treating %v as unavailable: %v", u, origin, err)
+			r.Body = nil
+			return r
+		}
+	}
+	r.StatusCode = res.StatusCode
+	if res.StatusCode < 500 {
+		r.Expires = r.FetchTime.Add(expiry)
+	}
+	return r
+}
+
+// robotsRedirectNotFollowed is the redirect policy for fetching robots.txt,
+// see redirectNotFollowed. Config.Redirects doesn't apply, since robots.txt
+// commonly redirects to another host (ex. test.com to www.test.com).
+func robotsRedirectNotFollowed(link, target *URL, hops int) string {
+	if hops > robotsMaxRedirects {
+		return fmt.Sprintf("more than %v redirects", robotsMaxRedirects)
+	}
+	if !shouldStore(target) {
+		return fmt.Sprintf("scheme %v is not accepted", target.Scheme)
+	}
+	return ""
+}
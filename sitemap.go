@@ -0,0 +1,270 @@
+package walker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// sitemapMaxSizeBytes is the most of a (decompressed) sitemap we read; the
+// sitemap protocol limits sitemaps to 50MB
+const sitemapMaxSizeBytes = 50 * 1024 * 1024
+
+// SitemapHints holds what a sitemap says about a link. The dispatcher uses
+// them to pick which links go in a segment (see ChangeRateRecrawlPolicy).
+type SitemapHints struct {
+	// LastMod is when the page last changed, or the zero time if the sitemap
+	// doesn't say
+	LastMod time.Time
+
+	// ChangeFreq is one of always, hourly, daily, weekly, monthly, yearly or
+	// never, or empty if the sitemap doesn't say
+	ChangeFreq string
+
+	// Priority of this page relative to others on the site, from 0.0 to 1.0.
+	// It is 0.5 if the sitemap doesn't say; a priority of 0 is treated the
+	// same way.
+	Priority float64
+}
+
+// changeFreqIntervals are the change intervals ChangeFreq values stand for
+var changeFreqIntervals = map[string]time.Duration{
+	"always":  time.Minute,
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+	"never":   10 * 365 * 24 * time.Hour,
+}
+
+// ChangeInterval returns how often ChangeFreq says the page changes, or 0 if
+// it isn't set.
+func (h *SitemapHints) ChangeInterval() time.Duration {
+	return changeFreqIntervals[h.ChangeFreq]
+}
+
+// columnValues returns LastMod and ChangeFreq for storing in the datastore,
+// with nil (i.e. null) for the ones that are unset.
+func (h *SitemapHints) columnValues() (lastmod, changefreq interface{}) {
+	if !h.LastMod.IsZero() {
+		lastmod = h.LastMod
+	}
+	if h.ChangeFreq != "" {
+		changefreq = h.ChangeFreq
+	}
+	return
+}
+
+// sitemapPriority returns the effective priority of a link with the given
+// hints, which may be nil for links not found in a sitemap.
+func sitemapPriority(h *SitemapHints) float64 {
+	if h == nil || h.Priority <= 0 {
+		return 0.5
+	}
+	return h.Priority
+}
+
+// sitemapLastModFormats are the W3C datetime formats allowed in lastmod
+var sitemapLastModFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// sitemapEntry is a <url> in a urlset or a <sitemap> in a sitemap index
+type sitemapEntry struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// hints returns the SitemapHints for e, ignoring any values that don't
+// parse.
+func (e *sitemapEntry) hints() *SitemapHints {
+	h := &SitemapHints{Priority: 0.5}
+	lastmod := strings.TrimSpace(e.LastMod)
+	for _, format := range sitemapLastModFormats {
+		if t, err := time.Parse(format, lastmod); err == nil {
+			h.LastMod = t
+			break
+		}
+	}
+	changefreq := strings.ToLower(strings.TrimSpace(e.ChangeFreq))
+	if _, ok := changeFreqIntervals[changefreq]; ok {
+		h.ChangeFreq = changefreq
+	}
+	if p, err := strconv.ParseFloat(strings.TrimSpace(e.Priority), 64); err == nil && p >= 0 && p <= 1 {
+		h.Priority = p
+	}
+	return h
+}
+
+// ParseSitemap reads an XML sitemap, which may be gzipped. It returns the
+// links of a urlset (with their Sitemap hints set) and the sitemaps listed in
+// a sitemap index. Entries that don't parse as URLs are skipped. If the
+// sitemap turns out to be malformed partway through, the entries read up to
+// that point are returned along with the error.
+func ParseSitemap(r io.Reader) (links []*URL, sitemaps []*URL, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read gzipped sitemap: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	decoder := xml.NewDecoder(io.LimitReader(r, sitemapMaxSizeBytes))
+	decoder.Strict = false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return links, sitemaps, nil
+		} else if err != nil {
+			return links, sitemaps, fmt.Errorf("failed to parse sitemap: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+
+		var e sitemapEntry
+		if err := decoder.DecodeElement(&e, &start); err != nil {
+			return links, sitemaps, fmt.Errorf("failed to parse sitemap: %v", err)
+		}
+		u, err := ParseURL(strings.TrimSpace(e.Loc))
+		if err != nil || !u.IsAbs() {
+			log4go.Fine("Skipping sitemap entry with bad loc %q", e.Loc)
+			continue
+		}
+		if start.Name.Local == "sitemap" {
+			sitemaps = append(sitemaps, u)
+		} else {
+			u.Sitemap = e.hints()
+			links = append(links, u)
+		}
+	}
+}
+
+// walkSitemaps fetches the sitemaps in start with get, following any sitemap
+// indexes, and calls store with every link found and the sitemap it was
+// found in. At most Config.Sitemaps.MaxSitemaps sitemaps are fetched, and
+// each only once.
+func walkSitemaps(start []*URL, get func(u *URL) (*http.Response, error), store func(u, sitemap *URL)) {
+	queue := start
+	seen := map[string]bool{}
+	fetched := 0
+	for len(queue) > 0 && fetched < Config.Sitemaps.MaxSitemaps {
+		sitemap := queue[0]
+		queue = queue[1:]
+		if seen[sitemap.String()] {
+			continue
+		}
+		seen[sitemap.String()] = true
+		fetched++
+
+		res, err := get(sitemap)
+		if err != nil {
+			log4go.Debug("Error fetching sitemap %v: %v", sitemap, err)
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			log4go.Debug("Not reading sitemap %v -- %v", sitemap, res.Status)
+			res.Body.Close()
+			continue
+		}
+		links, children, err := ParseSitemap(res.Body)
+		res.Body.Close()
+		if err != nil {
+			log4go.Debug("Error reading sitemap %v: %v", sitemap, err)
+		}
+		log4go.Debug("Found %v links and %v sitemaps in sitemap %v", len(links), len(children), sitemap)
+
+		for _, u := range links {
+			store(u, sitemap)
+		}
+		queue = append(queue, children...)
+	}
+}
+
+// SitemapLinks fetches the sitemap at u, following it if it is a sitemap
+// index, and returns every link it lists. It is meant for seeding; the
+// fetcher reads the sitemaps it discovers on its own. The sitemaps are fetched
+// with the same timeouts and IP blacklist as the fetcher uses.
+func SitemapLinks(u *URL) []*URL {
+	t := newTransport()
+	blacklistDial(t)
+	client := &http.Client{Transport: t}
+	get := func(u *URL) (*http.Response, error) {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", Config.UserAgent)
+		res, err := client.Do(req)
+		if err == nil {
+			timeBody(res, nil)
+		}
+		return res, err
+	}
+	var links []*URL
+	walkSitemaps([]*URL{u}, get, func(u, sitemap *URL) {
+		links = append(links, u)
+	})
+	return links
+}
+
+// readSitemaps reads the sitemaps of origin: the ones listed in its
+// robots.txt (rules), plus /sitemap.xml unless robots.txt disallows it. The
+// links found are stored like links parsed out of a page.
+func (f *fetcher) readSitemaps(origin string, rules *robotsRules) {
+	var start []*URL
+	listed := append([]string{}, rules.sitemaps...)
+	for _, s := range append(listed, origin+"/sitemap.xml") {
+		u, err := ParseURL(strings.TrimSpace(s))
+		if err != nil || !u.IsAbs() {
+			log4go.Debug("Skipping bad sitemap link %q for %v", s, origin)
+			continue
+		}
+		if robotsOrigin(u) == origin && !rules.allowed(u) {
+			log4go.Debug("Not fetching sitemap due to robots rules: %v", u)
+			continue
+		}
+		start = append(start, u)
+	}
+
+	delay := time.Duration(Config.DefaultCrawlDelay) * time.Second
+	if rules.crawlDelay() > delay {
+		delay = rules.crawlDelay()
+	}
+	// Each sitemap holds its server's request slot until the next one is
+	// fetched
+	defer f.doneWithServer()
+	get := func(u *URL) (*http.Response, error) {
+		time.Sleep(delay)
+		f.waitForServer(u)
+		res, _, err := f.fetch(u)
+		if err == nil {
+			timeBody(res, nil)
+		}
+		return res, err
+	}
+	walkSitemaps(start, get, func(u, sitemap *URL) {
+		f.storeParsedURL(u, &FetchResults{URL: sitemap})
+	})
+}
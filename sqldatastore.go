@@ -0,0 +1,753 @@
+package walker
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"code.google.com/p/log4go"
+
+	"github.com/dropbox/godropbox/container/lrucache"
+	"github.com/gocql/gocql"
+)
+
+// SQLDatastore is a Datastore implementation backed by a database/sql
+// database, intended for smaller deployments that don't want to run
+// Cassandra. It mirrors the links, segments and domain_info tables of the
+// Cassandra schema (see GetSQLSchema) and is paired with SQLDispatcher.
+//
+// SQLite ("sqlite3") and PostgreSQL ("postgres") are supported. The binary
+// running walker must import the database/sql driver for the configured
+// sql.driver (the walker binary imports both).
+type SQLDatastore struct {
+	db *sql.DB
+
+	// A group of domains that this datastore has already claimed, ready to
+	// pass to a fetcher
+	domains []string
+	mu      sync.Mutex
+
+	// A cache for domains we've already verified exist in domain_info
+	addedDomains *lrucache.LRUCache
+
+	// This is a unique token for the entire crawler, stored in
+	// domain_info.claim_tok for the domains it claims.
+	crawlerToken string
+}
+
+// OpenSQLDatabase opens the database configured in the sql section of the
+// walker config.
+func OpenSQLDatabase() (*sql.DB, error) {
+	db, err := sql.Open(Config.SQL.Driver, Config.SQL.DataSource)
+	if err != nil {
+		return nil, err
+	}
+	if Config.SQL.Driver == "sqlite3" {
+		// SQLite only allows a single writer; sharing one connection keeps us
+		// from running into "database is locked" errors
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+func NewSQLDatastore() (*SQLDatastore, error) {
+	ds := &SQLDatastore{}
+	var err error
+	ds.db, err = OpenSQLDatabase()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create sql datastore: %v", err)
+	}
+	ds.addedDomains = lrucache.New(Config.AddedDomainsCacheSize)
+
+	u, err := gocql.RandomUUID()
+	if err != nil {
+		return ds, err
+	}
+	ds.crawlerToken = u.String()
+
+	return ds, nil
+}
+
+// Close closes the underlying database.
+func (ds *SQLDatastore) Close() {
+	ds.db.Close()
+}
+
+// sqlRebind converts a query using `?` placeholders to the placeholder style
+// of the configured driver.
+func sqlRebind(query string) string {
+	if Config.SQL.Driver != "postgres" {
+		return query
+	}
+	var b bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (ds *SQLDatastore) ClaimNewHost() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if len(ds.domains) == 0 {
+		if err := ds.claimDomains(); err != nil {
+			log4go.Error("Failed to claim new domains: %v", err)
+		}
+	}
+
+	// Domains may have waited in ds.domains for a while, so make sure our
+	// claim on the one we hand out is still valid (and fresh, so it is not
+	// considered stale while we crawl it)
+	for len(ds.domains) > 0 {
+		// Pop the last element and return it
+		lastIndex := len(ds.domains) - 1
+		domain := ds.domains[lastIndex]
+		ds.domains = ds.domains[:lastIndex]
+		if ds.RefreshClaim(domain) {
+			return domain
+		}
+	}
+	return ""
+}
+
+// RefreshClaim updates claim_time on a domain this crawler has claimed,
+// returning false if the claim has since been released or taken by another
+// crawler (for example because a dispatcher found it stale).
+func (ds *SQLDatastore) RefreshClaim(domain string) bool {
+	res, err := ds.db.Exec(sqlRebind(`UPDATE domain_info SET claim_time = ?
+									WHERE dom = ? AND claim_tok = ?`),
+		time.Now(), domain, ds.crawlerToken)
+	if err != nil {
+		log4go.Error("Failed to refresh claim on %v: %v", domain, err)
+		return false
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		log4go.Warn("Lost claim on %v", domain)
+		return false
+	}
+	return true
+}
+
+// claimDomains claims a batch of dispatched domains in a single transaction
+// and adds them to ds.domains. A domain is only claimed if its claim_tok is
+// still empty when we update it, so two crawlers can never claim the same
+// domain.
+func (ds *SQLDatastore) claimDomains() error {
+	start := time.Now()
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(sqlRebind(`SELECT dom FROM domain_info
+										WHERE claim_tok = ? AND dispatched = ? AND excluded = ?
+										AND (dns_retry_time IS NULL OR dns_retry_time <= ?)
+										ORDER BY priority DESC LIMIT ?`), "", true, false, start, claimBatchSize)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var candidates []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		candidates = append(candidates, domain)
+	}
+	if err := rows.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	log4go.Debug("ClaimNewHost selected %v new domains in %v", len(candidates), time.Since(start))
+
+	var claimed []string
+	for _, domain := range candidates {
+		res, err := tx.Exec(sqlRebind(`UPDATE domain_info SET claim_tok = ?, claim_time = ?
+										WHERE dom = ? AND claim_tok = ?`),
+			ds.crawlerToken, time.Now(), domain, "")
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to claim segment %v: %v", domain, err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			log4go.Debug("Domain %v was claimed by another crawler", domain)
+			continue
+		}
+		claimed = append(claimed, domain)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log4go.Debug("Claimed %v domains with token %v", len(claimed), ds.crawlerToken)
+
+	// Domains are popped off the end, so store them lowest priority first
+	for i := len(claimed) - 1; i >= 0; i-- {
+		ds.domains = append(ds.domains, claimed[i])
+	}
+	return nil
+}
+
+func (ds *SQLDatastore) ClaimedDomains() []string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return append([]string{}, ds.domains...)
+}
+
+func (ds *SQLDatastore) SegmentHosts(domain string) []string {
+	rows, err := ds.db.Query(sqlRebind(`SELECT DISTINCT subdom FROM segments WHERE dom = ?`), domain)
+	if err != nil {
+		log4go.Error("Failed to read segment hosts of %v: %v", domain, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var hosts []string
+	for rows.Next() {
+		var subdom string
+		if err := rows.Scan(&subdom); err != nil {
+			log4go.Error("Failed to read segment hosts of %v: %v", domain, err)
+			return hosts
+		}
+		hosts = append(hosts, segmentHost(domain, subdom))
+	}
+	return hosts
+}
+
+func (ds *SQLDatastore) SkipUnresolvableDomain(domain string, reason string) {
+	if !ds.dropClaimedDomain(domain) {
+		// Already handed to a fetcher
+		return
+	}
+	retry := time.Now().Add(time.Duration(Config.DNSPrefetch.SkipUnresolvableFor) * time.Second)
+	_, err := ds.db.Exec(sqlRebind(`UPDATE domain_info SET claim_tok = ?, dns_retry_time = ?, dns_error = ?
+									WHERE dom = ? AND claim_tok = ?`),
+		"", retry, reason, domain, ds.crawlerToken)
+	if err != nil {
+		log4go.Error("Failed to skip unresolvable domain %v: %v", domain, err)
+		return
+	}
+	log4go.Info("Skipping %v until %v: %v", domain, retry, reason)
+}
+
+// dropClaimedDomain removes domain from the domains waiting to be handed out
+// by ClaimNewHost, returning false if it wasn't there.
+func (ds *SQLDatastore) dropClaimedDomain(domain string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for i, d := range ds.domains {
+		if d == domain {
+			ds.domains = append(ds.domains[:i], ds.domains[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// UnclaimHost only touches host if we still hold its claim; if it was released
+// as stale another crawler may be working on it.
+func (ds *SQLDatastore) UnclaimHost(host string) {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		log4go.Error("Failed to unclaim %v: %v", host, err)
+		return
+	}
+
+	_, err = tx.Exec(sqlRebind(`DELETE FROM segments WHERE dom = ?
+								AND EXISTS (SELECT 1 FROM domain_info WHERE dom = ? AND claim_tok = ?)`),
+		host, host, ds.crawlerToken)
+	if err != nil {
+		log4go.Error("Failed deleting segment links for %v: %v", host, err)
+		tx.Rollback()
+		return
+	}
+
+	res, err := tx.Exec(sqlRebind(`UPDATE domain_info SET dispatched = ?, claim_tok = ?
+								WHERE dom = ? AND claim_tok = ?`), false, "", host, ds.crawlerToken)
+	if err != nil {
+		log4go.Error("Failed unclaiming %v in domain_info: %v", host, err)
+		tx.Rollback()
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		log4go.Warn("Not unclaiming %v since we no longer hold the claim", host)
+		tx.Rollback()
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log4go.Error("Failed to unclaim %v: %v", host, err)
+	}
+}
+
+func (ds *SQLDatastore) LinksForHost(domain string) <-chan *URL {
+	links, err := ds.getSegmentLinks(domain)
+	if err != nil {
+		log4go.Error("Failed to grab segment for %v: %v", domain, err)
+		c := make(chan *URL)
+		close(c)
+		return c
+	}
+	log4go.Info("Returning %v links to crawl domain %v", len(links), domain)
+
+	linkchan := make(chan *URL, len(links))
+	for _, l := range links {
+		linkchan <- l
+	}
+	close(linkchan)
+	return linkchan
+}
+
+func (ds *SQLDatastore) StoreURLFetchResults(fr *FetchResults) {
+	url := fr.URL
+	if len(fr.RedirectedFrom) > 0 {
+		// Remember that the actual response of this FetchResults is from
+		// the url at the end of RedirectedFrom
+		url = fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
+	}
+
+	dom, subdom, err := url.TLDPlusOneAndSubdomain()
+	if err != nil {
+		log4go.Error("StoreURLFetchResults not storing %v: %v", url, err)
+		return
+	}
+
+	inserts := []dbfield{
+		dbfield{"dom", dom},
+		dbfield{"subdom", subdom},
+		dbfield{"path", url.RequestURI()},
+		dbfield{"proto", url.Scheme},
+		dbfield{"time", fr.FetchTime},
+	}
+
+	if fr.FetchError != nil {
+		inserts = append(inserts, dbfield{"err", fr.FetchError.Error()})
+	}
+
+	if fr.ExcludedByRobots {
+		inserts = append(inserts, dbfield{"robot_ex", true})
+	}
+
+	if fr.Response != nil {
+		inserts = append(inserts, dbfield{"stat", fr.Response.StatusCode})
+	}
+
+	if r := fr.unfollowedRedirect(); r != nil {
+		inserts = append(inserts, dbfield{"redto_url", r.Location.String()})
+	}
+
+	if fr.MimeType != "" {
+		inserts = append(inserts, dbfield{"mime", fr.MimeType})
+	}
+
+	if etag := fr.etag(); etag != "" {
+		inserts = append(inserts, dbfield{"etag", etag})
+	}
+
+	if lastmod := fr.lastModified(); !lastmod.IsZero() {
+		inserts = append(inserts, dbfield{"last_modified", lastmod})
+	}
+
+	if fr.Fingerprint != 0 {
+		inserts = append(inserts, dbfield{"fp", fr.Fingerprint})
+		inserts = append(inserts, dbfield{"structfp", fr.StructFingerprint})
+	}
+
+	if fr.Truncated {
+		inserts = append(inserts, dbfield{"truncated", true})
+	}
+
+	if fr.DroppedLinks > 0 {
+		inserts = append(inserts, dbfield{"dropped_links", fr.DroppedLinks})
+	}
+
+	// Put the values together and run the query
+	names := []string{}
+	values := []interface{}{}
+	placeholders := []string{}
+	for _, f := range inserts {
+		names = append(names, f.name)
+		values = append(values, f.value)
+		placeholders = append(placeholders, "?")
+	}
+	_, err = ds.db.Exec(sqlRebind(
+		fmt.Sprintf(`INSERT INTO links (%s) VALUES (%s) ON CONFLICT DO NOTHING`,
+			strings.Join(names, ", "), strings.Join(placeholders, ", "))),
+		values...,
+	)
+	if err != nil {
+		log4go.Error("Failed storing fetch results: %v", err)
+		return
+	}
+
+	// As in CassandraDatastore, fr.URL redirected to RedirectedFrom[0], and
+	// after that RedirectedFrom[n] redirected to RedirectedFrom[n+1]
+	for _, hop := range fr.redirectHops() {
+		back, front := hop.URL, hop.Location
+		dom, subdom, err = back.TLDPlusOneAndSubdomain()
+		if err != nil {
+			log4go.Error("StoreURLFetchResults not storing info for url that redirected (%v): %v", back, err)
+			continue
+		}
+		_, err := ds.db.Exec(sqlRebind(`INSERT INTO links (dom, subdom, path, proto, time, stat, redto_url)
+										VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+			dom, subdom, back.RequestURI(), back.Scheme, fr.FetchTime, hop.statusValue(), front.String())
+		if err != nil {
+			log4go.Error("Failed to insert redirected link %s -> %s: %v", back.String(), front.String(), err)
+		}
+	}
+}
+
+func (ds *SQLDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
+	if !u.IsAbs() {
+		log4go.Warn("Link should not have made it to StoreParsedURL: %v", u)
+		return
+	}
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		log4go.Debug("StoreParsedURL not storing %v: %v", u, err)
+		return
+	}
+
+	if Config.AddNewDomains {
+		ds.addDomainIfNew(dom)
+	}
+	log4go.Fine("Inserting parsed URL: %v", u)
+
+	// The primary key on links deduplicates parsed links for us; links found
+	// in a sitemap update their sitemap hints, and links parsed out of a page
+	// the tag and attribute they were last found in
+	if u.Sitemap != nil {
+		lastmod, changefreq := u.Sitemap.columnValues()
+		_, err = ds.db.Exec(sqlRebind(`INSERT INTO links (dom, subdom, path, proto, time,
+											sitemap_lastmod, sitemap_changefreq, sitemap_priority)
+										VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+										ON CONFLICT (dom, subdom, path, proto, time) DO UPDATE SET
+											sitemap_lastmod = excluded.sitemap_lastmod,
+											sitemap_changefreq = excluded.sitemap_changefreq,
+											sitemap_priority = excluded.sitemap_priority`),
+			dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled, lastmod, changefreq, u.Sitemap.Priority)
+	} else if u.SourceTag != "" {
+		_, err = ds.db.Exec(sqlRebind(`INSERT INTO links (dom, subdom, path, proto, time, source_tag, source_attr)
+										VALUES (?, ?, ?, ?, ?, ?, ?)
+										ON CONFLICT (dom, subdom, path, proto, time) DO UPDATE SET
+											source_tag = excluded.source_tag,
+											source_attr = excluded.source_attr`),
+			dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled, u.SourceTag, u.SourceAttr)
+	} else {
+		_, err = ds.db.Exec(sqlRebind(`INSERT INTO links (dom, subdom, path, proto, time)
+										VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+			dom, subdom, u.RequestURI(), u.Scheme, NotYetCrawled)
+	}
+	if err != nil {
+		log4go.Error("failed inserting parsed url (%v) to sql datastore, %v", u, err)
+	}
+}
+
+func (ds *SQLDatastore) StoreTrapURL(u *URL, reason string) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		log4go.Debug("StoreTrapURL not storing %v: %v", u, err)
+		return
+	}
+	_, err = ds.db.Exec(sqlRebind(`INSERT INTO trap_links (dom, subdom, path, proto, reason, time)
+									VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+		dom, subdom, u.RequestURI(), u.Scheme, reason, time.Now())
+	if err != nil {
+		log4go.Error("failed inserting trap url (%v) to sql datastore, %v", u, err)
+	}
+}
+
+func (ds *SQLDatastore) CachedRobots(origin string) *RobotsTxt {
+	r := &RobotsTxt{Origin: origin}
+	err := ds.db.QueryRow(sqlRebind(`SELECT stat, body, time, expires FROM robots WHERE origin = ?`),
+		origin).Scan(&r.StatusCode, &r.Body, &r.FetchTime, &r.Expires)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log4go.Error("Failed to read cached robots.txt for %v: %v", origin, err)
+		return nil
+	}
+	return r
+}
+
+func (ds *SQLDatastore) StoreRobots(r *RobotsTxt) {
+	_, err := ds.db.Exec(sqlRebind(`INSERT INTO robots (origin, stat, body, time, expires)
+									VALUES (?, ?, ?, ?, ?)
+									ON CONFLICT (origin) DO UPDATE SET stat = excluded.stat,
+										body = excluded.body, time = excluded.time, expires = excluded.expires`),
+		r.Origin, r.StatusCode, r.Body, r.FetchTime, r.Expires)
+	if err != nil {
+		log4go.Error("failed inserting robots.txt for %v to sql datastore, %v", r.Origin, err)
+	}
+}
+
+func (ds *SQLDatastore) CachedCrawlDelay(domain string) (time.Duration, bool) {
+	var ms sql.NullInt64
+	err := ds.db.QueryRow(sqlRebind(`SELECT crawl_delay_ms FROM domain_info WHERE dom = ?`), domain).Scan(&ms)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log4go.Error("Failed to read crawl delay of %v: %v", domain, err)
+		}
+		return 0, false
+	}
+	if !ms.Valid {
+		return 0, false
+	}
+	return time.Duration(ms.Int64) * time.Millisecond, true
+}
+
+func (ds *SQLDatastore) StoreCrawlDelay(domain string, delay time.Duration) {
+	_, err := ds.db.Exec(sqlRebind(`UPDATE domain_info SET crawl_delay_ms = ? WHERE dom = ?`),
+		int64(delay/time.Millisecond), domain)
+	if err != nil {
+		log4go.Error("Failed to store crawl delay of %v: %v", domain, err)
+	}
+}
+
+func (ds *SQLDatastore) SetDomainPriority(domain string, priority int) error {
+	res, err := ds.db.Exec(sqlRebind(`UPDATE domain_info SET priority = ? WHERE dom = ?`),
+		priority, domain)
+	if err != nil {
+		return fmt.Errorf("failed to set priority of %v: %v", domain, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%v is not part of the crawl", domain)
+	}
+	return nil
+}
+
+func (ds *SQLDatastore) ExcludeDomain(domain string, reason string) error {
+	_, err := ds.db.Exec(sqlRebind(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority)
+									VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+		domain, "", false, 0)
+	if err != nil {
+		return fmt.Errorf("failed to add excluded domain %v: %v", domain, err)
+	}
+	_, err = ds.db.Exec(sqlRebind(`UPDATE domain_info SET excluded = ?, exclude_reason = ?
+									WHERE dom = ?`), true, reason, domain)
+	if err != nil {
+		return fmt.Errorf("failed to exclude %v: %v", domain, err)
+	}
+	ds.addedDomains.Set(domain, nil)
+	log4go.Info("Excluded %v from the crawl: %v", domain, reason)
+	return nil
+}
+
+func (ds *SQLDatastore) IncludeDomain(domain string) error {
+	res, err := ds.db.Exec(sqlRebind(`UPDATE domain_info SET excluded = ?, exclude_reason = NULL
+										WHERE dom = ?`), false, domain)
+	if err != nil {
+		return fmt.Errorf("failed to include %v: %v", domain, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%v is not part of the crawl", domain)
+	}
+	log4go.Info("Included %v in the crawl", domain)
+	return nil
+}
+
+// addDomainIfNew expects a toplevel domain, no subdomain
+func (ds *SQLDatastore) addDomainIfNew(domain string) {
+	_, ok := ds.addedDomains.Get(domain)
+	if ok {
+		return
+	}
+	_, err := ds.db.Exec(sqlRebind(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority)
+									VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+		domain, "", false, 0)
+	if err != nil {
+		log4go.Error("Failed to add new domain %v: %v", domain, err)
+		return
+	}
+	ds.addedDomains.Set(domain, nil)
+}
+
+func (ds *SQLDatastore) getSegmentLinks(domain string) (links []*URL, err error) {
+	rows, err := ds.db.Query(sqlRebind(`SELECT dom, subdom, path, proto, time, last_modified, etag
+										FROM segments WHERE dom = ?`), domain)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	var dbdomain, subdomain, path, protocol string
+	var etag sql.NullString
+	var crawl_time time.Time
+	var last_modified *time.Time
+	for rows.Next() {
+		if err = rows.Scan(&dbdomain, &subdomain, &path, &protocol, &crawl_time, &last_modified, &etag); err != nil {
+			return
+		}
+		u, e := CreateURL(dbdomain, subdomain, path, protocol, crawl_time)
+		if e != nil {
+			log4go.Error("Error adding link (%v) to crawl: %v", u, e)
+		} else {
+			if last_modified != nil {
+				u.LastModified = *last_modified
+			}
+			u.ETag = etag.String
+			log4go.Debug("Adding link: %v", u)
+			links = append(links, u)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// CreateSQLSchema creates the walker tables in the configured sql database.
+// The tables must not already exist.
+func CreateSQLSchema() error {
+	db, err := OpenSQLDatabase()
+	if err != nil {
+		return fmt.Errorf("Could not connect to create sql schema: %v", err)
+	}
+	defer db.Close()
+
+	schema, err := GetSQLSchema()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range strings.Split(schema, ";") {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			continue
+		}
+		if _, err = db.Exec(q); err != nil {
+			return fmt.Errorf("Failed to create schema: %v\nStatement:\n%v", err, q)
+		}
+	}
+	return nil
+}
+
+// GetSQLSchema returns the DDL for the walker tables, using column types
+// appropriate for the configured sql driver.
+func GetSQLSchema() (string, error) {
+	t, err := template.New("sqlschema").Parse(sqlSchemaTemplate)
+	if err != nil {
+		return "", fmt.Errorf("Failure parsing the SQL schema template: %v", err)
+	}
+
+	// SQLite drivers only recognize plain `timestamp` columns as times, while
+	// PostgreSQL needs the time zone to round trip times correctly
+	timestampType := "timestamp"
+	blobType := "blob"
+	if Config.SQL.Driver == "postgres" {
+		timestampType = "timestamp with time zone"
+		blobType = "bytea"
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, map[string]string{"Timestamp": timestampType, "Blob": blobType})
+	if err != nil {
+		return "", fmt.Errorf("Failure executing the SQL schema template: %v", err)
+	}
+	return b.String(), nil
+}
+
+const sqlSchemaTemplate string = `-- The SQL schema file for walker
+--
+-- These tables mirror the Cassandra schema (see 'walker schema' with the
+-- cassandra datastore for full descriptions of each column).
+
+-- links stores all links we have parsed out of pages and crawled. Links that
+-- have not been crawled yet have 'time' set to the epoch. Every fetch adds
+-- another row, so this table holds the crawl history of every link.
+CREATE TABLE links (
+	dom text NOT NULL,
+	subdom text NOT NULL,
+	path text NOT NULL,
+	proto text NOT NULL,
+	time {{.Timestamp}} NOT NULL,
+	stat integer,
+	err text,
+	robot_ex boolean,
+	redto_url text,
+	getnow boolean,
+	mime text,
+	etag text,
+	last_modified {{.Timestamp}},
+	fp bigint,
+	structfp bigint,
+	truncated boolean,
+	dropped_links integer,
+	sitemap_lastmod {{.Timestamp}},
+	sitemap_changefreq text,
+	sitemap_priority double precision,
+	source_tag text,
+	source_attr text,
+	PRIMARY KEY (dom, subdom, path, proto, time)
+);
+
+-- segments contains groups of links that are ready to be crawled for a given
+-- domain.
+CREATE TABLE segments (
+	dom text NOT NULL,
+	subdom text NOT NULL,
+	path text NOT NULL,
+	proto text NOT NULL,
+	time {{.Timestamp}},
+	last_modified {{.Timestamp}},
+	etag text,
+	PRIMARY KEY (dom, subdom, path, proto)
+);
+
+-- trap_links contains parsed links that were not stored in links because they
+-- looked like crawler traps, along with the reason why.
+CREATE TABLE trap_links (
+	dom text NOT NULL,
+	subdom text NOT NULL,
+	path text NOT NULL,
+	proto text NOT NULL,
+	reason text,
+	time {{.Timestamp}},
+	PRIMARY KEY (dom, subdom, path, proto)
+);
+
+-- robots caches the robots.txt file of each origin (ex.
+-- https://sub.test.com:8080). body is only set for 2XX responses.
+CREATE TABLE robots (
+	origin text PRIMARY KEY,
+	stat integer,
+	body {{.Blob}},
+	time {{.Timestamp}},
+	expires {{.Timestamp}}
+);
+
+-- domain_info holds every domain in the crawl. claim_tok is the token of the
+-- crawler that claimed this domain, or the empty string if unclaimed. Excluded
+-- domains are never dispatched or claimed.
+CREATE TABLE domain_info (
+	dom text NOT NULL,
+	priority integer NOT NULL DEFAULT 0,
+	claim_tok text NOT NULL DEFAULT '',
+	claim_time {{.Timestamp}},
+	dispatched boolean NOT NULL DEFAULT false,
+	excluded boolean NOT NULL DEFAULT false,
+	exclude_reason text,
+	dns_retry_time {{.Timestamp}},
+	dns_error text,
+	crawl_delay_ms integer,
+	PRIMARY KEY (dom)
+);
+CREATE INDEX domain_info_claim_idx ON domain_info (claim_tok, dispatched);
+CREATE INDEX domain_info_priority_idx ON domain_info (priority);`
@@ -0,0 +1,294 @@
+package walker
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// SQLDispatcher is the Dispatcher paired with SQLDatastore. It generates
+// segments the same way CassandraDispatcher does, for domains that are
+// neither claimed nor dispatched.
+type SQLDispatcher struct {
+	db *sql.DB
+
+	domains chan string   // For passing domains to generate to worker goroutines
+	quit    chan struct{} // Channel to close to stop the dispatcher (used by `Stop()`)
+
+	// synchronizes when all generator routines have exited, so
+	// `StopDispatcher()` can wait until all processing is done
+	finishWG sync.WaitGroup
+
+	// synchronizes generators that are currently working, so we can wait for
+	// them to finish before we start a new domain iteration
+	generatingWG sync.WaitGroup
+}
+
+func (d *SQLDispatcher) StartDispatcher() error {
+	log4go.Info("Starting SQLDispatcher")
+	var err error
+	d.db, err = OpenSQLDatabase()
+	if err != nil {
+		return fmt.Errorf("Failed to open sql database: %v", err)
+	}
+
+	d.quit = make(chan struct{})
+	d.domains = make(chan string)
+
+	for i := 0; i < Config.Dispatcher.NumConcurrentDomains; i++ {
+		d.finishWG.Add(1)
+		go func() {
+			d.generateRoutine()
+			d.finishWG.Done()
+		}()
+	}
+
+	if Config.Dispatcher.StaleClaimTimeout > 0 {
+		d.finishWG.Add(1)
+		go func() {
+			runClaimReaper(d.quit, d.releaseStaleClaims)
+			d.finishWG.Done()
+		}()
+	}
+
+	d.domainIterator()
+	return nil
+}
+
+func (d *SQLDispatcher) StopDispatcher() error {
+	log4go.Info("Stopping SQLDispatcher")
+	close(d.quit)
+	d.finishWG.Wait()
+	d.db.Close()
+	return nil
+}
+
+func (d *SQLDispatcher) domainIterator() {
+	for {
+		log4go.Debug("Starting new domain iteration")
+
+		// Read the domains in before handing them out; with SQLite there is
+		// only one connection, which the generators need
+		domains, err := d.undispatchedDomains()
+		if err != nil {
+			log4go.Error("Error iterating domains from domain_info: %v", err)
+		}
+
+		for _, domain := range domains {
+			select {
+			case <-d.quit:
+				log4go.Debug("Domain iterator signaled to stop")
+				close(d.domains)
+				return
+			case d.domains <- domain:
+			}
+		}
+
+		// Check for exit here as well in case domain_info is empty
+		select {
+		case <-d.quit:
+			log4go.Debug("Domain iterator signaled to stop")
+			close(d.domains)
+			return
+		default:
+		}
+
+		//TODO: configure this sleep time
+		time.Sleep(time.Second)
+		d.generatingWG.Wait()
+	}
+}
+
+// undispatchedDomains returns all domains that are neither claimed,
+// dispatched, nor excluded, highest priority first.
+func (d *SQLDispatcher) undispatchedDomains() ([]string, error) {
+	rows, err := d.db.Query(sqlRebind(`SELECT dom FROM domain_info
+										WHERE claim_tok = ? AND dispatched = ? AND excluded = ?
+										ORDER BY priority DESC`), "", false, false)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return domains, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// releaseStaleClaims unclaims any domain that has been claimed for longer than
+// Config.Dispatcher.StaleClaimTimeout (see CassandraDispatcher).
+func (d *SQLDispatcher) releaseStaleClaims() {
+	timeout := time.Duration(Config.Dispatcher.StaleClaimTimeout) * time.Second
+	cutoff := time.Now().Add(-timeout)
+
+	rows, err := d.db.Query(sqlRebind(`SELECT dom, claim_tok, claim_time FROM domain_info
+										WHERE claim_tok <> ? AND claim_time < ?`), "", cutoff)
+	if err != nil {
+		log4go.Error("Failed to select stale claims: %v", err)
+		return
+	}
+	type claim struct {
+		domain, tok string
+		time        time.Time
+	}
+	var stale []claim
+	for rows.Next() {
+		var c claim
+		if err := rows.Scan(&c.domain, &c.tok, &c.time); err != nil {
+			log4go.Error("Failed to read stale claim: %v", err)
+			continue
+		}
+		stale = append(stale, c)
+	}
+	rows.Close()
+
+	for _, c := range stale {
+		// Only release the claim if nobody has claimed or refreshed it since
+		// we read it
+		res, err := d.db.Exec(sqlRebind(`UPDATE domain_info SET claim_tok = ?
+										WHERE dom = ? AND claim_tok = ? AND claim_time < ?`),
+			"", c.domain, c.tok, cutoff)
+		if err != nil {
+			log4go.Error("Failed to release stale claim on %v: %v", c.domain, err)
+		} else if n, _ := res.RowsAffected(); n == 1 {
+			log4go.Info("Released stale claim on %v held by %v since %v", c.domain, c.tok, c.time)
+		} else {
+			log4go.Debug("Stale claim on %v changed before it could be released", c.domain)
+		}
+	}
+}
+
+func (d *SQLDispatcher) generateRoutine() {
+	for domain := range d.domains {
+		d.generatingWG.Add(1)
+		if err := d.generateSegment(domain); err != nil {
+			log4go.Error("error generating segment for %v: %v", domain, err)
+		}
+		d.generatingWG.Done()
+	}
+	log4go.Debug("Finishing generateRoutine")
+}
+
+// generateSegment reads links in for this domain, generates a segment for it,
+// and marks the domain dispatched (assuming a segment is ready to go)
+func (d *SQLDispatcher) generateSegment(domain string) error {
+	log4go.Info("Generating a crawl segment for %v", domain)
+
+	sb := newSegmentBuilder(domain)
+
+	// Ordering by time means the last row of each series sharing subdom,
+	// path and proto is the most recent crawl of that link (see the
+	// CassandraDispatcher for the same trick)
+	rows, err := d.db.Query(sqlRebind(`SELECT subdom, path, proto, time, getnow, etag, last_modified, stat, fp, structfp,
+											sitemap_lastmod, sitemap_changefreq, sitemap_priority
+										FROM links WHERE dom = ?
+										ORDER BY subdom, path, proto, time`), domain)
+	if err != nil {
+		return fmt.Errorf("error selecting links for %v: %v", domain, err)
+	}
+
+	var start = true
+	var finish = true
+	var current cell
+	var previous cell
+	var getnow sql.NullBool
+	var etag sql.NullString
+	var stat, fp, structfp sql.NullInt64
+	var lastModified, lastmod *time.Time
+	var changefreq sql.NullString
+	var priority sql.NullFloat64
+	for rows.Next() {
+		err := rows.Scan(&current.subdom, &current.path, &current.proto, &current.crawl_time,
+			&getnow, &etag, &lastModified, &stat, &fp, &structfp, &lastmod, &changefreq, &priority)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading links for %v: %v", domain, err)
+		}
+		current.getnow = getnow.Valid && getnow.Bool
+		current.etag = etag.String
+		current.last_modified = time.Time{}
+		if lastModified != nil {
+			current.last_modified = *lastModified
+		}
+		current.stat = int(stat.Int64)
+		current.fp = fp.Int64
+		current.structfp = structfp.Int64
+		current.lastmod = time.Time{}
+		if lastmod != nil {
+			current.lastmod = *lastmod
+		}
+		current.changefreq = changefreq.String
+		current.priority = priority.Float64
+		current.resetHistory()
+
+		if start {
+			start = false
+		} else if !current.equivalent(&previous) {
+			sb.push(&previous)
+		} else {
+			current.follow(&previous)
+		}
+		previous = current
+
+		if sb.full() {
+			finish = false
+			break
+		}
+	}
+	if finish && !start {
+		sb.push(&previous)
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("error selecting links for %v: %v", domain, err)
+	}
+
+	links := sb.segment()
+	if len(links) == 0 {
+		log4go.Info("No links to dispatch for %v", domain)
+		return nil
+	}
+
+	//
+	// Insert into segments and set the dispatched flag together, so fetchers
+	// never claim a domain with a partial segment
+	//
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, u := range links {
+		log4go.Debug("Inserting link in segment: %v", u.String())
+		dom, subdom, err := u.TLDPlusOneAndSubdomain()
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("generateSegment not inserting %v: %v", u, err)
+		}
+		_, err = tx.Exec(sqlRebind(`INSERT INTO segments (dom, subdom, path, proto, time, last_modified, etag)
+									VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+			dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled, u.lastModifiedValue(), u.ETag)
+		if err != nil {
+			log4go.Error("Failed to insert link (%v), error: %v", u, err)
+		}
+	}
+
+	_, err = tx.Exec(sqlRebind(`UPDATE domain_info SET dispatched = ? WHERE dom = ?`), true, domain)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error setting %v dispatched: %v", domain, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing segment for %v: %v", domain, err)
+	}
+	log4go.Info("Generated segment for %v (%v links)", domain, len(links))
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/iParadigms/walker"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		link      string
+		canonical string
+	}{
+		{"http://Example.com/a/../b?x=1&utm_source=y#frag", "http://example.com/b?x=1"},
+		{"http://example.com:80/", "http://example.com/"},
+		{"https://example.com:443/", "https://example.com/"},
+		{"http://example.com:8080/", "http://example.com:8080/"},
+		{"https://example.com:80/", "https://example.com:80/"},
+		{"http://[::1]:80/", "http://[::1]/"},
+		{"http://example.com/a/./b/../c/", "http://example.com/a/c/"},
+		{"http://example.com/a/b/..", "http://example.com/a/"},
+		{"http://example.com/../../a", "http://example.com/a"},
+		{"http://example.com/a.html?b=2&a=1&c=3", "http://example.com/a.html?a=1&b=2&c=3"},
+		{"http://example.com/?utm_medium=x&UTM_CAMPAIGN=z&gclid=1", "http://example.com/"},
+		{"http://example.com/?q=a%20b&fbclid=2", "http://example.com/?q=a%20b"},
+		{"http://example.com/a%2Fb", "http://example.com/a%2Fb"},
+	}
+	for _, test := range tests {
+		u := parse(test.link)
+		u.Canonicalize()
+		if u.String() != test.canonical {
+			t.Errorf("Canonicalize(%v): expected %v but got %v", test.link, test.canonical, u.String())
+		}
+	}
+}
+
+func TestCanonicalizeDisabled(t *testing.T) {
+	orig := walker.Config.Canonicalization
+	defer func() { walker.Config.Canonicalization = orig }()
+	walker.Config.Canonicalization.LowercaseHost = false
+	walker.Config.Canonicalization.StripDefaultPorts = false
+	walker.Config.Canonicalization.ResolveDotSegments = false
+	walker.Config.Canonicalization.DropFragments = false
+	walker.Config.Canonicalization.SortQuery = false
+	walker.Config.Canonicalization.StripQueryParams = nil
+
+	link := "http://Example.com:80/a/../b?y=1&utm_source=y&x=2#frag"
+	u := parse(link)
+	u.Canonicalize()
+	if u.String() != link {
+		t.Errorf("Expected %v to be unchanged with canonicalization disabled, got %v", link, u.String())
+	}
+
+	// Stripping parameters without sorting keeps the original order
+	walker.Config.Canonicalization.StripQueryParams = []string{"utm_*"}
+	u = parse(link)
+	u.Canonicalize()
+	expected := "http://Example.com:80/a/../b?y=1&x=2#frag"
+	if u.String() != expected {
+		t.Errorf("Expected %v but got %v", expected, u.String())
+	}
+}
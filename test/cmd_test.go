@@ -102,6 +102,39 @@ func TestCrawlCommand(t *testing.T) {
 	}
 }
 
+func TestCrawlCommandSeeds(t *testing.T) {
+	orig := os.Args
+	origSeeds := walker.Config.Seeds
+	defer func() {
+		os.Args = orig
+		walker.Config.Seeds = origSeeds
+	}()
+	walker.Config.Seeds = []string{"http://test.com/page1.html", "http://test2.com/"}
+
+	handler := &MockHandler{}
+	cmd.Handler(handler)
+
+	datastore := &MockDatastore{}
+	datastore.On("StoreParsedURL", parse("http://test.com/page1.html"), (*walker.FetchResults)(nil)).Return()
+	datastore.On("StoreParsedURL", parse("http://test2.com/"), (*walker.FetchResults)(nil)).Return()
+	datastore.On("ClaimNewHost").Return("")
+	cmd.Datastore(datastore)
+
+	dispatcher := &MockDispatcher{}
+	dispatcher.On("StartDispatcher").Return(nil)
+	dispatcher.On("StopDispatcher").Return(nil)
+	cmd.Dispatcher(dispatcher)
+
+	os.Args = []string{os.Args[0], "crawl", "--no-console"}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	cmd.Execute()
+
+	datastore.AssertExpectations(t)
+}
+
 func TestFetchCommand(t *testing.T) {
 	handler := &MockHandler{}
 	cmd.Handler(handler)
@@ -176,6 +209,23 @@ func TestSeedCommand(t *testing.T) {
 	datastore.AssertExpectations(t)
 }
 
+func TestExcludeCommand(t *testing.T) {
+	datastore := &MockDatastore{}
+	datastore.On("ExcludeDomain", "test.com", "spam").Return(nil)
+	datastore.On("IncludeDomain", "test2.com").Return(nil)
+	cmd.Datastore(datastore)
+
+	orig := os.Args
+	defer func() { os.Args = orig }()
+
+	os.Args = []string{os.Args[0], "exclude", "--domain=test.com", "--reason=spam"}
+	cmd.Execute()
+	os.Args = []string{os.Args[0], "include", "--domain=test2.com"}
+	cmd.Execute()
+
+	datastore.AssertExpectations(t)
+}
+
 func TestSchemaCommand(t *testing.T) {
 	orig := os.Args
 	defer func() { os.Args = orig }()
@@ -505,3 +505,301 @@ func TestAddingRedirects(t *testing.T) {
 		}
 	}
 }
+
+func TestClaimNewHostOnlyOnce(t *testing.T) {
+	db := getDB(t)
+	ds1 := getDS(t)
+	ds2 := getDS(t)
+
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 0, true)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	claims := []string{ds1.ClaimNewHost(), ds2.ClaimNewHost()}
+	if !reflect.DeepEqual(claims, []string{"test.com", ""}) {
+		t.Errorf("Expected test.com to be claimed exactly once, got %v", claims)
+	}
+}
+
+func TestClaimNewHostPriority(t *testing.T) {
+	db := getDB(t)
+	ds := getDS(t)
+
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+								VALUES (?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertDomainInfo, "low.com", gocql.UUID{}, 0, true),
+		db.Query(insertDomainInfo, "high.com", gocql.UUID{}, 0, true),
+		db.Query(insertDomainInfo, "medium.com", gocql.UUID{}, 0, true),
+		db.Query(insertDomainInfo, "lowest.com", gocql.UUID{}, 0, true),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+	priorities := map[string]int{"high.com": 10, "medium.com": 5, "lowest.com": -1}
+	for domain, priority := range priorities {
+		if err := ds.SetDomainPriority(domain, priority); err != nil {
+			t.Fatalf("Failed to set priority of %v: %v", domain, err)
+		}
+	}
+
+	var claims []string
+	for host := ds.ClaimNewHost(); host != ""; host = ds.ClaimNewHost() {
+		claims = append(claims, host)
+	}
+	expected := []string{"high.com", "medium.com", "low.com", "lowest.com"}
+	if !reflect.DeepEqual(claims, expected) {
+		t.Errorf("Expected hosts to be claimed in priority order %v, but got %v", expected, claims)
+	}
+}
+
+func TestSetDomainPriority(t *testing.T) {
+	db := getDB(t)
+	ds := getDS(t)
+
+	q := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 0, false)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+	}
+
+	if err := ds.SetDomainPriority("test.com", 3); err != nil {
+		t.Fatalf("Failed to set priority: %v", err)
+	}
+	var priority int
+	if err := db.Query(`SELECT priority FROM domain_info WHERE dom = ?`, "test.com").Scan(&priority); err != nil {
+		t.Fatalf("Failed to find domain info: %v", err)
+	}
+	if priority != 3 {
+		t.Errorf("Expected priority 3 but got %v", priority)
+	}
+
+	if err := ds.SetDomainPriority("notcrawled.com", 3); err == nil {
+		t.Errorf("Expected an error setting the priority of a domain not in the crawl")
+	}
+}
+
+func TestExcludedDomainsNotClaimed(t *testing.T) {
+	db := getDB(t)
+	ds := getDS(t)
+
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+								VALUES (?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertDomainInfo, "test.com", gocql.UUID{}, 0, true),
+		db.Query(insertDomainInfo, "test2.com", gocql.UUID{}, 0, true),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	if err := ds.ExcludeDomain("test.com", "spam"); err != nil {
+		t.Fatalf("Failed to exclude test.com: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "test2.com" {
+		t.Errorf("Expected to claim test2.com but got %q", host)
+	}
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected excluded test.com not to be claimed but got %q", host)
+	}
+
+	var reason string
+	err := db.Query(`SELECT exclude_reason FROM domain_info WHERE dom = ?`, "test.com").Scan(&reason)
+	if err != nil {
+		t.Fatalf("Failed to find domain info: %v", err)
+	}
+	if reason != "spam" {
+		t.Errorf("Expected exclude_reason %q but got %q", "spam", reason)
+	}
+
+	// Excluded domains are undispatched, so they don't crowd out the domains
+	// ClaimNewHost reads
+	var dispatched bool
+	err = db.Query(`SELECT dispatched FROM domain_info WHERE dom = ?`, "test.com").Scan(&dispatched)
+	if err != nil {
+		t.Fatalf("Failed to find domain info: %v", err)
+	}
+	if dispatched {
+		t.Errorf("Expected excluded test.com to be undispatched")
+	}
+
+	// Included domains are left undispatched for the dispatcher to generate
+	// a segment for, then claimed again
+	if err := ds.IncludeDomain("test.com"); err != nil {
+		t.Fatalf("Failed to include test.com: %v", err)
+	}
+	err = db.Query(`UPDATE domain_info SET dispatched = true WHERE dom = ?`, "test.com").Exec()
+	if err != nil {
+		t.Fatalf("Failed to dispatch test.com: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Errorf("Expected to claim included test.com but got %q", host)
+	}
+}
+
+func TestSkipUnresolvableDomain(t *testing.T) {
+	db := getDB(t)
+	ds := getDS(t)
+
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+								VALUES (?, ?, ?, ?)`
+	insertSegment := `INSERT INTO segments (dom, subdom, path, proto, time)
+								VALUES (?, ?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertDomainInfo, "test.com", gocql.UUID{}, 1, true),
+		db.Query(insertDomainInfo, "dead.com", gocql.UUID{}, 0, true),
+		db.Query(insertSegment, "dead.com", "", "/page1.html", "http", walker.NotYetCrawled),
+		db.Query(insertSegment, "dead.com", "www", "/page1.html", "http", walker.NotYetCrawled),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Fatalf("Expected to claim test.com first but got %q", host)
+	}
+	if claimed := ds.ClaimedDomains(); !reflect.DeepEqual(claimed, []string{"dead.com"}) {
+		t.Fatalf("Expected dead.com to be waiting to be handed out, got %v", claimed)
+	}
+	hosts := ds.SegmentHosts("dead.com")
+	if !reflect.DeepEqual(hosts, []string{"dead.com", "www.dead.com"}) {
+		t.Errorf("Expected segment hosts dead.com and www.dead.com, got %v", hosts)
+	}
+
+	ds.SkipUnresolvableDomain("dead.com", "Failed to resolve")
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected skipped dead.com not to be claimed again yet, got %q", host)
+	}
+
+	var reason string
+	err := db.Query(`SELECT dns_error FROM domain_info WHERE dom = ?`, "dead.com").Scan(&reason)
+	if err != nil {
+		t.Fatalf("Failed to find domain info: %v", err)
+	}
+	if reason != "Failed to resolve" {
+		t.Errorf("Expected dns_error %q but got %q", "Failed to resolve", reason)
+	}
+
+	// Skipped domains are undispatched, so they don't crowd out the domains
+	// ClaimNewHost reads
+	var dispatched bool
+	err = db.Query(`SELECT dispatched FROM domain_info WHERE dom = ?`, "dead.com").Scan(&dispatched)
+	if err != nil {
+		t.Fatalf("Failed to find domain info: %v", err)
+	}
+	if dispatched {
+		t.Errorf("Expected skipped dead.com to be undispatched")
+	}
+	var count int
+	err = db.Query(`SELECT COUNT(*) FROM segments WHERE dom = ?`, "dead.com").Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed to count segment links: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected the segment of skipped dead.com to be deleted, found %v links", count)
+	}
+
+	// Once its retry time has passed and it is dispatched again, it is
+	// claimed again
+	err = db.Query(`UPDATE domain_info SET dns_retry_time = ?, dispatched = true WHERE dom = ?`,
+		time.Now().Add(-time.Minute), "dead.com").Exec()
+	if err != nil {
+		t.Fatalf("Failed to update dns_retry_time: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "dead.com" {
+		t.Errorf("Expected dead.com to be claimed again after its retry time, got %q", host)
+	}
+}
+
+func TestSkippedDomainsDontStarveClaims(t *testing.T) {
+	db := getDB(t)
+	ds := getDS(t)
+
+	// More skipped domains than ClaimNewHost reads candidates of a priority
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+								VALUES (?, ?, ?, ?)`
+	for i := 0; i < 300; i++ {
+		q := db.Query(insertDomainInfo, fmt.Sprintf("dead%v.com", i), gocql.UUID{}, 0, true)
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+	skipped := 0
+	for host := ds.ClaimNewHost(); host != ""; host = ds.ClaimNewHost() {
+		for _, domain := range ds.ClaimedDomains() {
+			ds.SkipUnresolvableDomain(domain, "Failed to resolve")
+			skipped++
+		}
+		ds.UnclaimHost(host)
+	}
+	if skipped <= 100 {
+		t.Fatalf("Expected more than 100 domains to be skipped, got %v", skipped)
+	}
+
+	q := db.Query(insertDomainInfo, "test.com", gocql.UUID{}, 0, true)
+	if err := q.Exec(); err != nil {
+		t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+	}
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Errorf("Expected test.com to be claimed past the skipped domains, got %q", host)
+	}
+}
+
+func TestRobotsCache(t *testing.T) {
+	getDB(t)
+	ds := getDS(t)
+
+	if r := ds.CachedRobots("http://test.com"); r != nil {
+		t.Errorf("Expected no cached robots.txt but got %+v", r)
+	}
+
+	fetched := time.Now().Truncate(time.Millisecond)
+	for _, stat := range []int{503, 200} {
+		ds.StoreRobots(&walker.RobotsTxt{
+			Origin:     "http://test.com",
+			StatusCode: stat,
+			Body:       []byte("User-agent: *\nDisallow: /private\n"),
+			FetchTime:  fetched,
+			Expires:    fetched.Add(time.Hour),
+		})
+	}
+
+	r := ds.CachedRobots("http://test.com")
+	if r == nil {
+		t.Fatalf("Expected a cached robots.txt")
+	}
+	if r.StatusCode != 200 || string(r.Body) != "User-agent: *\nDisallow: /private\n" {
+		t.Errorf("Expected the last stored robots.txt but got %+v", r)
+	}
+	if !r.FetchTime.Equal(fetched) || !r.Expires.Equal(fetched.Add(time.Hour)) {
+		t.Errorf("Expected times %v and %v but got %v and %v",
+			fetched, fetched.Add(time.Hour), r.FetchTime, r.Expires)
+	}
+}
+
+func TestCrawlDelayCache(t *testing.T) {
+	db := getDB(t)
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 0, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	if delay, ok := ds.CachedCrawlDelay("test.com"); ok {
+		t.Errorf("Expected no crawl delay before one is stored, got %v", delay)
+	}
+	ds.StoreCrawlDelay("test.com", 2500*time.Millisecond)
+	if delay, ok := ds.CachedCrawlDelay("test.com"); !ok || delay != 2500*time.Millisecond {
+		t.Errorf("Expected stored crawl delay of 2.5s, got %v (%v)", delay, ok)
+	}
+}
@@ -451,3 +451,166 @@ func TestDispatcherDispatchedFalseIfNoLinks(t *testing.T) {
 		t.Errorf("`dispatched` flag set to true when no links existed")
 	}
 }
+
+func TestDispatcherDispatchesEachPriority(t *testing.T) {
+	db := getDB(t)
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+							VALUES (?, ?, ?, ?)`
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time)
+						VALUES (?, ?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertDomainInfo, "high.com", gocql.UUID{}, 7, false),
+		db.Query(insertLink, "high.com", "", "/page1.html", "http", walker.NotYetCrawled),
+		db.Query(insertDomainInfo, "low.com", gocql.UUID{}, -3, false),
+		db.Query(insertLink, "low.com", "", "/page1.html", "http", walker.NotYetCrawled),
+		db.Query(insertDomainInfo, "default.com", gocql.UUID{}, 0, false),
+		db.Query(insertLink, "default.com", "", "/page1.html", "http", walker.NotYetCrawled),
+		db.Query(`INSERT INTO priorities (priority) VALUES (?)`, 7),
+		db.Query(`INSERT INTO priorities (priority) VALUES (?)`, -3),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	d := &walker.CassandraDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(time.Millisecond * 100)
+	d.StopDispatcher()
+
+	for _, dom := range []string{"high.com", "low.com", "default.com"} {
+		var dispatched bool
+		if err := db.Query(`SELECT dispatched FROM domain_info WHERE dom = ?`, dom).Scan(&dispatched); err != nil {
+			t.Fatalf("Failed to read domain_info of %v: %v", dom, err)
+		}
+		if !dispatched {
+			t.Errorf("Expected %v to be dispatched", dom)
+		}
+	}
+}
+
+func TestDispatcherReleasesStaleClaims(t *testing.T) {
+	origTimeout := walker.Config.Dispatcher.StaleClaimTimeout
+	origInterval := walker.Config.Dispatcher.StaleClaimCheckInterval
+	defer func() {
+		walker.Config.Dispatcher.StaleClaimTimeout = origTimeout
+		walker.Config.Dispatcher.StaleClaimCheckInterval = origInterval
+	}()
+	walker.Config.Dispatcher.StaleClaimTimeout = 60
+	walker.Config.Dispatcher.StaleClaimCheckInterval = 1
+
+	db := getDB(t)
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, claim_time, priority, dispatched)
+							VALUES (?, ?, ?, ?, ?)`
+	queries := []*gocql.Query{
+		db.Query(insertDomainInfo, "stale.com", gocql.TimeUUID(), time.Now().Add(-time.Hour), 0, true),
+		db.Query(insertDomainInfo, "fresh.com", gocql.TimeUUID(), time.Now(), 0, true),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test domain info: %v\nQuery: %v", err, q)
+		}
+	}
+
+	d := &walker.CassandraDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(1500 * time.Millisecond)
+	d.StopDispatcher()
+
+	expected := map[string]bool{"stale.com": false, "fresh.com": true}
+	for dom, claimed := range expected {
+		var tok gocql.UUID
+		q := db.Query(`SELECT claim_tok FROM domain_info WHERE dom = ?`, dom)
+		if err := q.Scan(&tok); err != nil {
+			t.Fatalf("Failed to find domain info: %v\nQuery: %v", err, q)
+		}
+		if (tok != gocql.UUID{}) != claimed {
+			t.Errorf("Expected %v claimed to be %v, but claim_tok was %v", dom, claimed, tok)
+		}
+	}
+}
+
+func TestDispatcherSkipsExcludedDomains(t *testing.T) {
+	db := getDB(t)
+	queries := []*gocql.Query{
+		db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, excluded, exclude_reason)
+					VALUES (?, ?, ?, ?, ?, ?)`, "test.com", gocql.UUID{}, 0, false, true, "spam"),
+		db.Query(`INSERT INTO links (dom, subdom, path, proto, time)
+					VALUES (?, ?, ?, ?, ?)`, "test.com", "", "/page1.html", "http", walker.NotYetCrawled),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	d := &walker.CassandraDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(time.Millisecond * 100)
+	d.StopDispatcher()
+
+	var count int
+	db.Query(`SELECT COUNT(*) FROM segments WHERE dom = 'test.com'`).Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected no segment for excluded test.com, found %v links", count)
+	}
+}
+
+func TestDispatcherUsesFingerprints(t *testing.T) {
+	origStableCrawlCount := walker.Config.Dispatcher.StableCrawlCount
+	origCollapse := walker.Config.Dispatcher.CollapseStructuralDuplicates
+	defer func() {
+		walker.Config.Dispatcher.StableCrawlCount = origStableCrawlCount
+		walker.Config.Dispatcher.CollapseStructuralDuplicates = origCollapse
+	}()
+	walker.Config.Dispatcher.StableCrawlCount = 2
+	walker.Config.Dispatcher.CollapseStructuralDuplicates = true
+
+	db := getDB(t)
+	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, stat, fp, structfp)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	day := func(n int) time.Time { return time.Now().AddDate(0, 0, -n) }
+	queries := []*gocql.Query{
+		db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+					VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 0, false),
+
+		// stable.html has had the same content for 3 crawls
+		db.Query(insertLink, "test.com", "", "/stable.html", "http", day(3), 200, 1, 100),
+		db.Query(insertLink, "test.com", "", "/stable.html", "http", day(2), 200, 1, 100),
+		db.Query(insertLink, "test.com", "", "/stable.html", "http", day(1), 304, nil, nil),
+
+		// changing.html changes every crawl
+		db.Query(insertLink, "test.com", "", "/changing.html", "http", day(3), 200, 2, 200),
+		db.Query(insertLink, "test.com", "", "/changing.html", "http", day(2), 200, 3, 200),
+		db.Query(insertLink, "test.com", "", "/changing.html", "http", day(1), 200, 4, 200),
+
+		// dup1.html and dup2.html share a structure, dup1 is older
+		db.Query(insertLink, "test.com", "", "/dup1.html", "http", day(5), 200, 5, 300),
+		db.Query(insertLink, "test.com", "", "/dup2.html", "http", day(4), 200, 6, 300),
+	}
+	for _, q := range queries {
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	d := &walker.CassandraDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(time.Second)
+	d.StopDispatcher()
+
+	results := map[string]bool{}
+	iter := db.Query(`SELECT path FROM segments WHERE dom = 'test.com'`).Iter()
+	var path string
+	for iter.Scan(&path) {
+		results[path] = true
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	expected := map[string]bool{"/changing.html": true, "/dup1.html": true}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected segment %v\nBut got: %v", expected, results)
+	}
+}
@@ -1,7 +1,11 @@
 package test
 
 import (
+	"errors"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -76,38 +80,376 @@ func (a *MockAddr) String() string {
 	return args.String(0)
 }
 
-func TestHostnameCached(t *testing.T) {
-	addr := &MockAddr{}
-	addr.On("String").Return("1.2.3.4")
+// fakeResolver resolves hosts to the addresses in ips, failing for other
+// hosts, and counts the lookups of each host
+type fakeResolver struct {
+	sync.Mutex
+	ips     map[string][]net.IP
+	ttl     time.Duration
+	lookups map[string]int
+}
+
+func newFakeResolver(ttl time.Duration, hosts map[string]string) *fakeResolver {
+	r := &fakeResolver{ips: map[string][]net.IP{}, ttl: ttl, lookups: map[string]int{}}
+	for host, addrs := range hosts {
+		for _, addr := range strings.Split(addrs, ",") {
+			r.ips[host] = append(r.ips[host], net.ParseIP(addr))
+		}
+	}
+	return r
+}
+
+func (r *fakeResolver) resolve(host string) ([]net.IP, time.Duration, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.lookups[host]++
+	if ips, ok := r.ips[host]; ok {
+		return ips, r.ttl, nil
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host}
+}
 
+func (r *fakeResolver) count(host string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.lookups[host]
+}
+
+// useResolver sets r as the DNSResolver and the DNS cache config to the given
+// TTLs, returning a func restoring both
+func useResolver(r *fakeResolver, minTTL, maxTTL, negativeTTL int) func() {
+	orig := walker.Config.DNSCache
+	walker.Config.DNSCache.MinTTL = minTTL
+	walker.Config.DNSCache.MaxTTL = maxTTL
+	walker.Config.DNSCache.NegativeTTL = negativeTTL
+	walker.SetDNSResolver(r.resolve)
+	return func() {
+		walker.Config.DNSCache = orig
+		walker.SetDNSResolver(nil)
+	}
+}
+
+func mockConn(remoteAddr string) *MockConn {
+	addr := &MockAddr{}
+	addr.On("String").Return(remoteAddr)
 	conn := &MockConn{}
 	conn.On("RemoteAddr").Return(addr)
+	return conn
+}
+
+func TestHostnameCached(t *testing.T) {
+	r := newFakeResolver(time.Hour, map[string]string{"test.com": "1.2.3.4"})
+	defer useResolver(r, 60, 3600, 10)()
 
+	conn := mockConn("1.2.3.4:80")
 	dialer := &MockDialer{}
-	dialer.On("Dial", "tcp", "test.com").Return(conn, nil).Once()
-	dialer.On("Dial", "tcp", "1.2.3.4").Return(conn, nil).Twice()
+	dialer.On("Dial", "tcp", "1.2.3.4:80").Return(conn, nil).Times(3)
 
 	cdial := walker.DNSCachingDial(dialer.Dial, 2)
-	cdial("tcp", "test.com")
-	cdial("tcp", "test.com")
-	cdial("tcp", "test.com")
+	cdial("tcp", "test.com:80")
+	cdial("tcp", "test.com:80")
+	cdial("tcp", "test.com:80")
+
+	dialer.AssertExpectations(t)
+	if n := r.count("test.com"); n != 1 {
+		t.Errorf("Expected test.com to be resolved once, got %v", n)
+	}
 }
 
 func TestHostPushedOutOfCache(t *testing.T) {
-	addr := &MockAddr{}
-	addr.On("String").Return("1.2.3.4")
-
-	conn := &MockConn{}
-	conn.On("RemoteAddr").Return(addr)
+	r := newFakeResolver(time.Hour, map[string]string{
+		"host1.com": "1.2.3.4",
+		"host2.com": "1.2.3.4",
+		"host3.com": "1.2.3.4",
+	})
+	defer useResolver(r, 60, 3600, 10)()
 
+	conn := mockConn("1.2.3.4:80")
 	dialer := &MockDialer{}
-	dialer.On("Dial", "tcp", "host1.com").Return(conn, nil).Twice()
-	dialer.On("Dial", "tcp", "host2.com").Return(conn, nil).Once()
-	dialer.On("Dial", "tcp", "host3.com").Return(conn, nil).Once()
+	dialer.On("Dial", "tcp", "1.2.3.4:80").Return(conn, nil).Times(4)
 
 	cdial := walker.DNSCachingDial(dialer.Dial, 2)
-	cdial("tcp", "host1.com")
-	cdial("tcp", "host2.com")
-	cdial("tcp", "host3.com")
-	cdial("tcp", "host1.com")
+	cdial("tcp", "host1.com:80")
+	cdial("tcp", "host2.com:80")
+	cdial("tcp", "host3.com:80")
+	cdial("tcp", "host1.com:80")
+
+	expected := map[string]int{"host1.com": 2, "host2.com": 1, "host3.com": 1}
+	for host, n := range expected {
+		if r.count(host) != n {
+			t.Errorf("Expected %v to be resolved %v times, got %v", host, n, r.count(host))
+		}
+	}
+}
+
+func TestDNSCacheTTLBounds(t *testing.T) {
+	tests := []struct {
+		ttl            time.Duration
+		minTTL, maxTTL int
+		lookups        int
+	}{
+		// Records' TTL of an hour is held to a max of 0
+		{time.Hour, 0, 0, 3},
+		// Records' TTL of 0 is raised to a min of an hour
+		{0, 3600, 3600, 1},
+		// Within bounds, the records' TTL is used
+		{time.Hour, 0, 7200, 1},
+		{0, 0, 7200, 3},
+	}
+	for _, test := range tests {
+		r := newFakeResolver(test.ttl, map[string]string{"test.com": "1.2.3.4"})
+		restore := useResolver(r, test.minTTL, test.maxTTL, 10)
+
+		conn := mockConn("1.2.3.4:80")
+		dialer := &MockDialer{}
+		dialer.On("Dial", "tcp", "1.2.3.4:80").Return(conn, nil).Times(3)
+		cdial := walker.DNSCachingDial(dialer.Dial, 10)
+		for i := 0; i < 3; i++ {
+			cdial("tcp", "test.com:80")
+		}
+		if n := r.count("test.com"); n != test.lookups {
+			t.Errorf("Expected %v lookups with TTL %v bounded by [%v, %v], got %v",
+				test.lookups, test.ttl, test.minTTL, test.maxTTL, n)
+		}
+		restore()
+	}
+}
+
+func TestDNSCacheNegativeCaching(t *testing.T) {
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "dead.com"}}
+	var dialed []string
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		switch addr {
+		case "dead.com:80":
+			return nil, dnsErr
+		case "hosts-file.com:80":
+			return mockConn("5.6.7.8:80"), nil
+		}
+		return mockConn(addr), nil
+	}
+
+	// Failures are cached for the negative TTL, and the wrapped dial gets a
+	// chance to resolve the host itself once per failed lookup
+	r := newFakeResolver(time.Hour, nil)
+	restore := useResolver(r, 60, 3600, 60)
+	cdial := walker.DNSCachingDial(dial, 10)
+	for i := 0; i < 3; i++ {
+		if _, err := cdial("tcp", "dead.com:80"); err == nil {
+			t.Errorf("Expected dead.com to fail to dial")
+		}
+	}
+	if n := r.count("dead.com"); n != 1 {
+		t.Errorf("Expected dead.com to be resolved once within the negative TTL, got %v", n)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("Expected dead.com to be dialed once, got %v", dialed)
+	}
+	restore()
+
+	// A negative TTL of 0 retries right away
+	r = newFakeResolver(time.Hour, nil)
+	restore = useResolver(r, 60, 3600, 0)
+	cdial = walker.DNSCachingDial(dial, 10)
+	cdial("tcp", "dead.com:80")
+	cdial("tcp", "dead.com:80")
+	if n := r.count("dead.com"); n != 2 {
+		t.Errorf("Expected dead.com to be resolved again with a negative TTL of 0, got %v lookups", n)
+	}
+	restore()
+
+	// Hosts the wrapped dial resolves are cached at the address it connected to
+	r = newFakeResolver(time.Hour, nil)
+	restore = useResolver(r, 60, 3600, 60)
+	defer restore()
+	dialed = nil
+	cdial = walker.DNSCachingDial(dial, 10)
+	for i := 0; i < 2; i++ {
+		if _, err := cdial("tcp", "hosts-file.com:80"); err != nil {
+			t.Errorf("Failed to dial hosts-file.com: %v", err)
+		}
+	}
+	expected := []string{"hosts-file.com:80", "5.6.7.8:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("Expected dials %v, got %v", expected, dialed)
+	}
+	if n := r.count("hosts-file.com"); n != 1 {
+		t.Errorf("Expected hosts-file.com to be resolved once, got %v", n)
+	}
+}
+
+func TestDNSCacheFailover(t *testing.T) {
+	r := newFakeResolver(time.Hour, map[string]string{
+		"test.com": "1.1.1.1,2.2.2.2,2001:db8::1",
+	})
+	defer useResolver(r, 60, 3600, 10)()
+
+	var dialed []string
+	down := map[string]bool{}
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if down[addr] {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		}
+		return mockConn(addr), nil
+	}
+	cdial := walker.DNSCachingDial(dial, 10)
+
+	for i := 0; i < 3; i++ {
+		cdial("tcp", "test.com:80")
+	}
+	expected := []string{"1.1.1.1:80", "1.1.1.1:80", "1.1.1.1:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("Expected dials to stick to one address %v, got %v", expected, dialed)
+	}
+
+	// Unreachable addresses are skipped over, and the next one takes their
+	// place
+	dialed = nil
+	down["1.1.1.1:80"] = true
+	for i := 0; i < 2; i++ {
+		if _, err := cdial("tcp", "test.com:80"); err != nil {
+			t.Errorf("Expected dial to fall over to the next address, got %v", err)
+		}
+	}
+	expected = []string{"1.1.1.1:80", "2.2.2.2:80", "2.2.2.2:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("Expected dials %v, got %v", expected, dialed)
+	}
+
+	// Networks only get addresses of their family
+	delete(down, "2.2.2.2:80")
+	for _, network := range []string{"tcp4", "tcp6"} {
+		for i := 0; i < 3; i++ {
+			dialed = nil
+			cdial(network, "test.com:80")
+			if len(dialed) != 1 || strings.HasPrefix(dialed[0], "[") != (network == "tcp6") {
+				t.Errorf("Expected %v dial to one address of its family, got %v", network, dialed)
+			}
+		}
+	}
+}
+
+func TestDNSCacheRotatesOnResolution(t *testing.T) {
+	// Every dial resolves the host again, since nothing is cached for long
+	r := newFakeResolver(0, map[string]string{
+		"test.com": "1.1.1.1,2.2.2.2,2001:db8::1",
+	})
+	defer useResolver(r, 0, 0, 0)()
+
+	var dialed []string
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return mockConn(addr), nil
+	}
+	cdial := walker.DNSCachingDial(dial, 10)
+
+	for i := 0; i < 4; i++ {
+		cdial("tcp", "test.com:80")
+	}
+	expected := []string{"1.1.1.1:80", "2.2.2.2:80", "[2001:db8::1]:80", "1.1.1.1:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("Expected resolutions to rotate through addresses %v, got %v", expected, dialed)
+	}
+}
+
+func TestDNSCacheStats(t *testing.T) {
+	r := newFakeResolver(time.Hour, map[string]string{"test.com": "1.2.3.4"})
+	defer useResolver(r, 60, 3600, 60)()
+	dial := func(network, addr string) (net.Conn, error) {
+		if addr == "dead.com:80" {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "dead.com"}}
+		}
+		return mockConn(addr), nil
+	}
+	cdial := walker.DNSCachingDial(dial, 10)
+
+	before := walker.DNSCacheStats()
+	cdial("tcp", "test.com:80")
+	cdial("tcp", "test.com:80")
+	cdial("tcp", "dead.com:80")
+	cdial("tcp", "dead.com:80")
+	cdial("tcp", "1.2.3.4:80")
+	after := walker.DNSCacheStats()
+
+	got := walker.DNSCacheCounts{
+		Hits:     after.Hits - before.Hits,
+		Misses:   after.Misses - before.Misses,
+		Failures: after.Failures - before.Failures,
+	}
+	expected := walker.DNSCacheCounts{Hits: 2, Misses: 2, Failures: 1}
+	if got != expected {
+		t.Errorf("Expected DNS cache counts %+v, got %+v", expected, got)
+	}
+}
+
+// claimingDatastore is a MockDatastore that has claimed the domains in hosts
+// ahead of time, recording the domains it is asked to skip
+type claimingDatastore struct {
+	*MockDatastore
+	mu      sync.Mutex
+	hosts   map[string][]string
+	skipped []string
+}
+
+func (ds *claimingDatastore) ClaimedDomains() []string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var domains []string
+	for domain := range ds.hosts {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+func (ds *claimingDatastore) SegmentHosts(domain string) []string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.hosts[domain]
+}
+
+func (ds *claimingDatastore) SkipUnresolvableDomain(domain string, reason string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.hosts, domain)
+	ds.skipped = append(ds.skipped, domain)
+}
+
+func TestDNSPrefetch(t *testing.T) {
+	r := newFakeResolver(time.Hour, map[string]string{"www.good.com": "1.2.3.4"})
+	defer useResolver(r, 60, 3600, 0)()
+	origPrefetch := walker.Config.DNSPrefetch
+	defer func() { walker.Config.DNSPrefetch = origPrefetch }()
+	walker.Config.DNSPrefetch.Enabled = true
+	walker.Config.DNSPrefetch.Interval = 1
+	walker.Config.DNSPrefetch.SkipUnresolvableFor = 3600
+
+	mock := &MockDatastore{}
+	mock.On("ClaimNewHost").Return("")
+	ds := &claimingDatastore{
+		MockDatastore: mock,
+		hosts: map[string][]string{
+			"good.com": []string{"good.com", "www.good.com"},
+			"dead.com": []string{"dead.com", "www.dead.com"},
+		},
+	}
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   &MockHandler{},
+		Transport: GetFakeTransport(),
+	}
+	go manager.Start()
+	time.Sleep(1500 * time.Millisecond)
+	manager.Stop()
+
+	if n := r.count("www.good.com"); n != 1 {
+		t.Errorf("Expected www.good.com to be prefetched once and then cached, got %v lookups", n)
+	}
+	if n := r.count("www.dead.com"); n != 2 {
+		t.Errorf("Expected www.dead.com to be looked up in 2 rounds, got %v lookups", n)
+	}
+	if !reflect.DeepEqual(ds.skipped, []string{"dead.com"}) {
+		t.Errorf("Expected only dead.com to be skipped, got %v", ds.skipped)
+	}
 }
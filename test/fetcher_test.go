@@ -1,11 +1,21 @@
+//go:build sudo
 // +build sudo
 
 package test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -225,6 +235,12 @@ func TestFetcherBlacklistsPrivateIPs(t *testing.T) {
 
 	ds := &MockDatastore{}
 	ds.On("ClaimNewHost").Return("private.com").Once()
+	ds.On("LinksForHost", "private.com").Return([]*walker.URL{
+		parse("http://private.com/page1.html"),
+		parse("http://private.com/page2.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return().Once()
+	ds.On("ExcludeDomain", "private.com", "Resolved to private IP address 127.0.0.1").Return(nil).Once()
 	ds.On("UnclaimHost", "private.com").Return()
 	ds.On("ClaimNewHost").Return("")
 
@@ -249,10 +265,18 @@ func TestFetcherBlacklistsPrivateIPs(t *testing.T) {
 	if len(h.Calls) != 0 {
 		t.Error("Did not expect any handler calls due to host resolving to private IP")
 	}
+	// The segment is abandoned after the first fetch is refused
+	for _, call := range ds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fr := call.Arguments.Get(0).(*walker.FetchResults)
+			if fr.FetchError == nil || !strings.Contains(fr.FetchError.Error(), "blacklisted IP address 127.0.0.1") {
+				t.Errorf("Expected fetch of %v to be refused, got error %v", fr.URL, fr.FetchError)
+			}
+		}
+	}
 
 	ds.AssertExpectations(t)
 	h.AssertExpectations(t)
-	ds.AssertNotCalled(t, "LinksForHost", "private.com")
 }
 
 func TestStillCrawlWhenDomainUnreachable(t *testing.T) {
@@ -265,7 +289,6 @@ func TestStillCrawlWhenDomainUnreachable(t *testing.T) {
 	ds.On("LinksForHost", "a1234567890bcde.com").Return([]*walker.URL{
 		parse("http://a1234567890bcde.com/"),
 	})
-	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
 	ds.On("UnclaimHost", "a1234567890bcde.com").Return()
 	ds.On("ClaimNewHost").Return("")
 
@@ -281,7 +304,10 @@ func TestStillCrawlWhenDomainUnreachable(t *testing.T) {
 	time.Sleep(time.Millisecond * 10)
 	manager.Stop()
 
+	// robots.txt can't be reached, so the link is left to be dispatched again
+	// later, but the host is still crawled through and unclaimed
 	ds.AssertExpectations(t)
+	ds.AssertNotCalled(t, "StoreURLFetchResults", mock.Anything)
 	h.AssertExpectations(t)
 }
 
@@ -388,6 +414,71 @@ func TestRedirects(t *testing.T) {
 	h.AssertExpectations(t)
 }
 
+func TestLinksResolvedAgainstRedirectTarget(t *testing.T) {
+	orig := walker.Config.Canonicalization.HonorRelCanonical
+	defer func() { walker.Config.Canonicalization.HonorRelCanonical = orig }()
+	walker.Config.Canonicalization.HonorRelCanonical = true
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(`<!DOCTYPE html>
+<html>
+<head>
+<link rel="canonical" href="canonical.html">
+</head>
+<body>
+<a href="sibling.html">link</a>
+<a href="../parent.html">link</a>
+</body>
+</html>`))
+	rt := &mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/old/page.html":     response307("http://t.com/new/dir/page.html"),
+			"http://t.com/new/dir/page.html": page,
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/old/page.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	parsed := map[string]bool{}
+	for _, call := range ds.Calls {
+		if call.Method == "StoreParsedURL" {
+			parsed[call.Arguments.Get(0).(*walker.URL).String()] = true
+		}
+	}
+	// Relative links are resolved against the page that served them, not
+	// the link that redirected to it
+	expected := map[string]bool{
+		"http://t.com/new/dir/sibling.html":   true,
+		"http://t.com/new/parent.html":        true,
+		"http://t.com/new/dir/canonical.html": true,
+	}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("Expected parsed links %v\nBut got: %v", expected, parsed)
+	}
+}
+
 func TestHrefWithSpace(t *testing.T) {
 
 	testPage := "http://t.com/page1.html"
@@ -487,3 +578,1921 @@ func TestHrefWithSpace(t *testing.T) {
 	ds.AssertExpectations(t)
 	h.AssertExpectations(t)
 }
+
+// notModifiedRoundTrip records requests and responds 304 Not Modified to
+// every one of them
+type notModifiedRoundTrip struct {
+	requests []*http.Request
+}
+
+func (rt *notModifiedRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req)
+	return &http.Response{
+		Status:        "304 Not Modified",
+		StatusCode:    http.StatusNotModified,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader("")),
+		ContentLength: 0,
+	}, nil
+}
+
+func TestConditionalGet(t *testing.T) {
+	link := parse("http://t.com/page1.html")
+	link.LastCrawled = time.Date(2014, time.November, 14, 10, 0, 0, 0, time.UTC)
+	link.LastModified = time.Date(2014, time.November, 12, 10, 0, 0, 0, time.UTC)
+	link.ETag = `"abc123"`
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{link})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+
+	rt := &notModifiedRoundTrip{}
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+
+	go manager.Start()
+	time.Sleep(time.Millisecond * 100)
+	manager.Stop()
+
+	var pageReq *http.Request
+	for _, req := range rt.requests {
+		if req.URL.String() == link.String() {
+			pageReq = req
+		}
+	}
+	if pageReq == nil {
+		t.Fatalf("Expected a request for %v", link)
+	}
+	if ims := pageReq.Header.Get("If-Modified-Since"); ims != "Wed, 12 Nov 2014 10:00:00 GMT" {
+		t.Errorf("Expected If-Modified-Since to be LastModified but got %q", ims)
+	}
+	if inm := pageReq.Header.Get("If-None-Match"); inm != `"abc123"` {
+		t.Errorf("Expected If-None-Match to be the stored ETag but got %q", inm)
+	}
+
+	var stored *walker.FetchResults
+	for _, call := range ds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fr := call.Arguments.Get(0).(*walker.FetchResults)
+			if fr.URL.String() == link.String() {
+				stored = fr
+			}
+		}
+	}
+	if stored == nil || stored.Response == nil || stored.Response.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected the 304 response to be stored, got %+v", stored)
+	}
+
+	// The handler should never be called since the page did not change
+	ds.AssertExpectations(t)
+	h.AssertExpectations(t)
+}
+
+func TestFetcherFingerprints(t *testing.T) {
+	page := func(title, text string) *http.Response {
+		res := response200()
+		res.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>%s</title></head>
+<body><div class="content"><p>%s</p></div></body>
+</html>`, title, text)))
+		return res
+	}
+	roundTriper := mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/page1.html": page("Page 1", "Some text"),
+			"http://t.com/page2.html": page("Page 2", "Other text"),
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/page1.html"),
+		parse("http://t.com/page2.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &roundTriper,
+	}
+
+	go manager.Start()
+	time.Sleep(time.Second * 3)
+	manager.Stop()
+
+	if len(h.Calls) != 2 {
+		t.Fatalf("Expected 2 handler calls but got %v", len(h.Calls))
+	}
+	fr1 := h.Calls[0].Arguments.Get(0).(*walker.FetchResults)
+	fr2 := h.Calls[1].Arguments.Get(0).(*walker.FetchResults)
+	if fr1.Fingerprint == 0 || fr1.StructFingerprint == 0 {
+		t.Errorf("Expected fingerprints to be set, got %v and %v", fr1.Fingerprint, fr1.StructFingerprint)
+	}
+	if fr1.Fingerprint == fr2.Fingerprint {
+		t.Errorf("Expected pages with different content to have different fingerprints")
+	}
+	if fr1.StructFingerprint != fr2.StructFingerprint {
+		t.Errorf("Expected pages with the same structure to have the same structure fingerprint")
+	}
+}
+
+func TestFetcherSkipsCrawlerTraps(t *testing.T) {
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(`<!DOCTYPE html>
+<html>
+<body>
+	<a href="/page2.html">page2</a>
+	<a href="/page.jsp;jsessionid=ABC123">session</a>
+</body>
+</html>`))
+	roundTriper := mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/page1.html": page,
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/page1.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreTrapURL", mock.AnythingOfType("*walker.URL"), "session ID jsessionid in path").Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &roundTriper,
+	}
+
+	go manager.Start()
+	time.Sleep(time.Second * 3)
+	manager.Stop()
+
+	var stored []string
+	var trapped []string
+	for _, call := range ds.Calls {
+		switch call.Method {
+		case "StoreParsedURL":
+			stored = append(stored, call.Arguments.Get(0).(*walker.URL).String())
+		case "StoreTrapURL":
+			trapped = append(trapped, call.Arguments.Get(0).(*walker.URL).String())
+		}
+	}
+	if !reflect.DeepEqual(stored, []string{"http://t.com/page2.html"}) {
+		t.Errorf("Expected only page2.html to be stored, got %v", stored)
+	}
+	if !reflect.DeepEqual(trapped, []string{"http://t.com/page.jsp;jsessionid=ABC123"}) {
+		t.Errorf("Expected the session ID link to be recorded as a trap, got %v", trapped)
+	}
+}
+
+func TestFetcherCanonicalizesLinks(t *testing.T) {
+	orig := walker.Config.Canonicalization.HonorRelCanonical
+	defer func() { walker.Config.Canonicalization.HonorRelCanonical = orig }()
+	walker.Config.Canonicalization.HonorRelCanonical = true
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(`<!DOCTYPE html>
+<html>
+<head><link rel="canonical" href="/page1.html?a=1&b=2"></head>
+<body>
+	<a href="http://T.com:80/dir/../page2.html?utm_source=x#top">page2</a>
+</body>
+</html>`))
+	roundTriper := mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/page1.html?b=2&a=1": page,
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/page1.html?b=2&a=1"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &roundTriper,
+	}
+
+	go manager.Start()
+	time.Sleep(time.Second * 3)
+	manager.Stop()
+
+	var stored []string
+	for _, call := range ds.Calls {
+		if call.Method == "StoreParsedURL" {
+			stored = append(stored, call.Arguments.Get(0).(*walker.URL).String())
+		}
+	}
+	expected := []string{"http://t.com/page2.html", "http://t.com/page1.html?a=1&b=2"}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored links %v but got %v", expected, stored)
+	}
+
+	if len(h.Calls) != 1 {
+		t.Fatalf("Expected 1 handler call but got %v", len(h.Calls))
+	}
+	fr := h.Calls[0].Arguments.Get(0).(*walker.FetchResults)
+	if fr.CanonicalURL == nil || fr.CanonicalURL.String() != "http://t.com/page1.html?a=1&b=2" {
+		t.Errorf("Expected CanonicalURL http://t.com/page1.html?a=1&b=2 but got %v", fr.CanonicalURL)
+	}
+}
+
+func TestFetcherMaxContentSize(t *testing.T) {
+	origMax := walker.Config.MaxHTTPContentSizeBytes
+	origTruncate := walker.Config.TruncateOversizedContent
+	origFormats := walker.Config.AcceptFormats
+	defer func() {
+		walker.Config.MaxHTTPContentSizeBytes = origMax
+		walker.Config.TruncateOversizedContent = origTruncate
+		walker.Config.AcceptFormats = origFormats
+	}()
+	walker.Config.AcceptFormats = []string{"text/html", "text/csv"}
+
+	html := `<html><body><a href="/page2.html">page2</a>` + strings.Repeat(" ", 100) +
+		`<a href="/page3.html">page3</a></body></html>`
+	walker.Config.MaxHTTPContentSizeBytes = int64(strings.Index(html, `<a href="/page3.html">`))
+
+	text := strings.Repeat("x", 1000)
+	responses := func() map[string]*http.Response {
+		page := response200()
+		page.Body = ioutil.NopCloser(strings.NewReader(html))
+		page.ContentLength = -1
+
+		// Documents with no LinkExtractor are passed to the handler without
+		// being read first
+		doc := response200()
+		doc.Header.Set("Content-Type", "text/csv")
+		doc.Body = ioutil.NopCloser(strings.NewReader(text))
+		doc.ContentLength = -1
+
+		big := response200()
+		big.Header.Set("Content-Type", "text/csv")
+		big.Body = ioutil.NopCloser(strings.NewReader(text))
+		big.ContentLength = int64(len(text))
+
+		return map[string]*http.Response{
+			"http://t.com/page1.html": page,
+			"http://t.com/doc.txt":    doc,
+			"http://t.com/big.txt":    big,
+		}
+	}
+
+	run := func() (*MockDatastore, *MockHandler) {
+		ds := &MockDatastore{}
+		ds.On("ClaimNewHost").Return("t.com").Once()
+		ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+			parse("http://t.com/page1.html"),
+			parse("http://t.com/doc.txt"),
+			parse("http://t.com/big.txt"),
+		})
+		ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("StoreParsedURL",
+			mock.AnythingOfType("*walker.URL"),
+			mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("UnclaimHost", "t.com").Return()
+		ds.On("ClaimNewHost").Return("")
+
+		h := &MockHandler{}
+		h.On("HandleResponse", mock.Anything).Return()
+
+		manager := &walker.FetchManager{
+			Datastore: ds,
+			Handler:   h,
+			Transport: &mapRoundTrip{responses: responses()},
+		}
+		go manager.Start()
+		time.Sleep(time.Second * 4)
+		manager.Stop()
+		return ds, h
+	}
+
+	// results collects the stored FetchResults by path
+	results := func(ds *MockDatastore) map[string]*walker.FetchResults {
+		frs := map[string]*walker.FetchResults{}
+		for _, call := range ds.Calls {
+			if call.Method == "StoreURLFetchResults" {
+				fr := call.Arguments.Get(0).(*walker.FetchResults)
+				frs[fr.URL.Path] = fr
+			}
+		}
+		return frs
+	}
+
+	//
+	// Truncating
+	//
+	walker.Config.TruncateOversizedContent = true
+	ds, h := run()
+
+	anchor := func(link string) *walker.URL {
+		u := parse(link)
+		u.SourceTag, u.SourceAttr = "a", "href"
+		return u
+	}
+	ds.AssertCalled(t, "StoreParsedURL", anchor("http://t.com/page2.html"), mock.AnythingOfType("*walker.FetchResults"))
+	ds.AssertNotCalled(t, "StoreParsedURL", anchor("http://t.com/page3.html"), mock.AnythingOfType("*walker.FetchResults"))
+	if len(h.Calls) != 3 {
+		t.Fatalf("Expected 3 handler calls but got %v", len(h.Calls))
+	}
+	for _, call := range h.Calls {
+		fr := call.Arguments.Get(0).(*walker.FetchResults)
+		body, err := ioutil.ReadAll(fr.Response.Body)
+		if err != nil {
+			t.Errorf("Failed to read body of %v: %v", fr.URL, err)
+		}
+		if int64(len(body)) != walker.Config.MaxHTTPContentSizeBytes {
+			t.Errorf("Expected %v body to be truncated to %v bytes, got %v",
+				fr.URL, walker.Config.MaxHTTPContentSizeBytes, len(body))
+		}
+		if !fr.Truncated {
+			t.Errorf("Expected %v to be marked truncated", fr.URL)
+		}
+	}
+
+	//
+	// Aborting
+	//
+	walker.Config.TruncateOversizedContent = false
+	ds, h = run()
+
+	frs := results(ds)
+	for _, path := range []string{"/page1.html", "/big.txt"} {
+		fr := frs[path]
+		if fr == nil {
+			t.Fatalf("Expected fetch results to be stored for %v", path)
+		}
+		if fr.FetchError != walker.ErrContentTooLarge || !fr.Truncated {
+			t.Errorf("Expected %v fetch to be aborted, got error %v (truncated %v)", path, fr.FetchError, fr.Truncated)
+		}
+	}
+	ds.AssertNotCalled(t, "StoreParsedURL", mock.AnythingOfType("*walker.URL"), mock.AnythingOfType("*walker.FetchResults"))
+
+	// Without a Content-Length we only find out while the handler reads the
+	// body
+	if len(h.Calls) != 1 {
+		t.Fatalf("Expected 1 handler call but got %v", len(h.Calls))
+	}
+	fr := h.Calls[0].Arguments.Get(0).(*walker.FetchResults)
+	if _, err := ioutil.ReadAll(fr.Response.Body); err != walker.ErrContentTooLarge {
+		t.Errorf("Expected reading the body of %v to fail with ErrContentTooLarge, got %v", fr.URL, err)
+	}
+	if !fr.Truncated {
+		t.Errorf("Expected %v to be marked truncated", fr.URL)
+	}
+}
+
+func TestFetcherMaxLinksPerPage(t *testing.T) {
+	origMax := walker.Config.MaxLinksPerPage
+	origSelection := walker.Config.LinkSelection
+	defer func() {
+		walker.Config.MaxLinksPerPage = origMax
+		walker.Config.LinkSelection = origSelection
+	}()
+	walker.Config.MaxLinksPerPage = 2
+
+	tests := []struct {
+		selection string
+		expected  []string // nil means any 2 links
+	}{
+		{"first", []string{"http://other.com/a.html", "http://other.com/b.html"}},
+		{"same_domain_first", []string{"http://t.com/c.html", "http://t.com/d.html"}},
+		{"sample", nil},
+	}
+	for _, test := range tests {
+		walker.Config.LinkSelection = test.selection
+
+		page := response200()
+		// Duplicates and traps are not stored, so they don't count
+		page.Body = ioutil.NopCloser(strings.NewReader(`<html><body>
+	<a href="http://other.com/x/x/x/x/trap.html">trap</a>
+	<a href="http://other.com/a.html">a</a>
+	<a href="http://OTHER.com/a.html">a again</a>
+	<a href="http://other.com/b.html">b</a>
+	<a href="/c.html">c</a>
+	<a href="mailto:someone@t.com">not stored</a>
+	<a href="/c.html">c again</a>
+	<a href="/d.html">d</a>
+</body></html>`))
+
+		ds := &MockDatastore{}
+		ds.On("ClaimNewHost").Return("t.com").Once()
+		ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+			parse("http://t.com/page1.html"),
+		})
+		ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("StoreParsedURL",
+			mock.AnythingOfType("*walker.URL"),
+			mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("StoreTrapURL", mock.AnythingOfType("*walker.URL"), mock.AnythingOfType("string")).Return()
+		ds.On("UnclaimHost", "t.com").Return()
+		ds.On("ClaimNewHost").Return("")
+
+		h := &MockHandler{}
+		h.On("HandleResponse", mock.Anything).Return()
+
+		manager := &walker.FetchManager{
+			Datastore: ds,
+			Handler:   h,
+			Transport: &mapRoundTrip{responses: map[string]*http.Response{"http://t.com/page1.html": page}},
+		}
+		go manager.Start()
+		time.Sleep(time.Second * 2)
+		manager.Stop()
+
+		var stored []string
+		var fr *walker.FetchResults
+		for _, call := range ds.Calls {
+			switch call.Method {
+			case "StoreParsedURL":
+				stored = append(stored, call.Arguments.Get(0).(*walker.URL).String())
+			case "StoreURLFetchResults":
+				fr = call.Arguments.Get(0).(*walker.FetchResults)
+			}
+		}
+		if test.expected != nil && !reflect.DeepEqual(stored, test.expected) {
+			t.Errorf("%v: expected stored links %v but got %v", test.selection, test.expected, stored)
+		} else if len(stored) == 2 && stored[0] == stored[1] {
+			t.Errorf("%v: expected 2 distinct stored links but got %v", test.selection, stored)
+		} else if len(stored) != 2 {
+			t.Errorf("%v: expected 2 stored links but got %v", test.selection, stored)
+		}
+		if fr == nil || fr.DroppedLinks != 2 {
+			t.Errorf("%v: expected fetch results with 2 dropped links, got %v", test.selection, fr)
+		}
+	}
+}
+
+// sequenceRoundTrip returns the given responses (or errors, if the response
+// is nil) for each link in order, then 404s once they run out
+type sequenceRoundTrip struct {
+	responses map[string][]*http.Response
+	errors    map[string][]error
+}
+
+func (rt *sequenceRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	link := req.URL.String()
+	res := rt.responses[link]
+	if len(res) == 0 {
+		return response404(), nil
+	}
+	rt.responses[link] = res[1:]
+	if res[0] == nil {
+		err := rt.errors[link][0]
+		rt.errors[link] = rt.errors[link][1:]
+		return nil, err
+	}
+	return res[0], nil
+}
+
+func responseStatus(code int, retryAfter string) *http.Response {
+	res := response200()
+	res.StatusCode = code
+	res.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+	if retryAfter != "" {
+		res.Header.Set("Retry-After", retryAfter)
+	}
+	return res
+}
+
+func TestFetcherRetries(t *testing.T) {
+	origRetry := walker.Config.Retry
+	defer func() { walker.Config.Retry = origRetry }()
+	walker.Config.Retry.MaxAttempts = 3
+	walker.Config.Retry.InitialBackoff = 0
+	walker.Config.Retry.MaxBackoff = 60
+	walker.Config.Retry.MaxHostFailures = 10
+
+	connErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "t.com"}}
+	rt := &sequenceRoundTrip{
+		responses: map[string][]*http.Response{
+			"http://t.com/page1.html": {responseStatus(503, "0"), nil, response200()},
+			"http://t.com/page2.html": {responseStatus(429, "3600"), response200()},
+			"http://t.com/page3.html": {nil, nil, nil, response200()},
+			"http://t.com/page4.html": {nil, response200()},
+		},
+		errors: map[string][]error{
+			"http://t.com/page1.html": {connErr},
+			"http://t.com/page3.html": {connErr, connErr, connErr},
+			"http://t.com/page4.html": {dnsErr},
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/page1.html"),
+		parse("http://t.com/page2.html"),
+		parse("http://t.com/page3.html"),
+		parse("http://t.com/page4.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	// Describe each stored attempt as its status code, or "err"
+	attempts := map[string][]string{}
+	for _, call := range ds.Calls {
+		if call.Method != "StoreURLFetchResults" {
+			continue
+		}
+		fr := call.Arguments.Get(0).(*walker.FetchResults)
+		result := "err"
+		if fr.FetchError == nil {
+			result = fmt.Sprint(fr.Response.StatusCode)
+		}
+		attempts[fr.URL.Path] = append(attempts[fr.URL.Path], result)
+	}
+	expected := map[string][]string{
+		// Retried until it succeeded
+		"/page1.html": {"503", "err", "200"},
+		// Retry-After is longer than max_backoff, so not retried
+		"/page2.html": {"429"},
+		// Gave up after max_attempts
+		"/page3.html": {"err", "err", "err"},
+		// The host doesn't resolve, so not retried
+		"/page4.html": {"err"},
+	}
+	if !reflect.DeepEqual(attempts, expected) {
+		t.Errorf("Expected stored attempts %v\nBut got: %v", expected, attempts)
+	}
+
+	// Only the last attempt at each link is handled
+	var handled []string
+	for _, call := range h.Calls {
+		fr := call.Arguments.Get(0).(*walker.FetchResults)
+		handled = append(handled, fmt.Sprintf("%v %v", fr.URL.Path, fr.Response.StatusCode))
+	}
+	expectedHandled := []string{"/page1.html 200", "/page2.html 429"}
+	if !reflect.DeepEqual(handled, expectedHandled) {
+		t.Errorf("Expected handled responses %v but got %v", expectedHandled, handled)
+	}
+}
+
+func TestFetcherAbandonsDownHost(t *testing.T) {
+	origRetry := walker.Config.Retry
+	defer func() { walker.Config.Retry = origRetry }()
+	walker.Config.Retry.MaxAttempts = 2
+	walker.Config.Retry.InitialBackoff = 0
+	walker.Config.Retry.MaxHostFailures = 3
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/page1.html"),
+		parse("http://t.com/page2.html"),
+		parse("http://t.com/page3.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	unavailable := func() []*http.Response {
+		return []*http.Response{responseStatus(503, ""), responseStatus(503, "")}
+	}
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &sequenceRoundTrip{
+			responses: map[string][]*http.Response{
+				"http://t.com/page1.html": unavailable(),
+				"http://t.com/page2.html": unavailable(),
+				"http://t.com/page3.html": unavailable(),
+			},
+		},
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	var fetched []string
+	for _, call := range ds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fetched = append(fetched, call.Arguments.Get(0).(*walker.FetchResults).URL.Path)
+		}
+	}
+	// page2's first attempt is the third failure in a row, so it isn't
+	// retried and page3 is never fetched
+	expected := []string{"/page1.html", "/page1.html", "/page2.html"}
+	if !reflect.DeepEqual(fetched, expected) {
+		t.Errorf("Expected fetches %v before abandoning the host, got %v", expected, fetched)
+	}
+	ds.AssertExpectations(t)
+}
+
+// claimRefresherDatastore is a MockDatastore that is also a
+// walker.ClaimRefresher
+type claimRefresherDatastore struct {
+	*MockDatastore
+}
+
+func (ds *claimRefresherDatastore) RefreshClaim(host string) bool {
+	args := ds.Mock.Called(host)
+	return args.Bool(0)
+}
+
+// slowRoundTrip is a mapRoundTrip that takes delay to answer
+type slowRoundTrip struct {
+	mapRoundTrip
+	delay time.Duration
+}
+
+func (rt *slowRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(rt.delay)
+	return rt.mapRoundTrip.RoundTrip(req)
+}
+
+func TestFetcherRefreshesClaim(t *testing.T) {
+	origTimeout := walker.Config.Dispatcher.StaleClaimTimeout
+	defer func() { walker.Config.Dispatcher.StaleClaimTimeout = origTimeout }()
+	walker.Config.Dispatcher.StaleClaimTimeout = 1
+
+	var links []*walker.URL
+	for i := 0; i < 10; i++ {
+		links = append(links, parse(fmt.Sprintf("http://t.com/page%v.html", i)))
+	}
+	mds := &MockDatastore{}
+	mds.On("ClaimNewHost").Return("t.com").Once()
+	mds.On("LinksForHost", "t.com").Return(links)
+	mds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	mds.On("UnclaimHost", "t.com").Return()
+	mds.On("ClaimNewHost").Return("")
+	// The claim is refreshed once, then found to be lost
+	mds.On("RefreshClaim", "t.com").Return(true).Once()
+	mds.On("RefreshClaim", "t.com").Return(false).Once()
+	ds := &claimRefresherDatastore{MockDatastore: mds}
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &slowRoundTrip{delay: 200 * time.Millisecond},
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 3)
+	manager.Stop()
+
+	fetched := 0
+	for _, call := range mds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fetched++
+		}
+	}
+	// Fetches take 200ms and the claim is refreshed every 333ms, so the
+	// segment is abandoned after a few of them
+	if fetched == 0 || fetched >= len(links) {
+		t.Errorf("Expected the segment to be abandoned part way through after losing the claim, got %v fetches", fetched)
+	}
+	mds.AssertExpectations(t)
+}
+
+// timeoutError is a net.Error that timed out, like the ones returned by a
+// net.Dialer with a Timeout
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+func TestFetcherTimeouts(t *testing.T) {
+	origTimeouts := walker.Config.HTTPTimeouts
+	origRetry := walker.Config.Retry
+	defer func() {
+		walker.Config.HTTPTimeouts = origTimeouts
+		walker.Config.Retry = origRetry
+	}()
+	walker.Config.HTTPTimeouts.Body = 1
+	walker.Config.Retry.MaxAttempts = 1
+
+	// A server that sends headers, then never finishes the body
+	drip, _ := io.Pipe()
+	slow := response200()
+	slow.Body = drip
+
+	rt := &sequenceRoundTrip{
+		responses: map[string][]*http.Response{
+			"http://t.com/slow.html":    {slow},
+			"http://t.com/dial.html":    {nil},
+			"http://t.com/refused.html": {nil},
+		},
+		errors: map[string][]error{
+			"http://t.com/dial.html":    {&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}},
+			"http://t.com/refused.html": {&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/slow.html"),
+		parse("http://t.com/dial.html"),
+		parse("http://t.com/refused.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	phases := map[string]string{}
+	for _, call := range ds.Calls {
+		if call.Method != "StoreURLFetchResults" {
+			continue
+		}
+		fr := call.Arguments.Get(0).(*walker.FetchResults)
+		terr, isTimeout := fr.FetchError.(*walker.TimeoutError)
+		if isTimeout != fr.TimedOut {
+			t.Errorf("Expected TimedOut to be %v for %v, FetchError: %v", isTimeout, fr.URL, fr.FetchError)
+		}
+		if isTimeout {
+			phases[fr.URL.Path] = terr.Phase
+			if !strings.HasPrefix(fr.FetchError.Error(), "timeout") {
+				t.Errorf("Expected timeout error message to start with timeout, got %q", fr.FetchError)
+			}
+		} else {
+			phases[fr.URL.Path] = "not a timeout"
+		}
+	}
+	expected := map[string]string{
+		"/slow.html":    "body",
+		"/dial.html":    "dial",
+		"/refused.html": "not a timeout",
+	}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("Expected fetches to be classified as %v\nBut got: %v", expected, phases)
+	}
+	h.AssertExpectations(t)
+}
+
+// recordingRoundTrip is a mapRoundTrip that records the links requested
+type recordingRoundTrip struct {
+	mapRoundTrip
+	requests []string
+}
+
+func (rt *recordingRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req.URL.String())
+	return rt.mapRoundTrip.RoundTrip(req)
+}
+
+// robotsCacheDatastore is a MockDatastore that is also a walker.RobotsCache
+type robotsCacheDatastore struct {
+	*MockDatastore
+	robots map[string]*walker.RobotsTxt
+	stored []*walker.RobotsTxt
+}
+
+func (ds *robotsCacheDatastore) CachedRobots(origin string) *walker.RobotsTxt {
+	return ds.robots[origin]
+}
+
+func (ds *robotsCacheDatastore) StoreRobots(r *walker.RobotsTxt) {
+	ds.stored = append(ds.stored, r)
+}
+
+func TestFetcherRobotsPerOrigin(t *testing.T) {
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader("User-agent: *\nDisallow: /private\n"))
+	rt := &recordingRoundTrip{mapRoundTrip: mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/robots.txt":       robots,
+			"https://t.com/robots.txt":      response404(),
+			"http://sub.t.com/robots.txt":   responseStatus(503, ""),
+			"http://t.com/public.html":      response200(),
+			"https://t.com/private/a.html":  response200(),
+			"http://sub.t.com/private.html": response200(),
+		},
+	}}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/private/a.html"),
+		parse("http://t.com/public.html"),
+		parse("https://t.com/private/a.html"),
+		parse("http://sub.t.com/private.html"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	stored := map[string]string{}
+	for _, call := range ds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fr := call.Arguments.Get(0).(*walker.FetchResults)
+			if fr.ExcludedByRobots {
+				stored[fr.URL.String()] = "excluded"
+			} else {
+				stored[fr.URL.String()] = "fetched"
+			}
+		}
+	}
+	expected := map[string]string{
+		// Disallowed by http://t.com/robots.txt
+		"http://t.com/private/a.html": "excluded",
+		"http://t.com/public.html":    "fetched",
+		// https://t.com/robots.txt is a 404, so everything is allowed
+		"https://t.com/private/a.html": "fetched",
+		// http://sub.t.com/robots.txt is a 503, so nothing is fetched (or
+		// stored) for now
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored fetch results %v\nBut got: %v", expected, stored)
+	}
+
+	robotsRequests := map[string]int{}
+	for _, link := range rt.requests {
+		if strings.HasSuffix(link, "/robots.txt") {
+			robotsRequests[link]++
+		}
+	}
+	expectedRequests := map[string]int{
+		"http://t.com/robots.txt":     1,
+		"https://t.com/robots.txt":    1,
+		"http://sub.t.com/robots.txt": 1,
+	}
+	if !reflect.DeepEqual(robotsRequests, expectedRequests) {
+		t.Errorf("Expected robots.txt to be fetched once per origin %v\nBut got: %v",
+			expectedRequests, robotsRequests)
+	}
+}
+
+func TestFetcherRobotsCache(t *testing.T) {
+	rt := &recordingRoundTrip{mapRoundTrip: mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/page1.html":     response200(),
+			"http://sub.t.com/page1.html": response200(),
+		},
+	}}
+
+	mds := &MockDatastore{}
+	mds.On("ClaimNewHost").Return("t.com").Once()
+	mds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/page1.html"),
+		parse("http://sub.t.com/page1.html"),
+	})
+	mds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	mds.On("UnclaimHost", "t.com").Return()
+	mds.On("ClaimNewHost").Return("")
+	ds := &robotsCacheDatastore{
+		MockDatastore: mds,
+		robots: map[string]*walker.RobotsTxt{
+			"http://t.com": {
+				Origin:     "http://t.com",
+				StatusCode: 200,
+				Body:       []byte("User-agent: *\nDisallow: /\n"),
+				FetchTime:  time.Now().Add(-time.Hour),
+				Expires:    time.Now().Add(time.Hour),
+			},
+			// Expired, so it should be fetched again
+			"http://sub.t.com": {
+				Origin:     "http://sub.t.com",
+				StatusCode: 200,
+				Body:       []byte("User-agent: *\nDisallow: /\n"),
+				FetchTime:  time.Now().Add(-2 * time.Hour),
+				Expires:    time.Now().Add(-time.Hour),
+			},
+		},
+	}
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	expectedRequests := []string{
+		"http://sub.t.com/robots.txt",
+		"http://sub.t.com/page1.html",
+	}
+	if !reflect.DeepEqual(rt.requests, expectedRequests) {
+		t.Errorf("Expected requests %v\nBut got: %v", expectedRequests, rt.requests)
+	}
+	if len(ds.stored) != 1 || ds.stored[0].Origin != "http://sub.t.com" || ds.stored[0].StatusCode != 404 {
+		t.Fatalf("Expected the refetched robots.txt to be stored, got %+v", ds.stored)
+	}
+	if !ds.stored[0].Expires.After(time.Now()) {
+		t.Errorf("Expected the stored robots.txt to expire in the future, got %v", ds.stored[0].Expires)
+	}
+}
+
+func TestFetcherRobotsRedirectsAndErrors(t *testing.T) {
+	origRedirects := walker.Config.Redirects
+	origRobots := walker.Config.Robots
+	defer func() {
+		walker.Config.Redirects = origRedirects
+		walker.Config.Robots = origRobots
+	}()
+	walker.Config.Redirects.Follow = "same_host"
+	walker.Config.Robots.CacheTime = 86400
+	walker.Config.Robots.ErrorCacheTime = 60
+
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader("User-agent: *\nDisallow: /private\n"))
+	rt := &sequenceRoundTrip{
+		responses: map[string][]*http.Response{
+			// Redirects to another host are followed for robots.txt, even
+			// though pages only follow redirects to the same host
+			"http://t.com/robots.txt":     {response307("http://www.t.com/robots.txt")},
+			"http://www.t.com/robots.txt": {robots},
+			"http://sub.t.com/robots.txt": {nil},
+			"http://t.com/public.html":    {response200()},
+			"http://t.com/private/a.html": {response200()},
+			"http://sub.t.com/page1.html": {response200()},
+		},
+		errors: map[string][]error{
+			"http://sub.t.com/robots.txt": {&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}},
+		},
+	}
+
+	mds := &MockDatastore{}
+	mds.On("ClaimNewHost").Return("t.com").Once()
+	mds.On("LinksForHost", "t.com").Return([]*walker.URL{
+		parse("http://t.com/private/a.html"),
+		parse("http://t.com/public.html"),
+		parse("http://sub.t.com/page1.html"),
+	})
+	mds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	mds.On("UnclaimHost", "t.com").Return()
+	mds.On("ClaimNewHost").Return("")
+	ds := &robotsCacheDatastore{MockDatastore: mds, robots: map[string]*walker.RobotsTxt{}}
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	stored := map[string]string{}
+	for _, call := range mds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fr := call.Arguments.Get(0).(*walker.FetchResults)
+			if fr.ExcludedByRobots {
+				stored[fr.URL.String()] = "excluded"
+			} else {
+				stored[fr.URL.String()] = "fetched"
+			}
+		}
+	}
+	expected := map[string]string{
+		// Disallowed by the robots.txt http://t.com/robots.txt redirected to
+		"http://t.com/private/a.html": "excluded",
+		"http://t.com/public.html":    "fetched",
+		// http://sub.t.com/robots.txt timed out, so nothing is fetched (or
+		// stored) for now
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored fetch results %v\nBut got: %v", expected, stored)
+	}
+
+	expires := map[string]time.Duration{}
+	for _, r := range ds.stored {
+		if r.Origin == "http://sub.t.com" && r.StatusCode != 0 {
+			t.Errorf("Expected the unreachable robots.txt to be stored with status 0, got %v", r.StatusCode)
+		}
+		expires[r.Origin] = r.Expires.Sub(r.FetchTime)
+	}
+	expectedExpires := map[string]time.Duration{
+		"http://t.com":     24 * time.Hour,
+		"http://sub.t.com": time.Minute,
+	}
+	if !reflect.DeepEqual(expires, expectedExpires) {
+		t.Errorf("Expected stored robots.txt to expire after %v\nBut got: %v", expectedExpires, expires)
+	}
+}
+
+func TestFetcherReadsSitemaps(t *testing.T) {
+	origSitemaps := walker.Config.Sitemaps
+	defer func() { walker.Config.Sitemaps = origSitemaps }()
+	walker.Config.Sitemaps.Discover = true
+
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader(
+		"User-agent: *\nDisallow: /sitemap.xml\nSitemap: http://t.com/index.xml.gz\n"))
+	index := response200()
+	index.Body = ioutil.NopCloser(bytes.NewReader(gzipped(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>http://t.com/pages.xml</loc></sitemap>
+</sitemapindex>`)))
+	pages := response200()
+	pages.Body = ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://t.com/new.html</loc><changefreq>hourly</changefreq><priority>0.9</priority></url>
+</urlset>`))
+	rt := &recordingRoundTrip{mapRoundTrip: mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/robots.txt":   robots,
+			"http://t.com/index.xml.gz": index,
+			"http://t.com/pages.xml":    pages,
+			"http://t.com/page1.html":   response200(),
+		},
+	}}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{parse("http://t.com/page1.html")})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: rt,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	var found *walker.URL
+	for _, call := range ds.Calls {
+		if call.Method == "StoreParsedURL" {
+			u := call.Arguments.Get(0).(*walker.URL)
+			if u.String() == "http://t.com/new.html" {
+				found = u
+			}
+		}
+	}
+	if found == nil {
+		t.Fatalf("Expected link from sitemap to be stored")
+	}
+	expected := walker.SitemapHints{ChangeFreq: "hourly", Priority: 0.9}
+	if found.Sitemap == nil || *found.Sitemap != expected {
+		t.Errorf("Expected sitemap hints %v but got %v", expected, found.Sitemap)
+	}
+
+	for _, link := range rt.requests {
+		if link == "http://t.com/sitemap.xml" {
+			t.Errorf("Expected /sitemap.xml not to be fetched when disallowed by robots.txt")
+		}
+	}
+}
+
+// crawlDirectivePages crawls pages with robots directives, returning the links
+// stored for each page and the FetchResults passed to the handler
+func crawlDirectivePages(t *testing.T) (map[string][]string, map[string]*walker.FetchResults) {
+	htmlPage := func(head, body string) *http.Response {
+		res := response200()
+		res.Body = ioutil.NopCloser(strings.NewReader(
+			"<!DOCTYPE html>\n<html>\n<head>" + head + "</head>\n<body>" + body + "</body>\n</html>"))
+		return res
+	}
+	metaNoFollow := htmlPage(`<meta name="ROBOTS" content="noindex, nofollow">`,
+		`<a href="/a.html">a</a>`)
+	metaOtherBot := htmlPage(`<meta name="otherbot" content="none"><meta name="walker" content="noindex">`,
+		`<a href="/b.html">b</a>`)
+	headerNoIndex := htmlPage("", `<a href="/c.html">c</a>`)
+	headerNoIndex.Header.Add("X-Robots-Tag", "otherbot: nofollow")
+	headerNoIndex.Header.Add("X-Robots-Tag", "unavailable_after: 25 Jun 2010 15:00:00 PST, noindex")
+	relNoFollow := htmlPage("", `<a href="/d.html" rel="Sponsored NOFOLLOW">d</a><a href="/e.html">e</a>`)
+	headerNone := htmlPage(`<meta name="robots" content="all">`, `<a href="/f.html">f</a>`)
+	headerNone.Header.Set("X-Robots-Tag", "walker: none")
+
+	roundTriper := mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/meta-nofollow.html":  metaNoFollow,
+			"http://t.com/meta-otherbot.html":  metaOtherBot,
+			"http://t.com/header-noindex.html": headerNoIndex,
+			"http://t.com/rel-nofollow.html":   relNoFollow,
+			"http://t.com/header-none.html":    headerNone,
+		},
+	}
+	var links []*walker.URL
+	for link := range roundTriper.responses {
+		links = append(links, parse(link))
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return(links)
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &roundTriper,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	stored := map[string][]string{}
+	for _, call := range ds.Calls {
+		if call.Method == "StoreParsedURL" {
+			u := call.Arguments.Get(0).(*walker.URL)
+			fr := call.Arguments.Get(1).(*walker.FetchResults)
+			stored[fr.URL.Path] = append(stored[fr.URL.Path], u.Path)
+		}
+	}
+	handled := map[string]*walker.FetchResults{}
+	for _, call := range h.Calls {
+		fr := call.Arguments.Get(0).(*walker.FetchResults)
+		handled[fr.URL.Path] = fr
+	}
+	if len(handled) != len(links) {
+		t.Errorf("Expected all %v pages to be handled but got %v", len(links), handled)
+	}
+	return stored, handled
+}
+
+func TestFetcherRobotsDirectives(t *testing.T) {
+	stored, handled := crawlDirectivePages(t)
+	expectedStored := map[string][]string{
+		"/meta-otherbot.html":  {"/b.html"},
+		"/header-noindex.html": {"/c.html"},
+		"/rel-nofollow.html":   {"/e.html"},
+	}
+	if !reflect.DeepEqual(stored, expectedStored) {
+		t.Errorf("Expected stored links %v\nBut got: %v", expectedStored, stored)
+	}
+	expectedFlags := map[string][2]bool{
+		"/meta-nofollow.html":  {true, true},
+		"/meta-otherbot.html":  {true, false},
+		"/header-noindex.html": {true, false},
+		"/rel-nofollow.html":   {false, false},
+		"/header-none.html":    {true, true},
+	}
+	for path, flags := range expectedFlags {
+		if fr := handled[path]; fr != nil && (fr.NoIndex != flags[0] || fr.NoFollow != flags[1]) {
+			t.Errorf("Expected %v to have NoIndex, NoFollow %v but got %v, %v",
+				path, flags, fr.NoIndex, fr.NoFollow)
+		}
+	}
+
+	orig := walker.Config.Robots.HonorPageDirectives
+	defer func() { walker.Config.Robots.HonorPageDirectives = orig }()
+	walker.Config.Robots.HonorPageDirectives = false
+
+	stored, handled = crawlDirectivePages(t)
+	expectedStored = map[string][]string{
+		"/meta-nofollow.html":  {"/a.html"},
+		"/meta-otherbot.html":  {"/b.html"},
+		"/header-noindex.html": {"/c.html"},
+		"/rel-nofollow.html":   {"/d.html", "/e.html"},
+		"/header-none.html":    {"/f.html"},
+	}
+	if !reflect.DeepEqual(stored, expectedStored) {
+		t.Errorf("Expected all links to be stored when ignoring directives %v\nBut got: %v",
+			expectedStored, stored)
+	}
+	for path, fr := range handled {
+		if fr.NoIndex || fr.NoFollow {
+			t.Errorf("Expected %v not to have NoIndex or NoFollow set when ignoring directives", path)
+		}
+	}
+}
+
+func TestFetcherExtractsLinks(t *testing.T) {
+	orig := walker.Config.IgnoreTags
+	defer func() { walker.Config.IgnoreTags = orig }()
+	walker.Config.IgnoreTags = []string{"script"}
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(`<!DOCTYPE html>
+<html>
+<head>
+	<link rel="stylesheet" href="style.css">
+	<base href="/dir/">
+	<base href="/ignored/">
+	<meta http-equiv="Refresh" content="5; URL='next.html'">
+	<meta http-equiv="refresh" content="30">
+	<meta name="description" content="not-a-link.html">
+	<script src="app.js"></script>
+</head>
+<body>
+	<a href="../about.html">about</a>
+	<img src="logo.png" srcset="logo-2x.png 2x, /img/a,b.png 3x,logo-4x.png"/>
+	<iframe src="http://other.com/frame.html"></iframe>
+	<frame src="frame.html">
+	<form action="search"></form>
+	<area href="map.html">
+</body>
+</html>`))
+	roundTriper := mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/page1.html": page,
+		},
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return([]*walker.URL{parse("http://t.com/page1.html")})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &roundTriper,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	var stored []string
+	for _, call := range ds.Calls {
+		if call.Method == "StoreParsedURL" {
+			u := call.Arguments.Get(0).(*walker.URL)
+			stored = append(stored, fmt.Sprintf("%v %v %v", u.SourceTag, u.SourceAttr, u))
+		}
+	}
+	expected := []string{
+		"link href http://t.com/dir/style.css",
+		"meta content http://t.com/dir/next.html",
+		"a href http://t.com/about.html",
+		"img src http://t.com/dir/logo.png",
+		"img srcset http://t.com/dir/logo-2x.png",
+		"img srcset http://t.com/img/a,b.png",
+		"img srcset http://t.com/dir/logo-4x.png",
+		"iframe src http://other.com/frame.html",
+		"frame src http://t.com/dir/frame.html",
+		"form action http://t.com/dir/search",
+		"area href http://t.com/dir/map.html",
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored links %v\nBut got: %v", expected, stored)
+	}
+}
+
+// wordLinkExtractor treats every word of the content as a link
+type wordLinkExtractor struct{}
+
+func (wordLinkExtractor) ExtractLinks(fr *walker.FetchResults, contents []byte) ([]*walker.URL, error) {
+	var links []*walker.URL
+	for _, word := range strings.Fields(string(contents)) {
+		links = append(links, parse(word))
+	}
+	return links, nil
+}
+
+func TestFetcherLinkExtractors(t *testing.T) {
+	if err := walker.RegisterLinkExtractor([]string{"application/x-words"}, wordLinkExtractor{}); err != nil {
+		t.Fatalf("Failed to register link extractor: %v", err)
+	}
+	if err := walker.RegisterLinkExtractor([]string{"not a media type;;"}, wordLinkExtractor{}); err == nil {
+		t.Errorf("Expected registering an invalid media type to fail")
+	}
+
+	withBody := func(ctype, body string) *http.Response {
+		res := response200()
+		res.Header.Set("Content-Type", ctype)
+		res.Body = ioutil.NopCloser(strings.NewReader(body))
+		return res
+	}
+	roundTriper := mapRoundTrip{
+		responses: map[string]*http.Response{
+			"http://t.com/rss.xml": withBody("application/rss+xml", `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+	<link>http://t.com/</link>
+	<item>
+		<link>http://t.com/post1.html</link>
+		<comments>http://t.com/post1.html#comments</comments>
+		<enclosure url="http://t.com/post1.mp3" length="1" type="audio/mpeg"/>
+	</item>
+</channel></rss>`),
+			"http://t.com/atom.xml": withBody("text/xml; charset=utf-8", `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<entry><link href="/post2.html"/></entry>
+</feed>`),
+			"http://t.com/map.xml": withBody("application/xml", `<?xml version="1.0"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://t.com/mapped.html</loc><priority>0.8</priority></url>
+</urlset>`),
+			"http://t.com/css/style.css": withBody("text/css", `@import "print.css";
+body { background: url( 'bg.png' ) }
+.logo { background-image: URL(/img/logo.png); }
+.dot { background: url(data:image/png;base64,AAAA) }`),
+			"http://t.com/links.txt": withBody("text/plain", "See http://other.com/a.html, and (https://other.com/b.html)."),
+			"http://t.com/words":     withBody("application/x-words", "http://t.com/word1.html /word2.html"),
+		},
+	}
+	var links []*walker.URL
+	for link := range roundTriper.responses {
+		links = append(links, parse(link))
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("t.com").Once()
+	ds.On("LinksForHost", "t.com").Return(links)
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "t.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &roundTriper,
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	stored := map[string][]string{}
+	var mapped *walker.URL
+	for _, call := range ds.Calls {
+		if call.Method == "StoreParsedURL" {
+			u := call.Arguments.Get(0).(*walker.URL)
+			fr := call.Arguments.Get(1).(*walker.FetchResults)
+			stored[fr.URL.Path] = append(stored[fr.URL.Path], u.String())
+			if u.Path == "/mapped.html" {
+				mapped = u
+			}
+		}
+	}
+	expected := map[string][]string{
+		// The comments link is the same page once canonicalized
+		"/rss.xml": {
+			"http://t.com/",
+			"http://t.com/post1.html",
+			"http://t.com/post1.mp3",
+		},
+		"/atom.xml": {"http://t.com/post2.html"},
+		"/map.xml":  {"http://t.com/mapped.html"},
+		"/css/style.css": {
+			"http://t.com/css/print.css",
+			"http://t.com/css/bg.png",
+			"http://t.com/img/logo.png",
+		},
+		"/links.txt": {"http://other.com/a.html", "https://other.com/b.html"},
+		"/words":     {"http://t.com/word1.html", "http://t.com/word2.html"},
+	}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored links %v\nBut got: %v", expected, stored)
+	}
+	if mapped == nil || mapped.Sitemap == nil || mapped.Sitemap.Priority != 0.8 {
+		t.Errorf("Expected link from sitemap to keep its sitemap hints")
+	}
+}
+
+func TestFetcherRedirectPolicies(t *testing.T) {
+	orig := walker.Config.Redirects
+	defer func() { walker.Config.Redirects = orig }()
+	walker.Config.Redirects.MaxHops = 2
+
+	redirect := func(code int, location string) *http.Response {
+		res := responseStatus(code, "")
+		res.Header.Set("Location", location)
+		return res
+	}
+	run := func() (map[string][]string, []string) {
+		roundTriper := mapRoundTrip{
+			responses: map[string]*http.Response{
+				"http://dom.com/page1.html":    redirect(301, "http://other.com/page.html"),
+				"http://dom.com/page2.html":    redirect(302, "http://sub.dom.com/page.html"),
+				"http://sub.dom.com/page.html": response200(),
+				"http://dom.com/page3.html":    redirect(307, "/hop1.html"),
+				"http://dom.com/hop1.html":     redirect(307, "/hop2.html"),
+				"http://dom.com/hop2.html":     redirect(307, "/hop3.html"),
+				"http://dom.com/hop3.html":     response200(),
+				"http://dom.com/page4.html":    redirect(301, "ftp://dom.com/file.txt"),
+			},
+		}
+
+		ds := &MockDatastore{}
+		ds.On("ClaimNewHost").Return("dom.com").Once()
+		ds.On("LinksForHost", "dom.com").Return([]*walker.URL{
+			parse("http://dom.com/page1.html"),
+			parse("http://dom.com/page2.html"),
+			parse("http://dom.com/page3.html"),
+			parse("http://dom.com/page4.html"),
+		})
+		ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("StoreParsedURL",
+			mock.AnythingOfType("*walker.URL"),
+			mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("UnclaimHost", "dom.com").Return()
+		ds.On("ClaimNewHost").Return("")
+
+		h := &MockHandler{}
+		h.On("HandleResponse", mock.Anything).Return()
+
+		manager := &walker.FetchManager{
+			Datastore: ds,
+			Handler:   h,
+			Transport: &roundTriper,
+		}
+		go manager.Start()
+		time.Sleep(time.Second * 2)
+		manager.Stop()
+
+		// The redirects of each fetch, with unfollowed ones marked by a !
+		redirects := map[string][]string{}
+		var stored []string
+		for _, call := range ds.Calls {
+			switch call.Method {
+			case "StoreURLFetchResults":
+				fr := call.Arguments.Get(0).(*walker.FetchResults)
+				var hops []string
+				followed := 0
+				for _, r := range fr.Redirects {
+					hop := fmt.Sprintf("%v %v -> %v", r.StatusCode, r.URL, r.Location)
+					if r.Followed {
+						followed++
+					} else {
+						hop += " !"
+					}
+					hops = append(hops, hop)
+				}
+				redirects[fr.URL.Path] = hops
+				if len(fr.RedirectedFrom) != followed {
+					t.Errorf("Expected RedirectedFrom of %v to match its followed redirects, got %v", fr.URL, fr.RedirectedFrom)
+				}
+			case "StoreParsedURL":
+				stored = append(stored, call.Arguments.Get(0).(*walker.URL).String())
+			}
+		}
+		return redirects, stored
+	}
+
+	walker.Config.Redirects.Follow = "same_domain"
+	redirects, stored := run()
+	expected := map[string][]string{
+		"/page1.html": {"301 http://dom.com/page1.html -> http://other.com/page.html !"},
+		"/page2.html": {"302 http://dom.com/page2.html -> http://sub.dom.com/page.html"},
+		"/page3.html": {
+			"307 http://dom.com/page3.html -> http://dom.com/hop1.html",
+			"307 http://dom.com/hop1.html -> http://dom.com/hop2.html",
+			"307 http://dom.com/hop2.html -> http://dom.com/hop3.html !",
+		},
+		"/page4.html": {"301 http://dom.com/page4.html -> ftp://dom.com/file.txt !"},
+	}
+	if !reflect.DeepEqual(redirects, expected) {
+		t.Errorf("Expected redirects %v\nBut got: %v", expected, redirects)
+	}
+	// Unfollowed targets are stored as links of their own (unless their
+	// scheme isn't accepted)
+	expectedStored := []string{"http://other.com/page.html", "http://dom.com/hop3.html"}
+	if !reflect.DeepEqual(stored, expectedStored) {
+		t.Errorf("Expected stored links %v but got %v", expectedStored, stored)
+	}
+
+	walker.Config.Redirects.Follow = "same_host"
+	redirects, stored = run()
+	if hops := redirects["/page2.html"]; len(hops) != 1 || !strings.HasSuffix(hops[0], "!") {
+		t.Errorf("Expected redirect to another host not to be followed with same_host, got %v", hops)
+	}
+	if len(stored) != 3 || stored[1] != "http://sub.dom.com/page.html" {
+		t.Errorf("Expected the other host's link to be stored, got %v", stored)
+	}
+
+	walker.Config.Redirects.Follow = "any"
+	redirects, stored = run()
+	if hops := redirects["/page1.html"]; len(hops) != 1 || strings.HasSuffix(hops[0], "!") {
+		t.Errorf("Expected redirect to another domain to be followed with any, got %v", hops)
+	}
+}
+
+// remoteAddrConn is a connection that reports a different remote address
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestFetcherBlacklistsEveryConnection(t *testing.T) {
+	origBlacklist := walker.Config.BlacklistPrivateIPs
+	origAllowed := walker.Config.AllowedNetworks
+	defer func() {
+		walker.Config.BlacklistPrivateIPs = origBlacklist
+		walker.Config.AllowedNetworks = origAllowed
+	}()
+	walker.Config.BlacklistPrivateIPs = true
+	walker.Config.AllowedNetworks = []string{"10.1.2.0/24"}
+
+	var mu sync.Mutex
+	requested := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.Host+r.URL.Path] = true
+		mu.Unlock()
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://internal.public.com/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>hello</body></html>"))
+	}))
+	defer server.Close()
+
+	// Every host is served by server, but appears to resolve to these IPs
+	ips := map[string]string{
+		"public.com":          "93.184.216.34",
+		"internal.public.com": "10.0.0.1",
+		"meta.public.com":     "169.254.169.254",
+		"v6.public.com":       "fd00:ec2::254",
+		"mapped.public.com":   "::ffff:127.0.0.1",
+		"allowed.public.com":  "10.1.2.3",
+	}
+	dial := func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ip = net.ParseIP(ips[host])
+		}
+		conn, err := net.Dial(network, server.Listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		p, _ := strconv.Atoi(port)
+		return &remoteAddrConn{Conn: conn, remote: &net.TCPAddr{IP: ip, Port: p}}, nil
+	}
+
+	ds := &MockDatastore{}
+	ds.On("ClaimNewHost").Return("public.com").Once()
+	ds.On("LinksForHost", "public.com").Return([]*walker.URL{
+		parse("http://public.com/redirect"),
+		parse("http://internal.public.com/"),
+		parse("http://meta.public.com/latest/meta-data/"),
+		parse("http://v6.public.com/"),
+		parse("http://mapped.public.com/"),
+		parse("http://allowed.public.com/"),
+	})
+	ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("StoreParsedURL",
+		mock.AnythingOfType("*walker.URL"),
+		mock.AnythingOfType("*walker.FetchResults")).Return()
+	ds.On("UnclaimHost", "public.com").Return()
+	ds.On("ClaimNewHost").Return("")
+
+	h := &MockHandler{}
+	h.On("HandleResponse", mock.Anything).Return()
+
+	manager := &walker.FetchManager{
+		Datastore: ds,
+		Handler:   h,
+		Transport: &http.Transport{Dial: dial},
+	}
+	go manager.Start()
+	time.Sleep(time.Second * 2)
+	manager.Stop()
+
+	refused := map[string]bool{}
+	for _, call := range ds.Calls {
+		if call.Method == "StoreURLFetchResults" {
+			fr := call.Arguments.Get(0).(*walker.FetchResults)
+			refused[fr.URL.String()] = fr.FetchError != nil &&
+				strings.Contains(fr.FetchError.Error(), "blacklisted IP address")
+		}
+	}
+	expected := map[string]bool{
+		// The redirect target is internal
+		"http://public.com/redirect":               true,
+		"http://internal.public.com/":              true,
+		"http://meta.public.com/latest/meta-data/": true,
+		"http://v6.public.com/":                    true,
+		"http://mapped.public.com/":                true,
+		"http://allowed.public.com/":               false,
+	}
+	if !reflect.DeepEqual(refused, expected) {
+		t.Errorf("Expected refused fetches %v\nBut got: %v", expected, refused)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for req := range requested {
+		if !strings.HasPrefix(req, "public.com/") && !strings.HasPrefix(req, "allowed.public.com/") {
+			t.Errorf("Expected no requests to blacklisted addresses, got %v", req)
+		}
+	}
+	ds.AssertNotCalled(t, "ExcludeDomain", mock.Anything, mock.Anything)
+}
+
+func TestFetcherPerIPLimits(t *testing.T) {
+	origFetchers := walker.Config.NumSimultaneousFetchers
+	origLimits := walker.Config.PerIPLimits
+	defer func() {
+		walker.Config.NumSimultaneousFetchers = origFetchers
+		walker.Config.PerIPLimits = origLimits
+	}()
+	walker.Config.NumSimultaneousFetchers = 2
+
+	tests := []struct {
+		tag           string
+		ips           map[string]string
+		maxConcurrent int
+		delay         int
+		inFlight      int
+		gap           time.Duration
+	}{
+		{"shared server", map[string]string{"a.com": "203.0.113.5", "b.com": "203.0.113.5"}, 1, 0, 1, 0},
+		{"separate servers", map[string]string{"a.com": "203.0.113.5", "b.com": "203.0.113.6"}, 1, 0, 2, 0},
+		{"shared server with delay", map[string]string{"a.com": "203.0.113.5", "b.com": "203.0.113.5"}, 0, 1, 1, time.Second},
+	}
+	for _, test := range tests {
+		walker.Config.PerIPLimits.MaxConcurrent = test.maxConcurrent
+		walker.Config.PerIPLimits.Delay = test.delay
+		restore := useResolver(newFakeResolver(time.Hour, test.ips), 60, 3600, 10)
+
+		var mu sync.Mutex
+		var inFlight, maxInFlight int
+		var starts []time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				http.NotFound(w, r)
+				return
+			}
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			starts = append(starts, time.Now())
+			mu.Unlock()
+
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>hello</body></html>"))
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}))
+		dial := func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, server.Listener.Addr().String())
+		}
+
+		ds := &MockDatastore{}
+		ds.On("ClaimNewHost").Return("a.com").Once()
+		ds.On("ClaimNewHost").Return("b.com").Once()
+		ds.On("ClaimNewHost").Return("")
+		for _, domain := range []string{"a.com", "b.com"} {
+			links := []*walker.URL{parse("http://" + domain + "/1.html")}
+			if test.gap == 0 {
+				links = append(links, parse("http://"+domain+"/2.html"), parse("http://"+domain+"/3.html"))
+			}
+			ds.On("LinksForHost", domain).Return(links)
+			ds.On("UnclaimHost", domain).Return()
+		}
+		ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("StoreParsedURL",
+			mock.AnythingOfType("*walker.URL"),
+			mock.AnythingOfType("*walker.FetchResults")).Return()
+
+		h := &MockHandler{}
+		h.On("HandleResponse", mock.Anything).Return()
+
+		manager := &walker.FetchManager{
+			Datastore: ds,
+			Handler:   h,
+			Transport: &http.Transport{Dial: dial},
+		}
+		go manager.Start()
+		time.Sleep(2 * time.Second)
+		manager.Stop()
+		server.Close()
+		restore()
+
+		if maxInFlight != test.inFlight {
+			t.Errorf("%v: expected at most %v requests in flight, got %v", test.tag, test.inFlight, maxInFlight)
+		}
+		// Requests are timed as they reach the server, so allow a little
+		// jitter in the gap between them
+		if len(starts) != 2 && test.gap > 0 || len(starts) != 6 && test.gap == 0 {
+			t.Errorf("%v: expected every link to be fetched, got %v requests", test.tag, len(starts))
+		} else if test.gap > 0 && starts[1].Sub(starts[0]) < test.gap-50*time.Millisecond {
+			t.Errorf("%v: expected requests at least %v apart, got %v", test.tag, test.gap, starts[1].Sub(starts[0]))
+		}
+	}
+}
+
+// crawlDelayDatastore is a MockDatastore that remembers crawl delays
+type crawlDelayDatastore struct {
+	*MockDatastore
+	mu     sync.Mutex
+	delays map[string]time.Duration
+}
+
+func (ds *crawlDelayDatastore) CachedCrawlDelay(domain string) (time.Duration, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delay, ok := ds.delays[domain]
+	return delay, ok
+}
+
+func (ds *crawlDelayDatastore) StoreCrawlDelay(domain string, delay time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.delays[domain] = delay
+}
+
+func TestFetcherAutoThrottle(t *testing.T) {
+	origThrottle := walker.Config.AutoThrottle
+	origRetry := walker.Config.Retry
+	defer func() {
+		walker.Config.AutoThrottle = origThrottle
+		walker.Config.Retry = origRetry
+	}()
+	walker.Config.AutoThrottle.Enabled = true
+	walker.Config.AutoThrottle.MinDelay = 0
+	walker.Config.AutoThrottle.MaxDelay = 60
+	walker.Config.Retry.MaxAttempts = 3
+
+	tests := []struct {
+		tag      string
+		links    int
+		status   int
+		robots   string
+		cached   time.Duration
+		minDelay time.Duration
+		maxDelay time.Duration
+		gap      time.Duration
+	}{
+		// Each of the 3 attempts doubles the delay, starting from 1s
+		{"overloaded host", 1, http.StatusServiceUnavailable, "", 0, 4 * time.Second, 4 * time.Second, 0},
+		// Each fetch moves the delay halfway toward the (tiny) response time
+		{"healthy host", 2, http.StatusOK, "", 2 * time.Second, 500 * time.Millisecond, 600 * time.Millisecond, 0},
+		// robots.txt still holds a fast host back
+		{"robots crawl delay", 2, http.StatusOK, "User-agent: *\nCrawl-delay: 1\n", 0, 0, 100 * time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		var mu sync.Mutex
+		var starts []time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				if test.robots == "" {
+					http.NotFound(w, r)
+				} else {
+					w.Write([]byte(test.robots))
+				}
+				return
+			}
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(test.status)
+			w.Write([]byte("<html><body>hello</body></html>"))
+		}))
+		dial := func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, server.Listener.Addr().String())
+		}
+
+		ds := &crawlDelayDatastore{
+			MockDatastore: &MockDatastore{},
+			delays:        map[string]time.Duration{"a.com": test.cached},
+		}
+		ds.On("ClaimNewHost").Return("a.com").Once()
+		ds.On("ClaimNewHost").Return("")
+		var links []*walker.URL
+		for i := 1; i <= test.links; i++ {
+			links = append(links, parse(fmt.Sprintf("http://a.com/%v.html", i)))
+		}
+		ds.On("LinksForHost", "a.com").Return(links)
+		ds.On("UnclaimHost", "a.com").Return()
+		ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("StoreParsedURL",
+			mock.AnythingOfType("*walker.URL"),
+			mock.AnythingOfType("*walker.FetchResults")).Return()
+
+		h := &MockHandler{}
+		h.On("HandleResponse", mock.Anything).Return()
+
+		manager := &walker.FetchManager{
+			Datastore: ds,
+			Handler:   h,
+			Transport: &http.Transport{Dial: dial},
+		}
+		go manager.Start()
+		time.Sleep(4 * time.Second)
+		manager.Stop()
+		server.Close()
+
+		delay, ok := ds.CachedCrawlDelay("a.com")
+		if !ok || delay < test.minDelay || delay > test.maxDelay {
+			t.Errorf("%v: expected a stored crawl delay between %v and %v, got %v",
+				test.tag, test.minDelay, test.maxDelay, delay)
+		}
+		if test.gap > 0 {
+			if len(starts) != 2 {
+				t.Errorf("%v: expected both links to be fetched, got %v requests", test.tag, len(starts))
+			} else if starts[1].Sub(starts[0]) < test.gap {
+				t.Errorf("%v: expected requests at least %v apart, got %v", test.tag, test.gap, starts[1].Sub(starts[0]))
+			}
+		}
+	}
+}
@@ -132,7 +132,7 @@ func getDB(t *testing.T) *gocql.Session {
 		return nil
 	}
 
-	tables := []string{"links", "segments", "domain_info"}
+	tables := []string{"links", "segments", "domain_info", "robots", "priorities"}
 	for _, table := range tables {
 		err := db.Query(fmt.Sprintf(`TRUNCATE %v`, table)).Exec()
 		if err != nil {
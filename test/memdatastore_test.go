@@ -0,0 +1,363 @@
+package test
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// memFetch builds a minimal successful FetchResults for link
+func memFetch(link string) *walker.FetchResults {
+	return &walker.FetchResults{
+		URL:       parse(link),
+		FetchTime: time.Now(),
+		Response:  response200(),
+		MimeType:  "text/html",
+	}
+}
+
+// seedMemoryDatastore stores the given links in a new MemoryDatastore as if
+// they were seeded (i.e. with add_new_domains turned on)
+func seedMemoryDatastore(links ...string) *walker.MemoryDatastore {
+	orig := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = orig }()
+	walker.Config.AddNewDomains = true
+
+	ds := walker.NewMemoryDatastore()
+	for _, l := range links {
+		ds.StoreParsedURL(parse(l), nil)
+	}
+	return ds
+}
+
+func TestMemoryDatastoreBasic(t *testing.T) {
+	ds := seedMemoryDatastore("http://test.com/page1.html", "http://test.com/page2.html")
+	page1Fetch := memFetch("http://test.com/page1.html")
+	page2Fetch := memFetch("http://test.com/page2.html")
+
+	host := ds.ClaimNewHost()
+	if host != "test.com" {
+		t.Fatalf("Expected test.com but got %v", host)
+	}
+	if next := ds.ClaimNewHost(); next != "" {
+		t.Errorf("Expected no more hosts to claim but got %v", next)
+	}
+
+	links := map[url.URL]bool{}
+	expectedLinks := map[url.URL]bool{
+		*page1Fetch.URL.URL: true,
+		*page2Fetch.URL.URL: true,
+	}
+	for u := range ds.LinksForHost("test.com") {
+		links[*u.URL] = true
+	}
+	if !reflect.DeepEqual(links, expectedLinks) {
+		t.Errorf("Expected links from LinksForHost: %v\nBut got: %v", expectedLinks, links)
+	}
+
+	ds.StoreURLFetchResults(page1Fetch)
+	ds.StoreURLFetchResults(page2Fetch)
+	ds.StoreParsedURL(parse("http://test.com/page3.html"), page1Fetch)
+	ds.UnclaimHost("test.com")
+
+	host = ds.ClaimNewHost()
+	if host != "test.com" {
+		t.Fatalf("Expected to reclaim test.com but got %v", host)
+	}
+	crawled := map[url.URL]time.Time{}
+	for u := range ds.LinksForHost("test.com") {
+		crawled[*u.URL] = u.LastCrawled
+	}
+	if len(crawled) != 3 {
+		t.Fatalf("Expected 3 links in the second segment but got %v", crawled)
+	}
+	if !crawled[*page1Fetch.URL.URL].Equal(page1Fetch.FetchTime) {
+		t.Errorf("Expected page1 LastCrawled to be %v but got %v",
+			page1Fetch.FetchTime, crawled[*page1Fetch.URL.URL])
+	}
+	if lc := crawled[*parse("http://test.com/page3.html").URL]; !lc.Equal(walker.NotYetCrawled) {
+		t.Errorf("Expected page3 to be not yet crawled but got %v", lc)
+	}
+}
+
+func TestMemoryDatastoreDeduplicates(t *testing.T) {
+	ds := seedMemoryDatastore(
+		"http://test.com/page1.html",
+		"http://test.com/page1.html",
+		"http://test.com/page1.html",
+	)
+
+	ds.ClaimNewHost()
+	count := 0
+	for _ = range ds.LinksForHost("test.com") {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Expected duplicate links to be stored once, got %v links", count)
+	}
+}
+
+func TestMemoryDatastoreNewDomainAdditions(t *testing.T) {
+	origAddNewDomains := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = origAddNewDomains }()
+
+	ds := walker.NewMemoryDatastore()
+	fr := memFetch("http://other.com/")
+
+	walker.Config.AddNewDomains = false
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), fr)
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected test.com not to be added to the crawl, but claimed %v", host)
+	}
+
+	walker.Config.AddNewDomains = true
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), fr)
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Errorf("Expected test.com to be added to the crawl, but claimed %q", host)
+	}
+}
+
+func TestMemoryDatastoreSegmentLimit(t *testing.T) {
+	origMaxLinksPerSegment := walker.Config.Dispatcher.MaxLinksPerSegment
+	defer func() { walker.Config.Dispatcher.MaxLinksPerSegment = origMaxLinksPerSegment }()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+
+	ds := seedMemoryDatastore(
+		"http://test.com/page1.html",
+		"http://test.com/page2.html",
+		"http://test.com/page3.html",
+	)
+
+	ds.ClaimNewHost()
+	count := 0
+	for _ = range ds.LinksForHost("test.com") {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected segment to be limited to 2 links, got %v", count)
+	}
+}
+
+func TestMemoryDatastorePriority(t *testing.T) {
+	ds := seedMemoryDatastore(
+		"http://low.com/page1.html",
+		"http://high.com/page1.html",
+		"http://medium.com/page1.html",
+	)
+	ds.SetDomainPriority("high.com", 10)
+	ds.SetDomainPriority("medium.com", 5)
+	if err := ds.SetDomainPriority("notcrawled.com", 1); err == nil {
+		t.Errorf("Expected an error setting the priority of a domain not in the crawl")
+	}
+
+	var claims []string
+	for host := ds.ClaimNewHost(); host != ""; host = ds.ClaimNewHost() {
+		claims = append(claims, host)
+	}
+	expected := []string{"high.com", "medium.com", "low.com"}
+	if !reflect.DeepEqual(claims, expected) {
+		t.Errorf("Expected hosts to be claimed in priority order %v, but got %v", expected, claims)
+	}
+}
+
+func TestMemoryDatastoreClaimsRoundRobinByPriority(t *testing.T) {
+	ds := seedMemoryDatastore(
+		"http://a.com/page1.html",
+		"http://b.com/page1.html",
+		"http://c.com/page1.html",
+	)
+	ds.SetDomainPriority("c.com", 5)
+
+	// A domain without links has nothing to crawl, so it is passed over
+	// despite its priority
+	ds.ExcludeDomain("empty.com", "test")
+	ds.IncludeDomain("empty.com")
+	ds.SetDomainPriority("empty.com", 10)
+
+	var claims []string
+	for i := 0; i < 4; i++ {
+		host := ds.ClaimNewHost()
+		claims = append(claims, host)
+		if host != "c.com" {
+			ds.UnclaimHost(host)
+		}
+	}
+	expected := []string{"c.com", "a.com", "b.com", "a.com"}
+	if !reflect.DeepEqual(claims, expected) {
+		t.Errorf("Expected hosts to be claimed by priority then round-robin %v, but got %v", expected, claims)
+	}
+}
+
+func TestMemoryDatastoreExclusion(t *testing.T) {
+	ds := seedMemoryDatastore("http://test.com/page1.html")
+
+	if err := ds.ExcludeDomain("test.com", "spam"); err != nil {
+		t.Fatalf("Failed to exclude test.com: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected excluded test.com not to be claimed but got %v", host)
+	}
+
+	if err := ds.IncludeDomain("test.com"); err != nil {
+		t.Fatalf("Failed to include test.com: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Errorf("Expected to claim included test.com but got %q", host)
+	}
+
+	if err := ds.IncludeDomain("notcrawled.com"); err == nil {
+		t.Errorf("Expected an error including a domain not in the crawl")
+	}
+}
+
+func TestMemoryDatastoreETag(t *testing.T) {
+	ds := seedMemoryDatastore("http://test.com/page1.html")
+
+	ds.ClaimNewHost()
+	fr := memFetch("http://test.com/page1.html")
+	fr.Response.Header.Set("ETag", `"abc123"`)
+	ds.StoreURLFetchResults(fr)
+	ds.UnclaimHost("test.com")
+
+	ds.ClaimNewHost()
+	for u := range ds.LinksForHost("test.com") {
+		if u.ETag != `"abc123"` {
+			t.Errorf("Expected stored ETag %q but got %q", `"abc123"`, u.ETag)
+		}
+
+		// A 304 without an ETag header keeps the ETag we sent
+		fr = memFetch(u.String())
+		fr.URL = u
+		fr.Response.StatusCode = http.StatusNotModified
+		ds.StoreURLFetchResults(fr)
+	}
+	ds.UnclaimHost("test.com")
+
+	ds.ClaimNewHost()
+	for u := range ds.LinksForHost("test.com") {
+		if u.ETag != `"abc123"` {
+			t.Errorf("Expected ETag %q to be kept after a 304 but got %q", `"abc123"`, u.ETag)
+		}
+		if !u.LastCrawled.Equal(fr.FetchTime) {
+			t.Errorf("Expected the 304 to be recorded as a visit at %v but got %v", fr.FetchTime, u.LastCrawled)
+		}
+	}
+}
+
+func TestMemoryDatastoreConditionalHeaders(t *testing.T) {
+	ds := seedMemoryDatastore("http://test.com/page1.html")
+	modified := time.Date(2014, time.November, 12, 10, 0, 0, 0, time.UTC)
+
+	visit := func(fr *walker.FetchResults) *walker.URL {
+		ds.ClaimNewHost()
+		ds.StoreURLFetchResults(fr)
+		ds.UnclaimHost("test.com")
+		ds.ClaimNewHost()
+		defer ds.UnclaimHost("test.com")
+		for u := range ds.LinksForHost("test.com") {
+			return u
+		}
+		t.Fatalf("Expected test.com/page1.html to be dispatched again")
+		return nil
+	}
+
+	fr := memFetch("http://test.com/page1.html")
+	fr.Response.Header.Set("ETag", `"v1"`)
+	fr.Response.Header.Set("Last-Modified", modified.Format(http.TimeFormat))
+	u := visit(fr)
+	if !u.LastModified.Equal(modified) || u.ETag != `"v1"` {
+		t.Errorf("Expected the Last-Modified and ETag of the 200, got %v and %q", u.LastModified, u.ETag)
+	}
+
+	// A failed attempt says nothing about the version of the page we have
+	fr = memFetch("http://test.com/page1.html")
+	fr.FetchTime = time.Now().Add(time.Minute)
+	fr.Response.StatusCode = http.StatusServiceUnavailable
+	fr.Response.Header.Set("ETag", `"error"`)
+	u = visit(fr)
+	if !u.LastModified.Equal(modified) || u.ETag != `"v1"` {
+		t.Errorf("Expected a 503 to keep the Last-Modified and ETag of the 200, got %v and %q",
+			u.LastModified, u.ETag)
+	}
+	if !u.LastCrawled.Equal(fr.FetchTime) {
+		t.Errorf("Expected the 503 to be recorded as a visit at %v but got %v", fr.FetchTime, u.LastCrawled)
+	}
+
+	fr = memFetch("http://test.com/page1.html")
+	fr.URL = u
+	fr.FetchTime = time.Now().Add(2 * time.Minute)
+	fr.Response.StatusCode = http.StatusNotModified
+	u = visit(fr)
+	if !u.LastModified.Equal(modified) || u.ETag != `"v1"` {
+		t.Errorf("Expected a 304 to keep the Last-Modified and ETag of the 200, got %v and %q",
+			u.LastModified, u.ETag)
+	}
+
+	// Without a Last-Modified header, the time of the crawl stands in for it
+	fr = memFetch("http://test.com/page1.html")
+	fr.FetchTime = time.Now().Add(3 * time.Minute)
+	u = visit(fr)
+	if !u.LastModified.Equal(fr.FetchTime) || u.ETag != "" {
+		t.Errorf("Expected a 200 without validators to use its fetch time %v and no ETag, got %v and %q",
+			fr.FetchTime, u.LastModified, u.ETag)
+	}
+}
+
+func TestMemoryDatastoreFingerprints(t *testing.T) {
+	origStableCrawlCount := walker.Config.Dispatcher.StableCrawlCount
+	origCollapse := walker.Config.Dispatcher.CollapseStructuralDuplicates
+	defer func() {
+		walker.Config.Dispatcher.StableCrawlCount = origStableCrawlCount
+		walker.Config.Dispatcher.CollapseStructuralDuplicates = origCollapse
+	}()
+	walker.Config.Dispatcher.StableCrawlCount = 2
+	walker.Config.Dispatcher.CollapseStructuralDuplicates = true
+
+	ds := seedMemoryDatastore(
+		"http://test.com/stable.html",
+		"http://test.com/changing.html",
+		"http://test.com/dup1.html",
+		"http://test.com/dup2.html",
+	)
+	store := func(link string, fp, structfp int64, age int) {
+		fr := memFetch(link)
+		fr.FetchTime = time.Now().Add(-time.Duration(age) * time.Hour)
+		fr.Fingerprint = fp
+		fr.StructFingerprint = structfp
+		ds.StoreURLFetchResults(fr)
+	}
+	store("http://test.com/stable.html", 1, 100, 3)
+	store("http://test.com/stable.html", 1, 100, 2)
+	store("http://test.com/stable.html", 1, 100, 1)
+	store("http://test.com/changing.html", 2, 200, 3)
+	store("http://test.com/changing.html", 3, 200, 2)
+	store("http://test.com/changing.html", 4, 200, 1)
+	store("http://test.com/dup1.html", 5, 300, 5)
+	store("http://test.com/dup2.html", 6, 300, 4)
+
+	ds.ClaimNewHost()
+	links := map[string]bool{}
+	for u := range ds.LinksForHost("test.com") {
+		links[u.Path] = true
+	}
+	expected := map[string]bool{"/changing.html": true, "/dup1.html": true}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Expected segment %v\nBut got: %v", expected, links)
+	}
+}
+
+func TestMemoryDatastoreCrawlDelay(t *testing.T) {
+	ds := seedMemoryDatastore("http://test.com/page1.html")
+
+	if delay, ok := ds.CachedCrawlDelay("test.com"); ok {
+		t.Errorf("Expected no crawl delay before one is stored, got %v", delay)
+	}
+	ds.StoreCrawlDelay("test.com", 2500*time.Millisecond)
+	if delay, ok := ds.CachedCrawlDelay("test.com"); !ok || delay != 2500*time.Millisecond {
+		t.Errorf("Expected stored crawl delay of 2.5s, got %v (%v)", delay, ok)
+	}
+}
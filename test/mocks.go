@@ -30,6 +30,20 @@ func (ds *MockDatastore) UnclaimHost(host string) {
 	ds.Mock.Called(host)
 }
 
+func (ds *MockDatastore) ExcludeDomain(domain string, reason string) error {
+	args := ds.Mock.Called(domain, reason)
+	return args.Error(0)
+}
+
+func (ds *MockDatastore) IncludeDomain(domain string) error {
+	args := ds.Mock.Called(domain)
+	return args.Error(0)
+}
+
+func (ds *MockDatastore) StoreTrapURL(u *walker.URL, reason string) {
+	ds.Mock.Called(u, reason)
+}
+
 func (ds *MockDatastore) LinksForHost(domain string) <-chan *walker.URL {
 	args := ds.Mock.Called(domain)
 	urls := args.Get(0).([]*walker.URL)
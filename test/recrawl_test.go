@@ -0,0 +1,148 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+func TestChangeRateRecrawlPolicy(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	news := &walker.LinkHistory{
+		FirstCrawled: now.Add(-11 * day),
+		LastCrawled:  now.Add(-1 * day),
+		Observations: 10,
+		Changes:      10,
+	}
+	archive := &walker.LinkHistory{
+		FirstCrawled: now.Add(-13 * day),
+		LastCrawled:  now.Add(-3 * day),
+		Observations: 10,
+		Changes:      0,
+	}
+	fresh := &walker.LinkHistory{
+		FirstCrawled: now,
+		LastCrawled:  now,
+	}
+
+	p := walker.ChangeRateRecrawlPolicy{DefaultChangeInterval: day}
+	newsScore := p.RefreshScore(news, now)
+	archiveScore := p.RefreshScore(archive, now)
+	if newsScore <= archiveScore {
+		t.Errorf("Expected frequently changing page to score higher than archive page, got %v <= %v",
+			newsScore, archiveScore)
+	}
+	if newsScore <= 0 || newsScore >= 1 || archiveScore <= 0 || archiveScore >= 1 {
+		t.Errorf("Expected scores to be probabilities, got %v and %v", newsScore, archiveScore)
+	}
+	if score := p.RefreshScore(fresh, now); score != 0 {
+		t.Errorf("Expected link crawled just now to score 0, got %v", score)
+	}
+
+	age := walker.AgeRecrawlPolicy{}
+	if age.RefreshScore(news, now) >= age.RefreshScore(archive, now) {
+		t.Errorf("Expected AgeRecrawlPolicy to score the older archive page higher")
+	}
+}
+
+// pathRecrawlPolicy refreshes the link with the given path first
+type pathRecrawlPolicy string
+
+func (p pathRecrawlPolicy) RefreshScore(h *walker.LinkHistory, now time.Time) float64 {
+	if h.URL.Path == string(p) {
+		return 1
+	}
+	return 0
+}
+
+func TestRecrawlPolicyDispatch(t *testing.T) {
+	origConfig := walker.Config.Dispatcher
+	defer func() {
+		walker.Config.Dispatcher = origConfig
+		walker.SetRecrawlPolicy(nil)
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 1
+	walker.Config.Dispatcher.RefreshPercentage = 100
+	walker.Config.Dispatcher.StableCrawlCount = 0
+
+	ds := seedMemoryDatastore("http://test.com/news.html", "http://test.com/archive.html")
+	for i := 5; i > 0; i-- {
+		fr := memFetch("http://test.com/news.html")
+		fr.FetchTime = time.Now().AddDate(0, 0, -i)
+		fr.Fingerprint = int64(i)
+		ds.StoreURLFetchResults(fr)
+
+		fr = memFetch("http://test.com/archive.html")
+		fr.FetchTime = time.Now().AddDate(0, 0, -i-2)
+		fr.Fingerprint = 100
+		ds.StoreURLFetchResults(fr)
+	}
+
+	refreshed := func() string {
+		if host := ds.ClaimNewHost(); host != "test.com" {
+			t.Fatalf("Expected to claim test.com but got %q", host)
+		}
+		defer ds.UnclaimHost("test.com")
+		var path string
+		for u := range ds.LinksForHost("test.com") {
+			path = u.Path
+		}
+		return path
+	}
+
+	tests := []struct {
+		policy   string
+		custom   walker.RecrawlPolicy
+		expected string
+	}{
+		{"change_rate", nil, "/news.html"},
+		{"age", nil, "/archive.html"},
+		{"age", pathRecrawlPolicy("/news.html"), "/news.html"},
+	}
+	for _, test := range tests {
+		walker.Config.Dispatcher.RecrawlPolicy = test.policy
+		walker.SetRecrawlPolicy(test.custom)
+		if path := refreshed(); path != test.expected {
+			t.Errorf("Expected %v (custom %v) to refresh %v but got %v",
+				test.policy, test.custom, test.expected, path)
+		}
+	}
+}
+
+func TestChangeRateRecrawlPolicySitemap(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	p := walker.ChangeRateRecrawlPolicy{DefaultChangeInterval: day}
+	history := func(sitemap *walker.SitemapHints) *walker.LinkHistory {
+		return &walker.LinkHistory{
+			FirstCrawled: now.Add(-2 * day),
+			LastCrawled:  now.Add(-day),
+			Observations: 1,
+			Sitemap:      sitemap,
+		}
+	}
+
+	plain := p.RefreshScore(history(nil), now)
+	if score := p.RefreshScore(history(&walker.SitemapHints{Priority: 0.5}), now); score != plain {
+		t.Errorf("Expected sitemap link with default priority to score %v, got %v", plain, score)
+	}
+
+	modified := p.RefreshScore(history(&walker.SitemapHints{LastMod: now.Add(-time.Hour), Priority: 0.5}), now)
+	if modified != 1 {
+		t.Errorf("Expected link modified since its last crawl to score 1, got %v", modified)
+	}
+
+	hourly := p.RefreshScore(history(&walker.SitemapHints{ChangeFreq: "hourly", Priority: 0.5}), now)
+	yearly := p.RefreshScore(history(&walker.SitemapHints{ChangeFreq: "yearly", Priority: 0.5}), now)
+	if !(hourly > plain && plain > yearly) {
+		t.Errorf("Expected changefreq to order scores hourly > none > yearly, got %v, %v, %v",
+			hourly, plain, yearly)
+	}
+
+	important := p.RefreshScore(history(&walker.SitemapHints{Priority: 1.0}), now)
+	if important <= plain {
+		t.Errorf("Expected priority 1.0 link to score higher than %v, got %v", plain, important)
+	}
+}
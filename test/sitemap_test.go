@@ -0,0 +1,169 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+const testSitemap = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url>
+		<loc>http://test.com/</loc>
+		<lastmod>2014-11-12</lastmod>
+		<changefreq>daily</changefreq>
+		<priority>1.0</priority>
+	</url>
+	<url>
+		<loc> http://test.com/about.html </loc>
+		<lastmod>2014-11-12T10:30:00+00:00</lastmod>
+		<changefreq>Yearly</changefreq>
+	</url>
+	<url>
+		<loc>http://test.com/bad.html</loc>
+		<lastmod>yesterday</lastmod>
+		<changefreq>sometimes</changefreq>
+		<priority>2.0</priority>
+	</url>
+	<url>
+		<loc>not a link</loc>
+	</url>
+</urlset>`
+
+const testSitemapIndex = `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap>
+		<loc>http://test.com/sitemap1.xml.gz</loc>
+		<lastmod>2014-11-12</lastmod>
+	</sitemap>
+	<sitemap>
+		<loc>http://test.com/sitemap2.xml</loc>
+	</sitemap>
+</sitemapindex>`
+
+func gzipped(s string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.Bytes()
+}
+
+func TestParseSitemap(t *testing.T) {
+	expected := map[string]walker.SitemapHints{
+		"http://test.com/": {
+			LastMod:    time.Date(2014, time.November, 12, 0, 0, 0, 0, time.UTC),
+			ChangeFreq: "daily",
+			Priority:   1.0,
+		},
+		"http://test.com/about.html": {
+			LastMod:    time.Date(2014, time.November, 12, 10, 30, 0, 0, time.UTC),
+			ChangeFreq: "yearly",
+			Priority:   0.5,
+		},
+		// Values that don't parse are ignored
+		"http://test.com/bad.html": {Priority: 0.5},
+	}
+
+	for _, contents := range [][]byte{[]byte(testSitemap), gzipped(testSitemap)} {
+		links, sitemaps, err := walker.ParseSitemap(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("Failed to parse sitemap: %v", err)
+		}
+		if len(sitemaps) != 0 {
+			t.Errorf("Expected no sitemaps in a urlset but got %v", sitemaps)
+		}
+		found := map[string]walker.SitemapHints{}
+		for _, u := range links {
+			found[u.String()] = *u.Sitemap
+			if !u.Sitemap.LastMod.IsZero() {
+				// Compare the instant only
+				h := found[u.String()]
+				h.LastMod = h.LastMod.UTC()
+				found[u.String()] = h
+			}
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("Expected sitemap links %v\nBut got: %v", expected, found)
+		}
+	}
+
+	links, sitemaps, err := walker.ParseSitemap(strings.NewReader(testSitemapIndex))
+	if err != nil {
+		t.Fatalf("Failed to parse sitemap index: %v", err)
+	}
+	if len(links) != 0 {
+		t.Errorf("Expected no links in a sitemap index but got %v", links)
+	}
+	if len(sitemaps) != 2 || sitemaps[0].String() != "http://test.com/sitemap1.xml.gz" ||
+		sitemaps[1].String() != "http://test.com/sitemap2.xml" {
+		t.Errorf("Expected the 2 sitemaps of the index but got %v", sitemaps)
+	}
+
+	// A sitemap cut off partway through returns the links up to that point
+	cutoff := testSitemap[:strings.Index(testSitemap, "<loc>http://test.com/bad.html")]
+	links, _, err = walker.ParseSitemap(strings.NewReader(cutoff))
+	if err == nil {
+		t.Errorf("Expected an error parsing a truncated sitemap")
+	}
+	if len(links) != 2 {
+		t.Errorf("Expected the 2 complete links of a truncated sitemap but got %v", links)
+	}
+}
+
+func TestSitemapLinksUsesFetcherTransport(t *testing.T) {
+	origBlacklist := walker.Config.BlacklistPrivateIPs
+	defer func() { walker.Config.BlacklistPrivateIPs = origBlacklist }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testSitemap))
+	}))
+	defer server.Close()
+	u := parse(server.URL + "/sitemap.xml")
+
+	walker.Config.BlacklistPrivateIPs = false
+	if links := walker.SitemapLinks(u); len(links) != 3 {
+		t.Errorf("Expected 3 links from the sitemap, got %v", links)
+	}
+
+	// The test server listens on a private address
+	walker.Config.BlacklistPrivateIPs = true
+	if links := walker.SitemapLinks(u); len(links) != 0 {
+		t.Errorf("Expected the sitemap on a blacklisted address not to be fetched, got %v", links)
+	}
+}
+
+func TestSitemapPriorityInSegments(t *testing.T) {
+	origDispatcher := walker.Config.Dispatcher
+	defer func() { walker.Config.Dispatcher = origDispatcher }()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+
+	ds := seedMemoryDatastore(
+		"http://test.com/page1.html",
+		"http://test.com/page2.html",
+		"http://test.com/page3.html",
+		"http://test.com/page4.html",
+	)
+	for path, priority := range map[string]float64{"/page2.html": 0.9, "/page4.html": 0.8, "/page1.html": 0.1} {
+		u := parse("http://test.com" + path)
+		u.Sitemap = &walker.SitemapHints{Priority: priority}
+		ds.StoreParsedURL(u, nil)
+	}
+
+	ds.ClaimNewHost()
+	var paths []string
+	for u := range ds.LinksForHost("test.com") {
+		paths = append(paths, u.Path)
+	}
+	expected := []string{"/page2.html", "/page4.html"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected the highest priority links %v but got %v", expected, paths)
+	}
+}
@@ -0,0 +1,509 @@
+package test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// useSQLDatastore points the config at a fresh SQLite database with the walker
+// schema created. The returned function restores the config and removes the
+// database.
+func useSQLDatastore(t *testing.T) func() {
+	f, err := ioutil.TempFile("", "walker-test-db")
+	if err != nil {
+		t.Fatalf("Failed to create temp sqlite file: %v", err)
+	}
+	f.Close()
+
+	origDatastore := walker.Config.Datastore
+	origSQL := walker.Config.SQL
+	walker.Config.Datastore = "sql"
+	walker.Config.SQL.Driver = "sqlite3"
+	walker.Config.SQL.DataSource = f.Name()
+
+	if err := walker.CreateSQLSchema(); err != nil {
+		t.Fatalf("Failed to create sql schema: %v", err)
+	}
+
+	return func() {
+		walker.Config.Datastore = origDatastore
+		walker.Config.SQL = origSQL
+		os.Remove(f.Name())
+	}
+}
+
+func getSQLDS(t *testing.T) *walker.SQLDatastore {
+	ds, err := walker.NewSQLDatastore()
+	if err != nil {
+		t.Fatalf("Failed to create SQLDatastore: %v", err)
+	}
+	return ds
+}
+
+func TestSQLDatastoreAndDispatcher(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	origAddNewDomains := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = origAddNewDomains }()
+	walker.Config.AddNewDomains = true
+
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), nil)
+	ds.StoreParsedURL(parse("http://test.com/page2.html"), nil)
+	ds.StoreParsedURL(parse("http://test.com/page2.html"), nil)
+
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Fatalf("Expected no host to claim before dispatching, but got %v", host)
+	}
+
+	d := &walker.SQLDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(100 * time.Millisecond)
+	d.StopDispatcher()
+
+	host := ds.ClaimNewHost()
+	if host != "test.com" {
+		t.Fatalf("Expected test.com but got %q", host)
+	}
+
+	page1Fetch := memFetch("http://test.com/page1.html")
+	page2Fetch := memFetch("http://test.com/page2.html")
+	links := map[url.URL]bool{}
+	expectedLinks := map[url.URL]bool{
+		*page1Fetch.URL.URL: true,
+		*page2Fetch.URL.URL: true,
+	}
+	for u := range ds.LinksForHost("test.com") {
+		links[*u.URL] = true
+	}
+	if !reflect.DeepEqual(links, expectedLinks) {
+		t.Errorf("Expected links from LinksForHost: %v\nBut got: %v", expectedLinks, links)
+	}
+
+	ds.StoreURLFetchResults(page1Fetch)
+	ds.StoreURLFetchResults(page2Fetch)
+	ds.UnclaimHost("test.com")
+
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected unclaimed host to be undispatched, but claimed %v", host)
+	}
+}
+
+func TestSQLDatastoreClaimsOnce(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds1 := getSQLDS(t)
+	defer ds1.Close()
+	ds2 := getSQLDS(t)
+	defer ds2.Close()
+
+	db, err := walker.OpenSQLDatabase()
+	if err != nil {
+		t.Fatalf("Failed to open sql database: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority)
+						VALUES ('test.com', '', 1, 0)`)
+	if err != nil {
+		t.Fatalf("Failed to insert test domain: %v", err)
+	}
+
+	claims := []string{ds1.ClaimNewHost(), ds2.ClaimNewHost()}
+	if !reflect.DeepEqual(claims, []string{"test.com", ""}) {
+		t.Errorf("Expected test.com to be claimed exactly once, got %v", claims)
+	}
+}
+
+func TestSQLDispatcherReleasesStaleClaims(t *testing.T) {
+	defer useSQLDatastore(t)()
+
+	origTimeout := walker.Config.Dispatcher.StaleClaimTimeout
+	origInterval := walker.Config.Dispatcher.StaleClaimCheckInterval
+	defer func() {
+		walker.Config.Dispatcher.StaleClaimTimeout = origTimeout
+		walker.Config.Dispatcher.StaleClaimCheckInterval = origInterval
+	}()
+	walker.Config.Dispatcher.StaleClaimTimeout = 60
+	walker.Config.Dispatcher.StaleClaimCheckInterval = 1
+
+	db, err := walker.OpenSQLDatabase()
+	if err != nil {
+		t.Fatalf("Failed to open sql database: %v", err)
+	}
+	insertDomainInfo := `INSERT INTO domain_info (dom, claim_tok, claim_time, dispatched, priority)
+							VALUES (?, ?, ?, 1, 0)`
+	if _, err := db.Exec(insertDomainInfo, "stale.com", "crawler1", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("Failed to insert test domain: %v", err)
+	}
+	if _, err := db.Exec(insertDomainInfo, "fresh.com", "crawler2", time.Now()); err != nil {
+		t.Fatalf("Failed to insert test domain: %v", err)
+	}
+	db.Close()
+
+	d := &walker.SQLDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(1500 * time.Millisecond)
+	d.StopDispatcher()
+
+	ds := getSQLDS(t)
+	defer ds.Close()
+	claims := []string{ds.ClaimNewHost(), ds.ClaimNewHost()}
+	if !reflect.DeepEqual(claims, []string{"stale.com", ""}) {
+		t.Errorf("Expected only stale.com to be claimable, got %v", claims)
+	}
+}
+
+func TestSQLDatastoreUnclaimAfterLostClaim(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	db, err := walker.OpenSQLDatabase()
+	if err != nil {
+		t.Fatalf("Failed to open sql database: %v", err)
+	}
+	defer db.Close()
+	queries := []string{
+		`INSERT INTO domain_info (dom, claim_tok, dispatched, priority) VALUES ('test.com', '', 1, 0)`,
+		`INSERT INTO segments (dom, subdom, path, proto, time) VALUES ('test.com', '', '/page1.html', 'http', '1970-01-01')`,
+	}
+	for _, q := range queries {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Failed to insert test data: %v\nQuery: %v", err, q)
+		}
+	}
+
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Fatalf("Expected to claim test.com but got %q", host)
+	}
+	if !ds.RefreshClaim("test.com") {
+		t.Errorf("Expected to refresh our claim on test.com")
+	}
+
+	// Our claim is released as stale and another crawler claims test.com
+	if _, err := db.Exec(`UPDATE domain_info SET claim_tok = 'crawler2' WHERE dom = 'test.com'`); err != nil {
+		t.Fatalf("Failed to reassign test.com: %v", err)
+	}
+	if ds.RefreshClaim("test.com") {
+		t.Errorf("Expected refreshing a lost claim to fail")
+	}
+	ds.UnclaimHost("test.com")
+
+	var tok string
+	var dispatched bool
+	err = db.QueryRow(`SELECT claim_tok, dispatched FROM domain_info WHERE dom = 'test.com'`).Scan(&tok, &dispatched)
+	if err != nil {
+		t.Fatalf("Failed to read domain_info: %v", err)
+	}
+	if tok != "crawler2" || !dispatched {
+		t.Errorf("Expected the new owner's claim to be kept, got claim_tok %q and dispatched %v", tok, dispatched)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM segments WHERE dom = 'test.com'`).Scan(&count); err != nil {
+		t.Fatalf("Failed to count segment links: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected the new owner's segment to be kept, found %v links", count)
+	}
+}
+
+func TestSQLDatastorePriority(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	origAddNewDomains := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = origAddNewDomains }()
+	walker.Config.AddNewDomains = true
+
+	ds.StoreParsedURL(parse("http://low.com/page1.html"), nil)
+	ds.StoreParsedURL(parse("http://high.com/page1.html"), nil)
+	ds.StoreParsedURL(parse("http://medium.com/page1.html"), nil)
+	if err := ds.SetDomainPriority("high.com", 10); err != nil {
+		t.Fatalf("Failed to set priority: %v", err)
+	}
+	if err := ds.SetDomainPriority("medium.com", 5); err != nil {
+		t.Fatalf("Failed to set priority: %v", err)
+	}
+	if err := ds.SetDomainPriority("notcrawled.com", 1); err == nil {
+		t.Errorf("Expected an error setting the priority of a domain not in the crawl")
+	}
+
+	d := &walker.SQLDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(100 * time.Millisecond)
+	d.StopDispatcher()
+
+	var claims []string
+	for host := ds.ClaimNewHost(); host != ""; host = ds.ClaimNewHost() {
+		claims = append(claims, host)
+	}
+	expected := []string{"high.com", "medium.com", "low.com"}
+	if !reflect.DeepEqual(claims, expected) {
+		t.Errorf("Expected hosts to be claimed in priority order %v, but got %v", expected, claims)
+	}
+}
+
+func TestSQLDatastoreExclusion(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	origAddNewDomains := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = origAddNewDomains }()
+	walker.Config.AddNewDomains = true
+
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), nil)
+	if err := ds.ExcludeDomain("test.com", "spam"); err != nil {
+		t.Fatalf("Failed to exclude test.com: %v", err)
+	}
+
+	d := &walker.SQLDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(100 * time.Millisecond)
+	d.StopDispatcher()
+
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected excluded test.com not to be dispatched or claimed but got %v", host)
+	}
+
+	if err := ds.IncludeDomain("test.com"); err != nil {
+		t.Fatalf("Failed to include test.com: %v", err)
+	}
+	d = &walker.SQLDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(100 * time.Millisecond)
+	d.StopDispatcher()
+
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Errorf("Expected to claim included test.com but got %q", host)
+	}
+}
+
+func TestSQLDatastoreRobotsCache(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	if r := ds.CachedRobots("http://test.com"); r != nil {
+		t.Errorf("Expected no cached robots.txt but got %+v", r)
+	}
+
+	fetched := time.Now().Truncate(time.Second)
+	for _, stat := range []int{503, 200} {
+		ds.StoreRobots(&walker.RobotsTxt{
+			Origin:     "http://test.com",
+			StatusCode: stat,
+			Body:       []byte("User-agent: *\nDisallow: /private\n"),
+			FetchTime:  fetched,
+			Expires:    fetched.Add(time.Hour),
+		})
+	}
+
+	r := ds.CachedRobots("http://test.com")
+	if r == nil {
+		t.Fatalf("Expected a cached robots.txt")
+	}
+	if r.StatusCode != 200 || string(r.Body) != "User-agent: *\nDisallow: /private\n" {
+		t.Errorf("Expected the last stored robots.txt but got %+v", r)
+	}
+	if !r.FetchTime.Equal(fetched) || !r.Expires.Equal(fetched.Add(time.Hour)) {
+		t.Errorf("Expected times %v and %v but got %v and %v",
+			fetched, fetched.Add(time.Hour), r.FetchTime, r.Expires)
+	}
+	if r := ds.CachedRobots("https://test.com"); r != nil {
+		t.Errorf("Expected https://test.com not to share http://test.com's robots.txt, got %+v", r)
+	}
+}
+
+func TestSQLDatastoreRedirects(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	// page1 redirected to page2 (followed), which redirected to another
+	// domain (not followed)
+	res := response307("http://other.com/page.html")
+	res.StatusCode = 302
+	fr := &walker.FetchResults{
+		URL:            parse("http://test.com/page1.html"),
+		RedirectedFrom: []*walker.URL{parse("http://test.com/page2.html")},
+		Redirects: []walker.Redirect{
+			{
+				URL:        parse("http://test.com/page1.html"),
+				StatusCode: 301,
+				Location:   parse("http://test.com/page2.html"),
+				Followed:   true,
+			},
+			{
+				URL:        parse("http://test.com/page2.html"),
+				StatusCode: 302,
+				Location:   parse("http://other.com/page.html"),
+			},
+		},
+		Response:  res,
+		FetchTime: time.Now(),
+	}
+	ds.StoreURLFetchResults(fr)
+
+	db, err := sql.Open(walker.Config.SQL.Driver, walker.Config.SQL.DataSource)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	expected := map[string]struct {
+		stat  int
+		redto string
+	}{
+		"/page1.html": {301, "http://test.com/page2.html"},
+		"/page2.html": {302, "http://other.com/page.html"},
+	}
+	for path, exp := range expected {
+		var stat int
+		var redto string
+		err := db.QueryRow(`SELECT stat, redto_url FROM links WHERE dom = ? AND path = ?`,
+			"test.com", path).Scan(&stat, &redto)
+		if err != nil {
+			t.Errorf("Failed to find link %v: %v", path, err)
+			continue
+		}
+		if stat != exp.stat || redto != exp.redto {
+			t.Errorf("Expected %v to have stat %v and redto_url %q, got %v and %q",
+				path, exp.stat, exp.redto, stat, redto)
+		}
+	}
+}
+
+func TestSQLDatastoreStoresLinkSource(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	img := parse("http://test.com/img.png")
+	img.SourceTag, img.SourceAttr = "img", "src"
+	ds.StoreParsedURL(img, nil)
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), nil)
+
+	// Found again in another tag, the link is not duplicated
+	img = parse("http://test.com/img.png")
+	img.SourceTag, img.SourceAttr = "img", "srcset"
+	ds.StoreParsedURL(img, nil)
+
+	db, err := sql.Open(walker.Config.SQL.Driver, walker.Config.SQL.DataSource)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	expected := map[string]struct{ tag, attr string }{
+		"/img.png":    {"img", "srcset"},
+		"/page1.html": {"", ""},
+	}
+	for path, exp := range expected {
+		var count int
+		var tag, attr string
+		err := db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(source_tag), ''), COALESCE(MAX(source_attr), '')
+							FROM links WHERE dom = ? AND path = ?`,
+			"test.com", path).Scan(&count, &tag, &attr)
+		if err != nil {
+			t.Errorf("Failed to find link %v: %v", path, err)
+			continue
+		}
+		if count != 1 || tag != exp.tag || attr != exp.attr {
+			t.Errorf("Expected one %v link with source %q %q, got %v with %q %q",
+				path, exp.tag, exp.attr, count, tag, attr)
+		}
+	}
+}
+
+func TestSQLDatastoreSkipsUnresolvableDomains(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	origAddNewDomains := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = origAddNewDomains }()
+	walker.Config.AddNewDomains = true
+
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), nil)
+	ds.StoreParsedURL(parse("http://dead.com/page1.html"), nil)
+	ds.StoreParsedURL(parse("http://www.dead.com/page1.html"), nil)
+	ds.StoreParsedURL(parse("http://www.dead.com/page2.html"), nil)
+	ds.SetDomainPriority("test.com", 1)
+
+	d := &walker.SQLDispatcher{}
+	go d.StartDispatcher()
+	time.Sleep(100 * time.Millisecond)
+	d.StopDispatcher()
+
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Fatalf("Expected to claim test.com first but got %q", host)
+	}
+	if claimed := ds.ClaimedDomains(); !reflect.DeepEqual(claimed, []string{"dead.com"}) {
+		t.Fatalf("Expected dead.com to be waiting to be handed out, got %v", claimed)
+	}
+	hosts := map[string]bool{}
+	for _, h := range ds.SegmentHosts("dead.com") {
+		hosts[h] = true
+	}
+	if !reflect.DeepEqual(hosts, map[string]bool{"dead.com": true, "www.dead.com": true}) {
+		t.Errorf("Expected segment hosts dead.com and www.dead.com, got %v", hosts)
+	}
+
+	ds.SkipUnresolvableDomain("dead.com", "Failed to resolve")
+	if claimed := ds.ClaimedDomains(); len(claimed) != 0 {
+		t.Errorf("Expected no domains waiting after skipping dead.com, got %v", claimed)
+	}
+	if host := ds.ClaimNewHost(); host != "" {
+		t.Errorf("Expected skipped dead.com not to be claimed again yet, got %q", host)
+	}
+
+	db, err := walker.OpenSQLDatabase()
+	if err != nil {
+		t.Fatalf("Failed to open sql database: %v", err)
+	}
+	defer db.Close()
+	var reason string
+	if err := db.QueryRow(`SELECT dns_error FROM domain_info WHERE dom = 'dead.com'`).Scan(&reason); err != nil {
+		t.Fatalf("Failed to read dns_error: %v", err)
+	}
+	if reason != "Failed to resolve" {
+		t.Errorf("Expected dns_error to be recorded, got %q", reason)
+	}
+	_, err = db.Exec(`UPDATE domain_info SET dns_retry_time = ? WHERE dom = 'dead.com'`,
+		time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to update dns_retry_time: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "dead.com" {
+		t.Errorf("Expected dead.com to be claimed again after its retry time, got %q", host)
+	}
+}
+
+func TestSQLDatastoreCrawlDelay(t *testing.T) {
+	defer useSQLDatastore(t)()
+	ds := getSQLDS(t)
+	defer ds.Close()
+
+	origAddNewDomains := walker.Config.AddNewDomains
+	defer func() { walker.Config.AddNewDomains = origAddNewDomains }()
+	walker.Config.AddNewDomains = true
+	ds.StoreParsedURL(parse("http://test.com/page1.html"), nil)
+
+	if delay, ok := ds.CachedCrawlDelay("test.com"); ok {
+		t.Errorf("Expected no crawl delay before one is stored, got %v", delay)
+	}
+	ds.StoreCrawlDelay("test.com", 2500*time.Millisecond)
+	if delay, ok := ds.CachedCrawlDelay("test.com"); !ok || delay != 2500*time.Millisecond {
+		t.Errorf("Expected stored crawl delay of 2.5s, got %v (%v)", delay, ok)
+	}
+}
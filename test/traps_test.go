@@ -0,0 +1,66 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+func TestDetectCrawlerTrap(t *testing.T) {
+	thisYear := time.Now().Year()
+	tests := []struct {
+		link string
+		trap bool
+	}{
+		{"http://test.com/", false},
+		{"http://test.com/a/b/c/page.html?x=1&y=2", false},
+		{"http://test.com/" + strings.Repeat("d/", 17), true},
+		{"http://test.com/a/b/a/b/a/b/a/b/", true},
+		{"http://test.com/a/b/a/b/a/b/", false},
+		{"http://test.com/search?" + strings.Repeat("q=x&", 13), true},
+		{"http://test.com/page.jsp;jsessionid=ABC123", true},
+		{"http://test.com/page.php?PHPSESSID=ABC123", true},
+		{"http://test.com/page.php?sidebar=1", false},
+		{fmt.Sprintf("http://test.com/news/%v/09/21/story.html", thisYear), false},
+		{fmt.Sprintf("http://test.com/calendar/%v/01/", thisYear+3), true},
+		{"http://test.com/calendar/1950-01", true},
+		{fmt.Sprintf("http://test.com/calendar?month=%v-01", thisYear+10), true},
+		{fmt.Sprintf("http://test.com/calendar?year=%v", thisYear+10), true},
+		{fmt.Sprintf("http://test.com/calendar?year=%v", thisYear), false},
+		{"http://test.com/products/1950", false},
+	}
+	for _, test := range tests {
+		reason := walker.DetectCrawlerTrap(parse(test.link))
+		if test.trap && reason == "" {
+			t.Errorf("Expected %v to be detected as a crawler trap", test.link)
+		} else if !test.trap && reason != "" {
+			t.Errorf("Expected %v not to be a crawler trap, got %q", test.link, reason)
+		}
+	}
+}
+
+func TestDetectCrawlerTrapDisabled(t *testing.T) {
+	orig := walker.Config.TrapDetection
+	defer func() { walker.Config.TrapDetection = orig }()
+	walker.Config.TrapDetection.MaxPathDepth = 0
+	walker.Config.TrapDetection.MaxRepeatedPathSegments = 0
+	walker.Config.TrapDetection.MaxQueryParams = 0
+	walker.Config.TrapDetection.SessionIDParams = nil
+	walker.Config.TrapDetection.MaxCalendarYearsAhead = -1
+	walker.Config.TrapDetection.MaxCalendarYearsBack = -1
+
+	links := []string{
+		"http://test.com/" + strings.Repeat("a/", 20),
+		"http://test.com/search?" + strings.Repeat("q=x&", 13),
+		"http://test.com/page.jsp;jsessionid=ABC123",
+		"http://test.com/calendar/2999/01/",
+	}
+	for _, link := range links {
+		if reason := walker.DetectCrawlerTrap(parse(link)); reason != "" {
+			t.Errorf("Expected %v not to be a crawler trap with detection disabled, got %q", link, reason)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package walker
+
+import (
+	"net/http"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// nextCrawlDelay returns the crawl delay to use after a fetch that took
+// latency and gave fr, following Config.AutoThrottle. A host that failed
+// with a timeout, a connection error, or a 429 or 5XX response is backed off
+// by doubling delay; otherwise delay moves halfway toward latency, so a host
+// is crawled more slowly as it answers more slowly, and faster (down to
+// MinDelay) while it answers quickly.
+func nextCrawlDelay(delay time.Duration, fr *FetchResults, latency time.Duration) time.Duration {
+	if overloaded(fr) {
+		if delay < time.Second {
+			delay = time.Second
+		} else {
+			delay *= 2
+		}
+	} else {
+		delay = (delay + latency) / 2
+	}
+	return clampCrawlDelay(delay)
+}
+
+// clampCrawlDelay bounds delay by Config.AutoThrottle.MinDelay and MaxDelay.
+func clampCrawlDelay(delay time.Duration) time.Duration {
+	min := time.Duration(Config.AutoThrottle.MinDelay) * time.Second
+	max := time.Duration(Config.AutoThrottle.MaxDelay) * time.Second
+	if delay < min {
+		delay = min
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// overloaded returns true if fr suggests its host is struggling to keep up
+// with us.
+func overloaded(fr *FetchResults) bool {
+	if fr.FetchError != nil {
+		return fr.TimedOut || isRetryable(fr)
+	}
+	code := fr.Response.StatusCode
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// initCrawlDelay sets the crawl delay of the host just claimed: the delay
+// learned the last time it was crawled if the datastore remembers it, or
+// Config.DefaultCrawlDelay.
+func (f *fetcher) initCrawlDelay() {
+	f.delay = time.Duration(Config.DefaultCrawlDelay) * time.Second
+	if !Config.AutoThrottle.Enabled {
+		return
+	}
+	if cache, ok := f.fm.Datastore.(CrawlDelayCache); ok {
+		if delay, ok := cache.CachedCrawlDelay(f.host); ok {
+			f.delay = delay
+		}
+	}
+	f.delay = clampCrawlDelay(f.delay)
+}
+
+// adjustCrawlDelay updates the crawl delay of the current host after a fetch
+// that took latency and gave fr.
+func (f *fetcher) adjustCrawlDelay(fr *FetchResults, latency time.Duration) {
+	if !Config.AutoThrottle.Enabled {
+		return
+	}
+	delay := nextCrawlDelay(f.delay, fr, latency)
+	if delay != f.delay {
+		log4go.Debug("Crawl delay of %v now %v (last fetch took %v)", f.host, delay, latency)
+	}
+	f.delay = delay
+}
+
+// storeCrawlDelay saves the crawl delay learned for the current host, if the
+// datastore can remember it.
+func (f *fetcher) storeCrawlDelay() {
+	if !Config.AutoThrottle.Enabled {
+		return
+	}
+	if cache, ok := f.fm.Datastore.(CrawlDelayCache); ok {
+		cache.StoreCrawlDelay(f.host, f.delay)
+	}
+}
@@ -0,0 +1,122 @@
+package walker
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarPathDate matches year/month(/day) dates in a path, separated by
+// slashes or dashes, ex. /2014/09/ or /events/2014-09-21
+var calendarPathDate = regexp.MustCompile(`(?:^|/)((?:19|20|21)\d\d)[/-](0?[1-9]|1[0-2])(?:[/-](0?[1-9]|[12]\d|3[01]))?(?:/|$)`)
+
+// calendarQueryDate matches query values that are dates, ex. 2014-09 or
+// 2014-09-21
+var calendarQueryDate = regexp.MustCompile(`^(\d{4})-\d{1,2}(?:-\d{1,2})?$`)
+
+// calendarYearParams are query parameters that hold just a year
+var calendarYearParams = map[string]bool{"year": true, "yr": true, "y": true}
+
+// DetectCrawlerTrap returns why u looks like a crawler trap, or an empty
+// string if it doesn't. Links that are traps lead to an effectively infinite
+// number of pages (or copies of the same page), so they should not be stored.
+// The checks and their thresholds are set in Config.TrapDetection.
+func DetectCrawlerTrap(u *URL) string {
+	tc := &Config.TrapDetection
+
+	var segments []string
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+
+	if tc.MaxPathDepth > 0 && len(segments) > tc.MaxPathDepth {
+		return fmt.Sprintf("path depth %v exceeds %v", len(segments), tc.MaxPathDepth)
+	}
+
+	if tc.MaxRepeatedPathSegments > 0 {
+		counts := map[string]int{}
+		for _, seg := range segments {
+			counts[seg]++
+			if counts[seg] > tc.MaxRepeatedPathSegments {
+				return fmt.Sprintf("path segment %q repeats more than %v times", seg, tc.MaxRepeatedPathSegments)
+			}
+		}
+	}
+
+	query := u.Query()
+	if tc.MaxQueryParams > 0 {
+		n := 0
+		for _, values := range query {
+			n += len(values)
+		}
+		if n > tc.MaxQueryParams {
+			return fmt.Sprintf("%v query parameters exceeds %v", n, tc.MaxQueryParams)
+		}
+	}
+
+	for _, name := range tc.SessionIDParams {
+		name = strings.ToLower(name)
+		// Session IDs show up as query parameters or as path parameters
+		// (ex. /page.jsp;jsessionid=ABC)
+		if strings.Contains(strings.ToLower(u.Path), ";"+name+"=") {
+			return fmt.Sprintf("session ID %v in path", name)
+		}
+		for param := range query {
+			if strings.ToLower(param) == name {
+				return fmt.Sprintf("session ID parameter %v", param)
+			}
+		}
+	}
+
+	if tc.MaxCalendarYearsAhead >= 0 || tc.MaxCalendarYearsBack >= 0 {
+		for _, year := range calendarYears(u.Path, query) {
+			if reason := calendarYearOutOfRange(year); reason != "" {
+				return reason
+			}
+		}
+	}
+
+	return ""
+}
+
+// calendarYears returns the years of any dates found in the given path and
+// query.
+func calendarYears(path string, query map[string][]string) []int {
+	var years []int
+	for _, m := range calendarPathDate.FindAllStringSubmatch(path, -1) {
+		year, _ := strconv.Atoi(m[1])
+		years = append(years, year)
+	}
+	for param, values := range query {
+		isYearParam := calendarYearParams[strings.ToLower(param)]
+		for _, v := range values {
+			if m := calendarQueryDate.FindStringSubmatch(v); m != nil {
+				year, _ := strconv.Atoi(m[1])
+				years = append(years, year)
+			} else if year, err := strconv.Atoi(v); isYearParam && err == nil && len(v) == 4 {
+				years = append(years, year)
+			}
+		}
+	}
+	return years
+}
+
+// calendarYearOutOfRange returns why year is too far from the current year
+// to be a real page (as opposed to infinite calendar pagination), or an
+// empty string if it isn't. A negative Config.TrapDetection limit disables
+// that side of the check.
+func calendarYearOutOfRange(year int) string {
+	tc := &Config.TrapDetection
+	now := time.Now().Year()
+	if tc.MaxCalendarYearsAhead >= 0 && year > now+tc.MaxCalendarYearsAhead {
+		return fmt.Sprintf("calendar date in %v is more than %v years ahead", year, tc.MaxCalendarYearsAhead)
+	}
+	if tc.MaxCalendarYearsBack >= 0 && year < now-tc.MaxCalendarYearsBack {
+		return fmt.Sprintf("calendar date in %v is more than %v years back", year, tc.MaxCalendarYearsBack)
+	}
+	return ""
+}
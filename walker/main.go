@@ -2,6 +2,10 @@ package main
 
 import (
 	"github.com/iParadigms/walker/cmd"
+
+	// database/sql drivers for the sql datastore
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {